@@ -1,117 +1,504 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/sqlitedialect"
 	"github.com/uptrace/bun/driver/sqliteshim"
+	"github.com/uptrace/bun/schema"
+	"golang.org/x/time/rate"
 )
 
 // Message represents a queue message
 type Message struct {
 	ID         int64     `bun:",pk,autoincrement" json:"id"`
 	Text       string    `bun:",notnull" json:"text"`
+	Priority   int       `bun:",notnull" json:"priority"`
 	State      string    `bun:",notnull" json:"-"`
 	CreatedAt  time.Time `bun:"created_at,nullzero,notnull,default:CURRENT_TIMESTAMP" json:"timestamp"`
 	ArchivedAt time.Time `bun:"archived_at,nullzero" json:"-"`
+	// LeasedUntil is when a leased message that wasn't acked returns to new
+	LeasedUntil time.Time `bun:"leased_until,nullzero" json:"-"`
+	// ExpiresAt is when a message that wasn't consumed is dropped
+	ExpiresAt time.Time `bun:"expires_at,nullzero" json:"-"`
+	// Topic splits the inbox into queues, GET with a topic only consumes
+	// messages with that topic
+	Topic string `bun:",notnull" json:"topic,omitempty"`
+	// Metadata is free-form key-value data from the producer
+	Metadata map[string]string `bun:",type:json,nullzero" json:"metadata,omitempty"`
+	// IdempotencyKey makes a retried post return this message instead of
+	// inserting it again, within idempotencyWindow
+	IdempotencyKey string `bun:"idempotency_key,nullzero" json:"-"`
 }
 
 // PostMessageRequest represents the request body for POST /v1/messages
 type PostMessageRequest struct {
 	Text string `json:"text"`
+	// Priority moves the message ahead of lower priority ones, default 0
+	Priority int `json:"priority"`
+	// TTLSeconds drops the message if it isn't consumed in time, 0 keeps it
+	// until it is
+	TTLSeconds int               `json:"ttl_seconds"`
+	Topic      string            `json:"topic"`
+	Metadata   map[string]string `json:"metadata"`
+	// IdempotencyKey is an alternative to the Idempotency-Key header
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// BatchMessagesResponse is the response body for POST /v1/messages/batch
+type BatchMessagesResponse struct {
+	IDs []int64 `json:"ids"`
 }
 
 // AddMessageRequest represents the request body for POST /v1/messages/add
 type AddMessageRequest struct {
-	Text string `json:"text"`
+	Text           string            `json:"text"`
+	Topic          string            `json:"topic"`
+	Metadata       map[string]string `json:"metadata"`
+	IdempotencyKey string            `json:"idempotency_key"`
+}
+
+// Stats is the GET /v1/stats response
+type Stats struct {
+	New      int `json:"new"`
+	Leased   int `json:"leased"`
+	Archived int `json:"archived"`
+	// OldestNewAgeSeconds is how long the oldest new message has been
+	// waiting, 0 when there are none
+	OldestNewAgeSeconds float64 `json:"oldest_new_age_seconds"`
+}
+
+// ListedMessage is a message in the GET /v1/messages/list response, with its
+// state and timestamps
+type ListedMessage struct {
+	ID         int64      `json:"id"`
+	Text       string     `json:"text"`
+	State      string     `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Topic      string     `json:"topic,omitempty"`
+	// TTLSeconds is the time left until the message expires
+	TTLSeconds *int              `json:"ttl_seconds,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
 }
 
 // Config holds application configuration
 type Config struct {
 	ListenAddr string
 	DBPath     string
-	AuthToken  string
+	// DBDriver picks the database, sqlite by default or postgres
+	DBDriver string
+	// DBDSN is the connection string, DBPath is used for SQLite without one
+	DBDSN string
+	// AuthToken may produce and consume, Tokens can be limited to either
+	AuthToken   string
+	Tokens      []TokenConfig
+	TLSCertFile string
+	TLSKeyFile  string
+	// LeaseTimeout switches GET to at-least-once delivery: fetched messages
+	// are leased for this long and only archived once acked
+	LeaseTimeout time.Duration
+	// RateLimit is the requests per second allowed from one client IP, with
+	// bursts up to RateBurst, 0 disables it
+	RateLimit float64
+	RateBurst int
+}
+
+// TokenConfig is an auth token and what it may do, from AUTH_TOKENS_FILE
+type TokenConfig struct {
+	Token string `json:"token"`
+	// Scopes are produce (post messages) and/or consume (get, ack, list and
+	// stream messages)
+	Scopes []string `json:"scopes"`
+}
+
+const (
+	scopeProduce = "produce"
+	scopeConsume = "consume"
+)
+
+// readTokens loads the tokens of AUTH_TOKENS_FILE, a JSON array of
+// TokenConfig
+func readTokens(path string) ([]TokenConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []TokenConfig
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %d is empty", i)
+		}
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("token %d has no scopes", i)
+		}
+		for _, scope := range token.Scopes {
+			if scope != scopeProduce && scope != scopeConsume {
+				return nil, fmt.Errorf("token %d has unknown scope %q, expected produce or consume", i, scope)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// tlsEnabled reports whether the server terminates TLS itself
+func (c Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
 }
 
 // Server holds the application state
 type Server struct {
-	db     *bun.DB
-	config Config
+	db      *bun.DB
+	config  Config
+	dialect *sqlDialect
+
+	// inserted is closed and replaced whenever messages become available,
+	// waking up long-polling GETs
+	mu       sync.Mutex
+	inserted chan struct{}
+	// subscribers get every inserted message for GET /v1/messages/stream,
+	// nil once the server shuts down
+	subscribers map[chan Message]struct{}
+
+	// limiters hold a token bucket per client IP when rate limiting is on
+	limitersMu sync.Mutex
+	limiters   map[string]*clientLimiter
+
+	// stats are cached for statsCacheTTL, counting is a table scan
+	statsMu sync.Mutex
+	stats   Stats
+	statsAt time.Time
+
+	// stopSweep stops the sweeper started by NewServer, swept is closed once
+	// it has returned
+	stopSweep context.CancelFunc
+	swept     chan struct{}
 }
 
 // NewServer creates a new server instance
 func NewServer(config Config) (*Server, error) {
 	log.Printf("Initializing server...")
 
-	// Open SQLite database
-	sqldb, err := sql.Open(sqliteshim.ShimName, config.DBPath)
+	driver := cmp.Or(config.DBDriver, "sqlite")
+	dialect, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	db, err := dialect.open(cmp.Or(config.DBDSN, config.DBPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-	log.Printf("Database opened: %s", config.DBPath)
-
-	// Create Bun DB
-	db := bun.NewDB(sqldb, sqlitedialect.New())
+	log.Printf("Database opened: %s", driver)
 
 	// Run migrations
-	if err := runMigrations(db); err != nil {
+	if err := dialect.migrate(db); err != nil {
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 	log.Printf("Database migrations completed")
 
-	return &Server{
-		db:     db,
-		config: config,
-	}, nil
+	ctx, stopSweep := context.WithCancel(context.Background())
+	s := &Server{
+		db:          db,
+		config:      config,
+		dialect:     dialect,
+		inserted:    make(chan struct{}),
+		subscribers: map[chan Message]struct{}{},
+		limiters:    map[string]*clientLimiter{},
+		stopSweep:   stopSweep,
+		swept:       make(chan struct{}),
+	}
+	go func() {
+		defer close(s.swept)
+		s.sweep(ctx, sweepInterval(config.LeaseTimeout))
+	}()
+	return s, nil
 }
 
-// runMigrations executes the SQL migration files
-func runMigrations(db *bun.DB) error {
-	migrationSQL := `
-	PRAGMA foreign_keys = ON;
+// Close stops the sweeper and closes the database
+func (s *Server) Close() error {
+	s.stopSweep()
+	<-s.swept
+	return s.db.Close()
+}
 
+// sqlDialect is what differs between the supported databases
+type sqlDialect struct {
+	open    func(dsn string) (*bun.DB, error)
+	migrate func(db *bun.DB) error
+	// now is the current time, comparable with the stored timestamps
+	now string
+	// nowPlus is the current time plus ? seconds
+	nowPlus string
+	// pickTx isolates picking messages from concurrent consumers, together
+	// with pickLock appended to the picking subquery
+	pickTx   *sql.TxOptions
+	pickLock string
+	// pollInterval makes long polls check for new messages periodically, for
+	// databases shared with other instances whose inserts don't wake them
+	pollInterval time.Duration
+}
+
+// dialects are the supported DB_DRIVER values, postgres.go adds postgres
+var dialects = map[string]*sqlDialect{
+	"sqlite": {
+		open: func(dsn string) (*bun.DB, error) {
+			sqldb, err := sql.Open(sqliteshim.ShimName, sqliteDSN(dsn))
+			if err != nil {
+				return nil, err
+			}
+			return bun.NewDB(sqldb, sqlitedialect.New()), nil
+		},
+		migrate: runMigrations,
+		now:     "strftime('%Y-%m-%dT%H:%M:%fZ','now')",
+		nowPlus: "strftime('%Y-%m-%dT%H:%M:%fZ','now', '+' || ? || ' seconds')",
+		pickTx:  &sql.TxOptions{Isolation: sql.LevelSerializable},
+	},
+}
+
+const messagesTableSQL = `
 	CREATE TABLE IF NOT EXISTS messages (
 	  id           INTEGER PRIMARY KEY AUTOINCREMENT,
 	  text         TEXT NOT NULL,
-	  state        TEXT NOT NULL CHECK (state IN ('new','archived')) DEFAULT 'new',
+	  priority     INTEGER NOT NULL DEFAULT 0,
+	  state        TEXT NOT NULL CHECK (state IN ('new','leased','archived')) DEFAULT 'new',
 	  created_at   DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
-	  archived_at  DATETIME
+	  archived_at  DATETIME,
+	  leased_until DATETIME,
+	  expires_at   DATETIME,
+	  topic        TEXT NOT NULL DEFAULT '',
+	  metadata     TEXT,
+	  idempotency_key TEXT
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_messages_state_created ON messages(state, created_at, id);
 	`
 
-	_, err := db.Exec(migrationSQL)
+// sqliteDSN turns on WAL, so reads don't block on writes, and a busy timeout,
+// so concurrent writers wait for each other instead of failing right away.
+// The parameters depend on the driver sqliteshim picked.
+func sqliteDSN(dsn string) string {
+	params := "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	if sqliteshim.DriverName() == "sqlite3" {
+		params = "_journal_mode=WAL&_busy_timeout=5000"
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + params
+	}
+	return dsn + "?" + params
+}
+
+// runMigrations creates the SQLite schema and upgrades older tables
+func runMigrations(db *bun.DB) error {
+	if _, err := db.Exec("PRAGMA foreign_keys = ON;" + messagesTableSQL); err != nil {
+		return err
+	}
+	if err := migrateLeasedState(db); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "priority", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "topic", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "metadata", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "idempotency_key", "TEXT"); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_messages_state_priority ON messages(state, priority, created_at, id);
+		CREATE INDEX IF NOT EXISTS idx_messages_state_topic ON messages(state, topic, priority, created_at, id);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idempotency_key ON messages(idempotency_key) WHERE idempotency_key IS NOT NULL;
+	`)
 	return err
 }
 
-// authMiddleware validates the token URL parameter
+// addColumnIfMissing adds a column to messages tables created before it existed
+func addColumnIfMissing(db *bun.DB, column, definition string) error {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('messages') WHERE name = ?", column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	log.Printf("Migrating messages table, adding %s", column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE messages ADD COLUMN %s %s", column, definition))
+	return err
+}
+
+// migrateLeasedState rebuilds a messages table created before the leased
+// state existed, SQLite can't change a CHECK constraint in place
+func migrateLeasedState(db *bun.DB) error {
+	var schema string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'messages'").Scan(&schema)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(schema, "'leased'") {
+		return nil
+	}
+	log.Printf("Migrating messages table to support leases")
+	return db.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			DROP INDEX idx_messages_state_created;
+			ALTER TABLE messages RENAME TO messages_old;
+			`+messagesTableSQL+`
+			INSERT INTO messages (id, text, state, created_at, archived_at)
+			SELECT id, text, state, created_at, archived_at FROM messages_old;
+			DROP TABLE messages_old;
+		`)
+		return err
+	})
+}
+
+// clientLimiter is the rate limiter of one client address
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterIdle is how long a client's limiter is kept after its last request
+const limiterIdle = 10 * time.Minute
+
+// rateLimitMiddleware rejects clients that go over the rate limit with 429,
+// telling them when to retry
+func (s *Server) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.RateLimit <= 0 {
+			next(w, r)
+			return
+		}
+
+		reservation := s.clientLimiter(clientIP(r)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			log.Printf("Rate limit exceeded by %s", clientIP(r))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) clientLimiter(ip string) *rate.Limiter {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	client, ok := s.limiters[ip]
+	if !ok {
+		burst := cmp.Or(s.config.RateBurst, max(int(s.config.RateLimit), 1))
+		client = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(s.config.RateLimit), burst)}
+		s.limiters[ip] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter
+}
+
+// pruneLimiters forgets clients that have been idle, their buckets are full
+// again anyway
+func (s *Server) pruneLimiters() {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	for ip, client := range s.limiters {
+		if time.Since(client.lastSeen) > limiterIdle {
+			delete(s.limiters, ip)
+		}
+	}
+}
+
+// clientIP is the address the request came from, without the port. Behind a
+// proxy that's the proxy for every client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authMiddleware validates the bearer token, falling back to the token URL
+// parameter for older clients
 func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.URL.Query().Get("token")
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
 		if token == "" {
-			log.Printf("Token parameter required")
-			http.Error(w, "Token parameter required", http.StatusUnauthorized)
+			log.Printf("Token required")
+			http.Error(w, "Token required", http.StatusUnauthorized)
 			return
 		}
 
-		if token != s.config.AuthToken {
-			log.Printf("Invalid token: %s", token)
+		scopes, ok := s.tokenScopes(token)
+		if !ok {
+			log.Printf("Invalid token from %s", r.RemoteAddr)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), scopesKey{}, scopes)))
+	}
+}
+
+// scopesKey holds the scopes of the request's token in its context
+type scopesKey struct{}
+
+// tokenScopes looks up a token, comparing with every configured token in
+// constant time so the timing doesn't tell which one nearly matched
+func (s *Server) tokenScopes(token string) ([]string, bool) {
+	var scopes []string
+	found := false
+	if s.config.AuthToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AuthToken)) == 1 {
+		scopes, found = []string{scopeProduce, scopeConsume}, true
+	}
+	for _, configured := range s.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(configured.Token)) == 1 {
+			scopes, found = configured.Scopes, true
+		}
+	}
+	return scopes, found
+}
+
+// requireScope responds with 403 unless the request's token has the scope
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(scopesKey{}).([]string)
+	if !slices.Contains(scopes, scope) {
+		http.Error(w, fmt.Sprintf("Token lacks the %s scope", scope), http.StatusForbidden)
+		return false
 	}
+	return true
 }
 
 // handlePostMessage handles POST /v1/messages
@@ -120,6 +507,9 @@ func (s *Server) handlePostMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !requireScope(w, r, scopeProduce) {
+		return
+	}
 
 	var req PostMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -131,30 +521,175 @@ func (s *Server) handlePostMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Text is required", http.StatusBadRequest)
 		return
 	}
+	if req.TTLSeconds < 0 {
+		http.Error(w, "TTL can't be negative", http.StatusBadRequest)
+		return
+	}
 
 	message := &Message{
-		Text:  req.Text,
-		State: "new",
+		Text:           req.Text,
+		Priority:       req.Priority,
+		Topic:          req.Topic,
+		Metadata:       req.Metadata,
+		IdempotencyKey: cmp.Or(req.IdempotencyKey, r.Header.Get("Idempotency-Key")),
+		State:          "new",
 	}
+	s.respondInserted(w, r, message, req.TTLSeconds)
+}
+
+// idempotencyWindow is how long an idempotency key is remembered, a post
+// with an older key inserts a new message
+const idempotencyWindow = 24 * time.Hour
 
-	_, err := s.db.NewInsert().Model(message).Exec(r.Context())
+// insertMessage stores a new message with a TTL in seconds, 0 for none. When
+// a message with the same idempotency key was stored within the window, that
+// one is loaded into message instead and created is false.
+func (s *Server) insertMessage(ctx context.Context, message *Message, ttlSeconds int) (created bool, err error) {
+	if message.IdempotencyKey != "" {
+		var existing Message
+		err := s.db.NewSelect().Model(&existing).Where("idempotency_key = ?", message.IdempotencyKey).Scan(ctx)
+		switch {
+		case err == nil && time.Since(existing.CreatedAt) < idempotencyWindow:
+			*message = existing
+			return false, nil
+		case err == nil:
+			// Expired, the key is free to use again
+			_, err = s.db.NewUpdate().Model(&existing).Set("idempotency_key = NULL").WherePK().Exec(ctx)
+			if err != nil {
+				return false, err
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return false, err
+		}
+	}
+
+	insert := s.db.NewInsert().Model(message)
+	if ttlSeconds > 0 {
+		// Computed by the database so it compares with its other timestamps
+		insert = insert.Value("expires_at", s.dialect.nowPlus, ttlSeconds)
+	}
+	_, err = insert.Exec(ctx)
+	if err != nil && message.IdempotencyKey != "" {
+		// A concurrent post with the same key may have won the unique index
+		var existing Message
+		if s.db.NewSelect().Model(&existing).Where("idempotency_key = ?", message.IdempotencyKey).Scan(ctx) == nil {
+			*message = existing
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+// respondInserted inserts the message and responds with it, 201 when it was
+// created and 200 when it was a repeated idempotency key
+func (s *Server) respondInserted(w http.ResponseWriter, r *http.Request, message *Message, ttlSeconds int) {
+	created, err := s.insertMessage(r.Context(), message, ttlSeconds)
 	if err != nil {
 		log.Printf("Failed to insert message: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		s.notifyInserted()
+		s.publish(*message)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(message)
 }
 
+// maxBatchSize is the most messages accepted by one POST /v1/messages/batch
+const maxBatchSize = 1000
+
+// handleBatchMessages handles POST /v1/messages/batch, inserting all messages
+// in one transaction
+func (s *Server) handleBatchMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireScope(w, r, scopeProduce) {
+		return
+	}
+
+	var reqs []PostMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(reqs) == 0 {
+		http.Error(w, "At least one message is required", http.StatusBadRequest)
+		return
+	}
+	if len(reqs) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("At most %d messages per batch", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	messages := make([]Message, len(reqs))
+	for i, req := range reqs {
+		if req.Text == "" {
+			http.Error(w, fmt.Sprintf("Text is required (message %d)", i), http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds < 0 {
+			http.Error(w, fmt.Sprintf("TTL can't be negative (message %d)", i), http.StatusBadRequest)
+			return
+		}
+		if req.IdempotencyKey != "" {
+			http.Error(w, fmt.Sprintf("Idempotency keys aren't supported in batches (message %d)", i), http.StatusBadRequest)
+			return
+		}
+		messages[i] = Message{Text: req.Text, Priority: req.Priority, Topic: req.Topic, Metadata: req.Metadata, State: "new"}
+	}
+
+	err := s.db.RunInTx(r.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(&messages).Exec(ctx); err != nil {
+			return err
+		}
+		for i, req := range reqs {
+			if req.TTLSeconds == 0 {
+				continue
+			}
+			_, err := tx.NewUpdate().Model((*Message)(nil)).
+				Set("expires_at = ?", schema.SafeQuery(s.dialect.nowPlus, []any{req.TTLSeconds})).
+				Where("id = ?", messages[i].ID).
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to insert %d messages: %v", len(messages), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.notifyInserted()
+	s.publish(messages...)
+
+	response := BatchMessagesResponse{IDs: make([]int64, len(messages))}
+	for i, message := range messages {
+		response.IDs[i] = message.ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
 // handleGetMessages handles GET /v1/messages
 func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !requireScope(w, r, scopeConsume) {
+		return
+	}
 
 	limit := 1
 	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
@@ -163,39 +698,578 @@ func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages, err := s.fetchAndArchive(r.Context(), limit)
+	var wait time.Duration
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		parsed, err := time.ParseDuration(waitStr)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		wait = min(parsed, maxWait)
+	}
+
+	messages, err := s.fetchWaiting(r.Context(), limit, wait, r.URL.Query().Get("topic"))
 	if err != nil {
-		log.Printf("Failed to fetch and archive messages: %v", err)
+		if r.Context().Err() != nil {
+			// The client went away while waiting
+			return
+		}
+		log.Printf("Failed to fetch messages: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if acceptsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, message := range messages {
+			// One message per line, so embedded newlines are flattened
+			fmt.Fprintln(w, strings.ReplaceAll(message.Text, "\n", " "))
+		}
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
+// maxWait caps the wait query parameter of GET /v1/messages
+const maxWait = time.Minute
+
+// fetchWaiting fetches messages with the topic, or any topic when it's empty,
+// waiting up to wait for new ones to arrive when there are none yet
+func (s *Server) fetchWaiting(ctx context.Context, limit int, wait time.Duration, topic string) ([]Message, error) {
+	fetch := s.fetchAndArchive
+	if s.config.LeaseTimeout > 0 {
+		fetch = s.fetchAndLease
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	var poll <-chan time.Time
+	if s.dialect.pollInterval > 0 {
+		ticker := time.NewTicker(s.dialect.pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		// Taken before fetching, so an insert in between isn't missed
+		inserted := s.insertedSignal()
+		messages, err := fetch(ctx, limit, topic)
+		if err != nil || len(messages) > 0 || wait == 0 {
+			return messages, err
+		}
+		select {
+		case <-inserted:
+		case <-poll:
+		case <-timeout.C:
+			return messages, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// notifyInserted wakes up the GETs waiting for messages
+func (s *Server) notifyInserted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.inserted)
+	s.inserted = make(chan struct{})
+}
+
+func (s *Server) insertedSignal() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inserted
+}
+
+// streamBuffer is how many messages a stream can fall behind before messages
+// are dropped for it
+const streamBuffer = 64
+
+// publish sends inserted messages to the streams, without blocking on slow
+// ones
+func (s *Server) publish(messages ...Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subscriber := range s.subscribers {
+		for _, message := range messages {
+			select {
+			case subscriber <- message:
+			default:
+				log.Printf("Stream is falling behind, dropped message %d", message.ID)
+			}
+		}
+	}
+}
+
+// subscribe registers a stream, it returns false when the server is shutting
+// down
+func (s *Server) subscribe() (chan Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribers == nil {
+		return nil, false
+	}
+	subscriber := make(chan Message, streamBuffer)
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber, true
+}
+
+func (s *Server) unsubscribe(subscriber chan Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, subscriber)
+}
+
+// closeStreams ends all streams, they would otherwise hold up a shutdown
+func (s *Server) closeStreams() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subscriber := range s.subscribers {
+		close(subscriber)
+	}
+	s.subscribers = nil
+}
+
+// acceptsPlainText reports whether the client asked for text/plain over JSON
+func acceptsPlainText(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// maxPickAttempts bounds retrying a pick that SQLite reported as busy
+const maxPickAttempts = 5
+
+// pickInTx runs a picking query in a transaction, retrying when SQLite is
+// busy. The busy timeout covers most contention, but a WAL transaction whose
+// snapshot went stale is failed right away and has to start over.
+func (s *Server) pickInTx(ctx context.Context, fn func(ctx context.Context, tx bun.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := s.db.RunInTx(ctx, s.dialect.pickTx, fn)
+		if err == nil || !isBusy(err) || attempt == maxPickAttempts {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// isBusy reports whether err is SQLITE_BUSY, checked by message as it is
+// worded the same by both drivers sqliteshim may pick
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// topicFilter narrows the picking subquery to a topic, all topics when empty
+func topicFilter(topic string) schema.QueryWithArgs {
+	if topic == "" {
+		return schema.SafeQuery("", nil)
+	}
+	return schema.SafeQuery("AND topic = ?", []any{topic})
+}
+
 // fetchAndArchive atomically fetches and archives messages
-func (s *Server) fetchAndArchive(ctx context.Context, limit int) ([]Message, error) {
+func (s *Server) fetchAndArchive(ctx context.Context, limit int, topic string) ([]Message, error) {
 	var messages []Message
 
-	err := s.db.RunInTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(ctx context.Context, tx bun.Tx) error {
+	now := bun.Safe(s.dialect.now)
+
+	err := s.pickInTx(ctx, func(ctx context.Context, tx bun.Tx) error {
 		return tx.NewRaw(`
 			WITH picked AS (
 			  SELECT id FROM messages
-			  WHERE state = 'new'
-			  ORDER BY created_at ASC, id ASC
+			  WHERE state = 'new' AND (expires_at IS NULL OR expires_at > ?) ?
+			  ORDER BY priority DESC, created_at ASC, id ASC
 			  LIMIT ?
+			  ?
 			)
 			UPDATE messages
-			SET state = 'archived', archived_at = (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+			SET state = 'archived', archived_at = ?
 			WHERE id IN (SELECT id FROM picked)
-			RETURNING id, created_at, text
-		`, limit).Scan(ctx, &messages)
+			RETURNING id, created_at, text, priority, topic, metadata
+		`, now, topicFilter(topic), limit, bun.Safe(s.dialect.pickLock), now).Scan(ctx, &messages)
 	})
+	sortMessages(messages)
 
 	return messages, err
 }
 
+// sortMessages puts messages in delivery order, RETURNING yields rows in
+// table order rather than the order they were picked in
+func sortMessages(messages []Message) {
+	slices.SortStableFunc(messages, func(a, b Message) int {
+		if a.Priority != b.Priority {
+			return cmp.Compare(b.Priority, a.Priority)
+		}
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+// fetchAndLease atomically fetches messages and leases them for the lease
+// timeout, they return to new unless acked in time
+func (s *Server) fetchAndLease(ctx context.Context, limit int, topic string) ([]Message, error) {
+	var messages []Message
+	leasedUntil := schema.SafeQuery(s.dialect.nowPlus, []any{s.config.LeaseTimeout.Seconds()})
+
+	err := s.pickInTx(ctx, func(ctx context.Context, tx bun.Tx) error {
+		return tx.NewRaw(`
+			WITH picked AS (
+			  SELECT id FROM messages
+			  WHERE state = 'new' AND (expires_at IS NULL OR expires_at > ?) ?
+			  ORDER BY priority DESC, created_at ASC, id ASC
+			  LIMIT ?
+			  ?
+			)
+			UPDATE messages
+			SET state = 'leased', leased_until = ?
+			WHERE id IN (SELECT id FROM picked)
+			RETURNING id, created_at, text, priority, topic, metadata, leased_until
+		`, bun.Safe(s.dialect.now), topicFilter(topic), limit, bun.Safe(s.dialect.pickLock), leasedUntil).Scan(ctx, &messages)
+	})
+	sortMessages(messages)
+
+	return messages, err
+}
+
+// releaseExpiredLeases returns messages whose lease ran out to new, so they
+// are delivered again
+func (s *Server) releaseExpiredLeases(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE messages
+		SET state = 'new', leased_until = NULL
+		WHERE state = 'leased' AND leased_until < ?
+	`, bun.Safe(s.dialect.now))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// deleteExpiredMessages drops the new messages whose TTL ran out
+func (s *Server) deleteExpiredMessages(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM messages
+		WHERE state = 'new' AND expires_at < ?
+	`, bun.Safe(s.dialect.now))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// sweep releases expired leases, deletes expired messages and forgets idle
+// rate limited clients every interval until ctx is done
+func (s *Server) sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.config.LeaseTimeout > 0 {
+				released, err := s.releaseExpiredLeases(ctx)
+				if err != nil {
+					log.Printf("Failed to release expired leases: %v", err)
+				} else if released > 0 {
+					log.Printf("Released %d messages with expired leases", released)
+					s.notifyInserted()
+				}
+			}
+			deleted, err := s.deleteExpiredMessages(ctx)
+			if err != nil {
+				log.Printf("Failed to delete expired messages: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Deleted %d expired messages", deleted)
+			}
+			s.pruneLimiters()
+		}
+	}
+}
+
+// streamKeepAlive is how often an idle stream gets a comment, so proxies
+// don't close it
+const streamKeepAlive = 15 * time.Second
+
+// handleStream handles GET /v1/messages/stream, pushing each inserted message
+// as a Server-Sent Event. It doesn't consume them, GET still delivers them.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireScope(w, r, scopeConsume) {
+		return
+	}
+
+	subscriber, ok := s.subscribe()
+	if !ok {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(subscriber)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Streaming not supported: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case message, ok := <-subscriber:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(message)
+			if err != nil {
+				log.Printf("Failed to encode message %d: %v", message.ID, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// statsCacheTTL is how long stats are reused before counting again
+const statsCacheTTL = 5 * time.Second
+
+// queueStats counts messages by state, cached so frequent polling and scrapes
+// don't count the table every time
+func (s *Server) queueStats(ctx context.Context) (Stats, error) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if time.Since(s.statsAt) < statsCacheTTL {
+		return s.stats, nil
+	}
+
+	var counts []struct {
+		State string
+		Count int
+	}
+	err := s.db.NewSelect().
+		Model((*Message)(nil)).
+		Column("state").
+		ColumnExpr("COUNT(*) AS count").
+		Group("state").
+		Scan(ctx, &counts)
+	if err != nil {
+		return Stats{}, err
+	}
+	var stats Stats
+	for _, count := range counts {
+		switch count.State {
+		case "new":
+			stats.New = count.Count
+		case "leased":
+			stats.Leased = count.Count
+		case "archived":
+			stats.Archived = count.Count
+		}
+	}
+
+	if stats.New > 0 {
+		var oldest time.Time
+		err := s.db.NewSelect().
+			Model((*Message)(nil)).
+			Column("created_at").
+			Where("state = 'new'").
+			Order("created_at ASC").
+			Limit(1).
+			Scan(ctx, &oldest)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.OldestNewAgeSeconds = max(time.Since(oldest).Seconds(), 0)
+	}
+
+	s.stats, s.statsAt = stats, time.Now()
+	return stats, nil
+}
+
+// handleStats handles GET /v1/stats, the queue depth by state
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.queueStats(r.Context())
+	if err != nil {
+		log.Printf("Failed to count messages: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleMetrics handles GET /metrics, the same numbers as /v1/stats in the
+// Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.queueStats(r.Context())
+	if err != nil {
+		log.Printf("Failed to count messages: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP inbox_messages Messages by state.")
+	fmt.Fprintln(w, "# TYPE inbox_messages gauge")
+	fmt.Fprintf(w, "inbox_messages{state=\"new\"} %d\n", stats.New)
+	fmt.Fprintf(w, "inbox_messages{state=\"leased\"} %d\n", stats.Leased)
+	fmt.Fprintf(w, "inbox_messages{state=\"archived\"} %d\n", stats.Archived)
+	fmt.Fprintln(w, "# HELP inbox_oldest_new_message_age_seconds How long the oldest new message has been waiting.")
+	fmt.Fprintln(w, "# TYPE inbox_oldest_new_message_age_seconds gauge")
+	fmt.Fprintf(w, "inbox_oldest_new_message_age_seconds %g\n", stats.OldestNewAgeSeconds)
+}
+
+// handleAck handles POST /v1/messages/{id}/ack, archiving a leased message
+func (s *Server) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireScope(w, r, scopeConsume) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.db.ExecContext(r.Context(), `
+		UPDATE messages
+		SET state = 'archived', archived_at = ?, leased_until = NULL
+		WHERE id = ? AND state = 'leased'
+	`, bun.Safe(s.dialect.now), id)
+	if err != nil {
+		log.Printf("Failed to ack message %d: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if acked, _ := result.RowsAffected(); acked == 0 {
+		// Unknown, not leased, or the lease already ran out
+		http.Error(w, "Message is not leased", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListMessages handles GET /v1/messages/list, a read-only page of
+// messages in one state, newest first, with the total in X-Total-Count
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireScope(w, r, scopeConsume) {
+		return
+	}
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	if state == "" {
+		state = "archived"
+	}
+	if state != "new" && state != "leased" && state != "archived" {
+		http.Error(w, "State must be new, leased or archived", http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if parsed, err := strconv.Atoi(query.Get("limit")); err == nil && parsed > 0 {
+		limit = min(parsed, 500)
+	}
+	offset := 0
+	if parsed, err := strconv.Atoi(query.Get("offset")); err == nil && parsed > 0 {
+		offset = parsed
+	}
+
+	var messages []Message
+	total, err := s.db.NewSelect().
+		Model(&messages).
+		Where("state = ?", state).
+		Order("created_at DESC", "id DESC").
+		Limit(limit).
+		Offset(offset).
+		ScanAndCount(r.Context())
+	if err != nil {
+		log.Printf("Failed to list messages: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	listed := make([]ListedMessage, 0, len(messages))
+	for _, message := range messages {
+		item := ListedMessage{
+			ID:        message.ID,
+			Text:      message.Text,
+			State:     message.State,
+			CreatedAt: message.CreatedAt,
+			Topic:     message.Topic,
+			Metadata:  message.Metadata,
+		}
+		if !message.ArchivedAt.IsZero() {
+			item.ArchivedAt = &message.ArchivedAt
+		}
+		if !message.ExpiresAt.IsZero() && message.State != "archived" {
+			ttl := max(int(time.Until(message.ExpiresAt).Seconds()), 0)
+			item.ExpiresAt = &message.ExpiresAt
+			item.TTLSeconds = &ttl
+		}
+		listed = append(listed, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(listed)
+}
+
 // handleHealth handles GET /health
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -216,12 +1290,16 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // handleAddMessage handles GET/POST /v1/messages/add
 func (s *Server) handleAddMessage(w http.ResponseWriter, r *http.Request) {
-	var text string
+	if !requireScope(w, r, scopeProduce) {
+		return
+	}
+	message := &Message{State: "new"}
 
 	switch r.Method {
 	case http.MethodGet:
-		text = r.URL.Query().Get("text")
-		if text == "" {
+		message.Text = r.URL.Query().Get("text")
+		message.Topic = r.URL.Query().Get("topic")
+		if message.Text == "" {
 			http.Error(w, "Text parameter is required", http.StatusBadRequest)
 			return
 		}
@@ -231,8 +1309,11 @@ func (s *Server) handleAddMessage(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
-		text = req.Text
-		if text == "" {
+		message.Text = req.Text
+		message.Topic = req.Topic
+		message.Metadata = req.Metadata
+		message.IdempotencyKey = req.IdempotencyKey
+		if message.Text == "" {
 			http.Error(w, "Text is required", http.StatusBadRequest)
 			return
 		}
@@ -241,21 +1322,8 @@ func (s *Server) handleAddMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message := &Message{
-		Text:  text,
-		State: "new",
-	}
-
-	_, err := s.db.NewInsert().Model(message).Exec(r.Context())
-	if err != nil {
-		log.Printf("Failed to insert message: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(message)
+	message.IdempotencyKey = cmp.Or(message.IdempotencyKey, r.Header.Get("Idempotency-Key"))
+	s.respondInserted(w, r, message, 0)
 }
 
 // handleMessages routes requests to the appropriate handler
@@ -270,17 +1338,73 @@ func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleNotFound answers unknown paths with JSON like the rest of the API
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+}
+
 // setupRoutes configures the HTTP routes
 func (s *Server) setupRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
+	// Everything but /health needs a token and counts against the rate limit
+	api := func(next http.HandlerFunc) http.HandlerFunc {
+		return s.loggingMiddleware(s.rateLimitMiddleware(s.authMiddleware(next)))
+	}
 
-	mux.HandleFunc("/v1/messages", s.loggingMiddleware(s.authMiddleware(s.handleMessages)))
-	mux.HandleFunc("/v1/messages/add", s.loggingMiddleware(s.authMiddleware(s.handleAddMessage)))
+	mux.HandleFunc("/v1/messages", api(s.handleMessages))
+	mux.HandleFunc("/v1/messages/batch", api(s.handleBatchMessages))
+	mux.HandleFunc("/v1/messages/add", api(s.handleAddMessage))
+	mux.HandleFunc("/v1/messages/stream", api(s.handleStream))
+	mux.HandleFunc("/v1/messages/list", api(s.handleListMessages))
+	mux.HandleFunc("/v1/messages/{id}/ack", api(s.handleAck))
+	mux.HandleFunc("/v1/stats", api(s.handleStats))
+	mux.HandleFunc("/metrics", api(s.handleMetrics))
 	mux.HandleFunc("/health", s.loggingMiddleware(s.handleHealth))
+	mux.HandleFunc("/", s.loggingMiddleware(handleNotFound))
 
 	return mux
 }
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown,
+// longer polls are cut off
+const shutdownTimeout = 15 * time.Second
+
+// serve handles requests on ln until ctx is done, terminating TLS when a
+// certificate is configured, then stops accepting connections and waits for
+// in-flight requests before returning
+func (s *Server) serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: s.setupRoutes()}
+	srv.RegisterOnShutdown(s.closeStreams)
+	srv.RegisterOnShutdown(s.stopSweep)
+
+	errs := make(chan error, 1)
+	go func() {
+		if !s.config.tlsEnabled() {
+			errs <- srv.Serve(ln)
+			return
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		errs <- srv.ServeTLS(ln, s.config.TLSCertFile, s.config.TLSKeyFile)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
+
 // loggingMiddleware logs each request
 func (s *Server) loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -306,31 +1430,93 @@ func getConfig() Config {
 	if dbPath := os.Getenv("DB_PATH"); dbPath != "" {
 		config.DBPath = dbPath
 	}
+	config.DBDriver = os.Getenv("DB_DRIVER")
+	config.DBDSN = os.Getenv("DB_DSN")
 	if token := os.Getenv("AUTH_TOKEN"); token != "" {
 		config.AuthToken = token
 	}
+	if path := os.Getenv("AUTH_TOKENS_FILE"); path != "" {
+		tokens, err := readTokens(path)
+		if err != nil {
+			log.Fatalf("Invalid AUTH_TOKENS_FILE %s: %v", path, err)
+		}
+		config.Tokens = tokens
+	}
+	if limit := os.Getenv("RATE_LIMIT"); limit != "" {
+		parsed, err := strconv.ParseFloat(limit, 64)
+		if err != nil || parsed < 0 {
+			log.Fatalf("Invalid RATE_LIMIT %q, expected requests per second like 5 or 0.5", limit)
+		}
+		config.RateLimit = parsed
+	}
+	if burst := os.Getenv("RATE_BURST"); burst != "" {
+		parsed, err := strconv.Atoi(burst)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid RATE_BURST %q, expected a positive number", burst)
+		}
+		config.RateBurst = parsed
+	}
+	config.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	config.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	if timeout := os.Getenv("LEASE_TIMEOUT"); timeout != "" {
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid LEASE_TIMEOUT %q, expected a positive duration like 5m", timeout)
+		}
+		config.LeaseTimeout = parsed
+	}
 
 	return config
 }
 
+// sweepInterval checks for expired leases a few times per lease, so messages
+// aren't held much longer than the timeout. Without leases only expired
+// messages are cleaned up, which isn't urgent as they are never delivered.
+func sweepInterval(leaseTimeout time.Duration) time.Duration {
+	if leaseTimeout <= 0 {
+		return time.Minute
+	}
+	return min(max(leaseTimeout/4, time.Second), time.Minute)
+}
+
 func main() {
 	config := getConfig()
 
-	if config.AuthToken == "" {
-		log.Fatal("AUTH_TOKEN environment variable is required")
+	if config.AuthToken == "" && len(config.Tokens) == 0 {
+		log.Fatal("AUTH_TOKEN or AUTH_TOKENS_FILE environment variable is required")
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
 	}
 
-	log.Printf("Starting inbox server with config: listen=%s, db=%s",
-		config.ListenAddr, config.DBPath)
+	// The DSN isn't logged, it may hold a password
+	db := cmp.Or(config.DBDriver, "sqlite")
+	if config.DBDSN == "" {
+		db += ":" + config.DBPath
+	}
+	log.Printf("Starting inbox server with config: listen=%s, db=%s, lease=%s",
+		config.ListenAddr, db, config.LeaseTimeout)
 
 	server, err := NewServer(config)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
-	defer server.db.Close()
 
-	mux := server.setupRoutes()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
 
-	log.Printf("Server ready, listening on %s", config.ListenAddr)
-	log.Fatal(http.ListenAndServe(config.ListenAddr, mux))
+	log.Printf("Server ready, listening on %s (tls=%t)", config.ListenAddr, config.tlsEnabled())
+	serveErr := server.serve(ctx, ln)
+	if err := server.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	if serveErr != nil {
+		log.Fatal(serveErr)
+	}
+	log.Printf("Server stopped")
 }
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uptrace/bun/driver/sqliteshim"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	if config.DBPath == "" {
+		config.DBPath = filepath.Join(t.TempDir(), "inbox.db")
+	}
+	if config.AuthToken == "" {
+		config.AuthToken = "secret"
+	}
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "inbox-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir)
+	server := newTestServer(t, Config{TLSCertFile: certFile, TLSKeyFile: keyFile})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.serve(t.Context(), ln)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("Expected 200 OK, got %d %q", resp.StatusCode, body)
+	}
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("Expected a TLS 1.2+ connection, got %+v", resp.TLS)
+	}
+}
+
+func TestGetMessagesPlainText(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	for _, text := range []string{"first", "second\nline", "third"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(`{"text":"`+strings.ReplaceAll(text, "\n", `\n`)+`"}`))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %q: %d %s", text, rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/messages?token=secret&limit=2", nil)
+	req.Header.Set("Accept", "text/plain")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain content type, got %q", ct)
+	}
+	if want := "first\nsecond line\n"; rec.Body.String() != want {
+		t.Errorf("Expected body %q, got %q", want, rec.Body.String())
+	}
+
+	var states []string
+	err := server.db.NewSelect().Model((*Message)(nil)).Column("state").Order("id").Scan(t.Context(), &states)
+	if err != nil {
+		t.Fatalf("Failed to query states: %v", err)
+	}
+	if want := []string{"archived", "archived", "new"}; strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected states %v, got %v", want, states)
+	}
+}
+
+func TestLeaseMode(t *testing.T) {
+	server := newTestServer(t, Config{LeaseTimeout: time.Hour})
+	handler := server.setupRoutes()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	fetch := func() string {
+		rec := do(http.MethodGet, "/v1/messages?token=secret", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d %s", rec.Code, rec.Body)
+		}
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	for _, text := range []string{"first", "second"} {
+		if rec := do(http.MethodPost, "/v1/messages?token=secret", `{"text":"`+text+`"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %q: %d %s", text, rec.Code, rec.Body)
+		}
+	}
+
+	if got := fetch(); !strings.Contains(got, `"text":"first"`) {
+		t.Fatalf("Expected the first message, got %s", got)
+	}
+	// The leased message isn't delivered again while the lease holds
+	if got := fetch(); !strings.Contains(got, `"text":"second"`) {
+		t.Fatalf("Expected the second message, got %s", got)
+	}
+
+	if rec := do(http.MethodPost, "/v1/messages/1/ack?token=secret", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected ack to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/v1/messages/1/ack?token=secret", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected a second ack to fail, got %d", rec.Code)
+	}
+
+	// Let the unacked lease run out
+	if _, err := server.db.ExecContext(t.Context(), "UPDATE messages SET leased_until = '2000-01-01T00:00:00.000Z' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	released, err := server.releaseExpiredLeases(t.Context())
+	if err != nil || released != 1 {
+		t.Fatalf("Expected 1 released lease, got %d (%v)", released, err)
+	}
+	if got := fetch(); !strings.Contains(got, `"text":"second"`) {
+		t.Errorf("Expected the expired message to be delivered again, got %s", got)
+	}
+
+	var states []string
+	err = server.db.NewSelect().Model((*Message)(nil)).Column("state").Order("id").Scan(t.Context(), &states)
+	if err != nil {
+		t.Fatalf("Failed to query states: %v", err)
+	}
+	if want := []string{"archived", "leased"}; strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected states %v, got %v", want, states)
+	}
+}
+
+func TestMigrateLeasedState(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "inbox.db")
+	// A database created before leases existed
+	old, err := sql.Open(sqliteshim.ShimName, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE messages (
+		  id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		  text         TEXT NOT NULL,
+		  state        TEXT NOT NULL CHECK (state IN ('new','archived')) DEFAULT 'new',
+		  created_at   DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+		  archived_at  DATETIME
+		);
+		CREATE INDEX idx_messages_state_created ON messages(state, created_at, id);
+		INSERT INTO messages (text) VALUES ('kept');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServer(t, Config{DBPath: dbPath, LeaseTimeout: time.Minute})
+	messages, err := server.fetchAndLease(t.Context(), 1, "")
+	if err != nil {
+		t.Fatalf("Failed to lease after migrating: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Text != "kept" {
+		t.Errorf("Expected the existing message to be kept, got %+v", messages)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		code   int
+	}{
+		{"bearer", "/v1/messages", "Bearer secret", http.StatusOK},
+		{"query param", "/v1/messages?token=secret", "", http.StatusOK},
+		{"bearer preferred", "/v1/messages?token=secret", "Bearer wrong", http.StatusUnauthorized},
+		{"wrong bearer", "/v1/messages", "Bearer wrong", http.StatusUnauthorized},
+		{"missing", "/v1/messages", "", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.code {
+				t.Errorf("Expected %d, got %d %s", tc.code, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		if rec := do(http.MethodPost, "/v1/messages", `{"text":"`+text+`"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %q: %d %s", text, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(http.MethodGet, "/v1/messages?limit=3", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Failed to consume: %d %s", rec.Code, rec.Body)
+	}
+
+	rec := do(http.MethodGet, "/v1/messages/list?limit=2&offset=1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rec.Code, rec.Body)
+	}
+	if total := rec.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("Expected 3 archived messages in total, got %s", total)
+	}
+	var listed []ListedMessage
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	// Newest first, skipping "three"
+	if len(listed) != 2 || listed[0].Text != "two" || listed[1].Text != "one" {
+		t.Fatalf("Unexpected page %+v", listed)
+	}
+	if listed[0].State != "archived" || listed[0].CreatedAt.IsZero() || listed[0].ArchivedAt == nil {
+		t.Errorf("Expected state and timestamps, got %+v", listed[0])
+	}
+
+	rec = do(http.MethodGet, "/v1/messages/list?state=new", "")
+	if total := rec.Header().Get("X-Total-Count"); total != "1" {
+		t.Errorf("Expected 1 new message, got %s", total)
+	}
+	if rec := do(http.MethodGet, "/v1/messages/list?state=deleted", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown state to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	for _, body := range []string{`{"text":"normal"}`, `{"text":"urgent","priority":10}`, `{"text":"later"}`, `{"text":"important","priority":5}`} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %s: %d %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	messages, err := server.fetchAndArchive(t.Context(), 4, "")
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	var texts []string
+	for _, message := range messages {
+		texts = append(texts, message.Text)
+	}
+	if want := "urgent,important,normal,later"; strings.Join(texts, ",") != want {
+		t.Errorf("Expected %s, got %v", want, texts)
+	}
+}
+
+func TestGetMessagesLongPoll(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/messages?token=secret&wait=50ms", nil))
+	if rec.Code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("Expected an empty response after waiting, got %d after %v", rec.Code, time.Since(start))
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/messages?token=secret&wait=10s", nil))
+		done <- rec
+	}()
+	time.Sleep(50 * time.Millisecond)
+	post := httptest.NewRecorder()
+	handler.ServeHTTP(post, httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(`{"text":"hello"}`)))
+	if post.Code != http.StatusCreated {
+		t.Fatalf("Failed to post: %d %s", post.Code, post.Body)
+	}
+
+	select {
+	case rec := <-done:
+		if !strings.Contains(rec.Body.String(), `"text":"hello"`) {
+			t.Errorf("Expected the posted message, got %d %s", rec.Code, rec.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Long poll wasn't woken up by the insert")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/messages?token=secret&wait=soon", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid wait to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	for _, body := range []string{`{"text":"stale","ttl_seconds":60}`, `{"text":"fresh","ttl_seconds":3600}`, `{"text":"forever"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %s: %d %s", body, rec.Code, rec.Body)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(`{"text":"x","ttl_seconds":-1}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative TTL, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/messages/list?token=secret", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var listed []ListedMessage
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatalf("Failed to decode list: %v", err)
+	}
+	for _, message := range listed {
+		switch message.Text {
+		case "forever":
+			if message.TTLSeconds != nil {
+				t.Errorf("Expected no TTL for %s, got %d", message.Text, *message.TTLSeconds)
+			}
+		case "fresh":
+			if message.TTLSeconds == nil || *message.TTLSeconds < 3500 || *message.TTLSeconds > 3600 {
+				t.Errorf("Expected about an hour left for %s, got %v", message.Text, message.TTLSeconds)
+			}
+		}
+	}
+
+	if _, err := server.db.Exec("UPDATE messages SET expires_at = '2000-01-01T00:00:00.000Z' WHERE text = 'stale'"); err != nil {
+		t.Fatalf("Failed to expire message: %v", err)
+	}
+	deleted, err := server.deleteExpiredMessages(t.Context())
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 expired message deleted, got %d, %v", deleted, err)
+	}
+	messages, err := server.fetchAndArchive(t.Context(), 10, "")
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected 2 messages, got %d", len(messages))
+	}
+}
+
+func TestServerSweeps(t *testing.T) {
+	// The shortest lease sweeps every second
+	server := newTestServer(t, Config{LeaseTimeout: time.Second})
+	if _, err := server.db.Exec("INSERT INTO messages (text, expires_at) VALUES ('stale', '2000-01-01T00:00:00.000Z')"); err != nil {
+		t.Fatalf("Failed to seed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := server.db.NewSelect().Model((*Message)(nil)).Count(t.Context())
+		if err != nil {
+			t.Fatalf("Failed to count messages: %v", err)
+		}
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the sweeper to delete the expired message")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	select {
+	case <-server.swept:
+	default:
+		t.Error("Expected the sweeper to stop on Close")
+	}
+}
+
+func TestBatchMessages(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	body := `[{"text":"one"},{"text":"two","priority":5},{"text":"three","ttl_seconds":60}]`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages/batch?token=secret", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to post batch: %d %s", rec.Code, rec.Body)
+	}
+	var response BatchMessagesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.IDs) != 3 || response.IDs[0] >= response.IDs[1] || response.IDs[1] >= response.IDs[2] {
+		t.Errorf("Expected 3 increasing IDs, got %v", response.IDs)
+	}
+	var expiring int
+	if err := server.db.QueryRow("SELECT COUNT(*) FROM messages WHERE expires_at IS NOT NULL").Scan(&expiring); err != nil || expiring != 1 {
+		t.Errorf("Expected 1 message with a TTL, got %d, %v", expiring, err)
+	}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`[]`, http.StatusBadRequest},
+		{`[{"text":"ok"},{"text":""}]`, http.StatusBadRequest},
+		{"[" + strings.Repeat(`{"text":"x"},`, maxBatchSize) + `{"text":"x"}]`, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages/batch?token=secret", strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("Expected %d, got %d", tc.code, rec.Code)
+		}
+	}
+
+	messages, err := server.fetchAndArchive(t.Context(), 10, "")
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if len(messages) != 3 || messages[0].Text != "two" {
+		t.Errorf("Expected the 3 batch messages, two first, got %v", messages)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/nothing", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON 404, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if strings.TrimSpace(rec.Body.String()) != `{"error":"not found"}` {
+		t.Errorf("Unexpected body %s", rec.Body)
+	}
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	server := newTestServer(t, Config{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error, 1)
+	go func() { served <- server.serve(ctx, ln) }()
+
+	// A long poll is in flight when the shutdown starts and still gets its
+	// response
+	responses := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/v1/messages?wait=1s", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	if code := <-responses; code != http.StatusOK {
+		t.Errorf("Expected the in-flight request to finish with 200, got %d", code)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server didn't shut down")
+	}
+}
+
+func TestConcurrentConsumers(t *testing.T) {
+	server := newTestServer(t, Config{})
+
+	const consumers = 20
+	for i := range consumers {
+		if _, err := server.db.Exec("INSERT INTO messages (text) VALUES (?)", fmt.Sprintf("message %d", i)); err != nil {
+			t.Fatalf("Failed to seed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	fetched := make(chan []Message, consumers)
+	errs := make(chan error, consumers)
+	for range consumers {
+		wg.Go(func() {
+			messages, err := server.fetchAndArchive(t.Context(), 1, "")
+			if err != nil {
+				errs <- err
+				return
+			}
+			fetched <- messages
+		})
+	}
+	wg.Wait()
+	close(fetched)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Consumer failed: %v", err)
+	}
+	seen := map[int64]bool{}
+	for messages := range fetched {
+		for _, message := range messages {
+			if seen[message.ID] {
+				t.Errorf("Message %d delivered twice", message.ID)
+			}
+			seen[message.ID] = true
+		}
+	}
+	if len(seen) != consumers {
+		t.Errorf("Expected %d messages delivered, got %d", consumers, len(seen))
+	}
+}
+
+func TestStreamMessages(t *testing.T) {
+	server := newTestServer(t, Config{})
+	ts := httptest.NewServer(server.setupRoutes())
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/messages/stream", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The stream is subscribed once the headers arrive
+	for _, path := range []string{"/v1/messages", "/v1/messages/batch"} {
+		body := `{"text":"single"}`
+		if path == "/v1/messages/batch" {
+			body = `[{"text":"first"},{"text":"second"}]`
+		}
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		posted, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to post: %v", err)
+		}
+		posted.Body.Close()
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var texts []string
+	for len(texts) < 3 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal([]byte(data), &message); err != nil {
+			t.Fatalf("Failed to decode event %q: %v", data, err)
+		}
+		texts = append(texts, message.Text)
+	}
+	if want := "single,first,second"; strings.Join(texts, ",") != want {
+		t.Errorf("Expected %s, got %v", want, texts)
+	}
+
+	// Streaming doesn't consume messages
+	messages, err := server.fetchAndArchive(t.Context(), 10, "")
+	if err != nil || len(messages) != 3 {
+		t.Errorf("Expected 3 messages left to fetch, got %d, %v", len(messages), err)
+	}
+}
+
+func TestMessageTopics(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	for _, body := range []string{
+		`{"text":"plain"}`,
+		`{"text":"build","topic":"ci","metadata":{"repo":"wow","branch":"main"}}`,
+		`{"text":"deploy","topic":"ops"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages?token=secret", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Failed to post %s: %d %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/messages?token=secret&limit=10&topic=ci", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var messages []Message
+	if err := json.NewDecoder(rec.Body).Decode(&messages); err != nil {
+		t.Fatalf("Failed to decode messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Text != "build" || messages[0].Topic != "ci" || messages[0].Metadata["repo"] != "wow" {
+		t.Fatalf("Expected only the ci message with its metadata, got %+v", messages)
+	}
+
+	// Without a topic every remaining message is consumed
+	messages, err := server.fetchAndArchive(t.Context(), 10, "")
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected the 2 other messages, got %+v", messages)
+	}
+}
+
+func TestStats(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	for i := range 3 {
+		if _, err := server.db.Exec("INSERT INTO messages (text) VALUES (?)", fmt.Sprintf("message %d", i)); err != nil {
+			t.Fatalf("Failed to seed: %v", err)
+		}
+	}
+	if _, err := server.fetchAndArchive(t.Context(), 1, ""); err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/stats?token=secret", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var stats Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.New != 2 || stats.Archived != 1 || stats.Leased != 0 || stats.OldestNewAgeSeconds < 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Cached, the new message doesn't show up yet
+	if _, err := server.db.Exec("INSERT INTO messages (text) VALUES ('late')"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/metrics?token=secret", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	for _, line := range []string{`inbox_messages{state="new"} 2`, `inbox_messages{state="archived"} 1`, "inbox_oldest_new_message_age_seconds "} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Expected %q in metrics:\n%s", line, rec.Body)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	server := newTestServer(t, Config{})
+	handler := server.setupRoutes()
+
+	post := func(path, body, key string) (int, Message) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path+"?token=secret", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var message Message
+		json.NewDecoder(rec.Body).Decode(&message)
+		return rec.Code, message
+	}
+
+	code, first := post("/v1/messages", `{"text":"charge"}`, "abc")
+	if code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", code)
+	}
+	code, retried := post("/v1/messages", `{"text":"charge"}`, "abc")
+	if code != http.StatusOK || retried.ID != first.ID {
+		t.Errorf("Expected 200 with message %d, got %d with %d", first.ID, code, retried.ID)
+	}
+	code, added := post("/v1/messages/add", `{"text":"charge","idempotency_key":"abc"}`, "")
+	if code != http.StatusOK || added.ID != first.ID {
+		t.Errorf("Expected 200 with message %d from add, got %d with %d", first.ID, code, added.ID)
+	}
+
+	// Once the window passed the key inserts again
+	old := time.Now().Add(-idempotencyWindow - time.Minute).UTC().Format("2006-01-02T15:04:05.000Z")
+	if _, err := server.db.Exec("UPDATE messages SET created_at = ? WHERE id = ?", old, first.ID); err != nil {
+		t.Fatalf("Failed to age message: %v", err)
+	}
+	code, again := post("/v1/messages", `{"text":"charge"}`, "abc")
+	if code != http.StatusCreated || again.ID == first.ID {
+		t.Errorf("Expected a new message after the window, got %d with %d", code, again.ID)
+	}
+
+	var count int
+	if err := server.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil || count != 2 {
+		t.Errorf("Expected 2 messages, got %d, %v", count, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newTestServer(t, Config{RateLimit: 0.5, RateBurst: 2})
+	handler := server.setupRoutes()
+
+	request := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := request("/v1/messages/add?token=secret&text=hi", "10.0.0.1:1234"); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected request %d within the burst to pass, got %d", i, rec.Code)
+		}
+	}
+	rec := request("/v1/messages/add?token=secret&text=hi", "10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 over the limit, got %d", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", retry)
+	}
+
+	if rec := request("/v1/messages/add?token=secret&text=hi", "10.0.0.2:1234"); rec.Code != http.StatusCreated {
+		t.Errorf("Expected another client to pass, got %d", rec.Code)
+	}
+	if rec := request("/health", "10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /health to be exempt, got %d", rec.Code)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	server := newTestServer(t, Config{Tokens: []TokenConfig{
+		{Token: "producer", Scopes: []string{scopeProduce}},
+		{Token: "consumer", Scopes: []string{scopeConsume}},
+	}})
+	handler := server.setupRoutes()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		code   int
+	}{
+		{"producer posts", http.MethodPost, "/v1/messages", "producer", http.StatusCreated},
+		{"producer adds", http.MethodGet, "/v1/messages/add?text=hi", "producer", http.StatusCreated},
+		{"producer can't consume", http.MethodGet, "/v1/messages", "producer", http.StatusForbidden},
+		{"producer can't list", http.MethodGet, "/v1/messages/list", "producer", http.StatusForbidden},
+		{"consumer can't post", http.MethodPost, "/v1/messages", "consumer", http.StatusForbidden},
+		{"consumer consumes", http.MethodGet, "/v1/messages", "consumer", http.StatusOK},
+		{"either sees stats", http.MethodGet, "/v1/stats", "producer", http.StatusOK},
+		{"shared token does both", http.MethodGet, "/v1/messages", "secret", http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(`{"text":"hi"}`))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.code {
+				t.Errorf("Expected %d, got %d %s", tc.code, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestReadTokens(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content string
+		valid   bool
+	}{
+		{`[{"token":"a","scopes":["produce"]},{"token":"b","scopes":["produce","consume"]}]`, true},
+		{`[{"token":"a","scopes":[]}]`, false},
+		{`[{"token":"","scopes":["consume"]}]`, false},
+		{`[{"token":"a","scopes":["admin"]}]`, false},
+	} {
+		path := filepath.Join(dir, "tokens.json")
+		if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTokens(path); (err == nil) != tc.valid {
+			t.Errorf("Expected valid=%t for %s, got %v", tc.valid, tc.content, err)
+		}
+	}
+}
+
+func TestDBDrivers(t *testing.T) {
+	// Postgres is part of the default build
+	for _, driver := range []string{"sqlite", "postgres"} {
+		if _, ok := dialects[driver]; !ok {
+			t.Errorf("DB_DRIVER=%s is not supported", driver)
+		}
+	}
+	if _, err := NewServer(Config{DBDriver: "mysql"}); err == nil {
+		t.Error("expected an error for an unsupported driver")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Postgres lets several inbox instances share one database
+func init() {
+	dialects["postgres"] = &sqlDialect{
+		open: func(dsn string) (*bun.DB, error) {
+			sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
+			return bun.NewDB(sqldb, pgdialect.New()), nil
+		},
+		migrate: migratePostgres,
+		now:     "now()",
+		nowPlus: "now() + ? * interval '1 second'",
+		// Row locks instead of serializable transactions, so instances
+		// picking at the same time take different messages instead of failing
+		pickLock:     "FOR UPDATE SKIP LOCKED",
+		pollInterval: time.Second,
+	}
+}
+
+const postgresMessagesTableSQL = `
+	CREATE TABLE IF NOT EXISTS messages (
+	  id           BIGSERIAL PRIMARY KEY,
+	  text         TEXT NOT NULL,
+	  priority     INTEGER NOT NULL DEFAULT 0,
+	  state        TEXT NOT NULL CHECK (state IN ('new','leased','archived')) DEFAULT 'new',
+	  created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+	  archived_at  TIMESTAMPTZ,
+	  leased_until TIMESTAMPTZ,
+	  expires_at   TIMESTAMPTZ,
+	  topic        TEXT NOT NULL DEFAULT '',
+	  metadata     JSONB,
+	  idempotency_key TEXT
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_messages_state_created ON messages(state, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_messages_state_priority ON messages(state, priority, created_at, id);
+	CREATE INDEX IF NOT EXISTS idx_messages_state_topic ON messages(state, topic, priority, created_at, id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_idempotency_key ON messages(idempotency_key) WHERE idempotency_key IS NOT NULL;
+	`
+
+// migratePostgres creates the schema, there are no older Postgres tables to
+// upgrade
+func migratePostgres(db *bun.DB) error {
+	_, err := db.Exec(postgresMessagesTableSQL)
+	return err
+}
@@ -2,4 +2,7 @@ module github.com/biozz/wow/jot
 
 go 1.24.1
 
-require gopkg.in/telebot.v4 v4.0.0-beta.4
+require (
+	gopkg.in/telebot.v4 v4.0.0-beta.4
+	gopkg.in/yaml.v3 v3.0.1
+)
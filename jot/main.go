@@ -1,16 +1,25 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf16"
 
 	tele "gopkg.in/telebot.v4"
 	"gopkg.in/telebot.v4/middleware"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
@@ -43,78 +52,547 @@ func main() {
 	if filenameTemplate == "" {
 		log.Fatal("FILENAME_TEMPLATE environment variable must be set")
 	}
+	templatePath := os.Getenv("TEMPLATE_PATH")
+	if templatePath == "" {
+		templatePath = "template.md.tmpl"
+	}
+	tmpl, err := parseTemplate(templatePath)
+	if err != nil {
+		log.Fatalf("Failed to parse template %s: %v", templatePath, err)
+	}
 	b.Use(middleware.Whitelist(adminID))
 	saveDir := os.Getenv("INBOX_PATH")
 	if err := os.MkdirAll(saveDir, 0755); err != nil {
 		log.Fatal("Failed to create save directory:", err)
 	}
+	attachmentsDir := os.Getenv("ATTACHMENTS_PATH")
+	if attachmentsDir == "" {
+		attachmentsDir = filepath.Join(saveDir, "attachments")
+	}
+	if err := os.MkdirAll(attachmentsDir, 0755); err != nil {
+		log.Fatal("Failed to create attachments directory:", err)
+	}
+	deleteAfterSave := true
+	if v := os.Getenv("DELETE_AFTER_SAVE"); v != "" {
+		deleteAfterSave, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("Invalid DELETE_AFTER_SAVE: %v", err)
+		}
+	}
+	appendMode := os.Getenv("APPEND_MODE")
+	if appendMode != "" && appendMode != "daily" {
+		log.Fatalf("Invalid APPEND_MODE %q: must be empty or daily", appendMode)
+	}
 
-	b.Handle(tele.OnText, handler(saveDir, filenameTemplate))
-	b.Handle(tele.OnChannelPost, handler(saveDir, filenameTemplate))
-	b.Handle(tele.OnEdited, handler(saveDir, filenameTemplate))
-	b.Handle(tele.OnEditedChannelPost, handler(saveDir, filenameTemplate))
+	h := handler(saveDir, attachmentsDir, filenameTemplate, tmpl, deleteAfterSave, appendMode == "daily")
+	b.Handle(tele.OnText, h)
+	b.Handle(tele.OnChannelPost, h)
+	b.Handle(tele.OnEdited, h)
+	b.Handle(tele.OnEditedChannelPost, h)
+	b.Handle(tele.OnPhoto, h)
+	b.Handle(tele.OnDocument, h)
 	log.Println("Bot starting...")
 	b.Start()
 
 }
 
-func handler(saveDir string, filenameTemplate string) func(tele.Context) error {
+func handler(saveDir string, attachmentsDir string, filenameTemplate string, tmpl *template.Template, deleteAfterSave bool, appendDaily bool) func(tele.Context) error {
 	return func(c tele.Context) error {
-		err := saveMessage(c.Message(), saveDir, filenameTemplate)
+		var filename string
+		var err error
+		if appendDaily {
+			filename, err = appendMessage(c.Bot(), c.Message(), saveDir, attachmentsDir)
+		} else {
+			filename, err = saveMessage(c.Bot(), c.Message(), saveDir, attachmentsDir, filenameTemplate, tmpl)
+		}
 		if err != nil {
-			return err
+			// Keep the message so nothing is lost and tell the user why.
+			log.Printf("Error saving message %d: %v", c.Message().ID, err)
+			return c.Reply("Failed to save: " + err.Error())
+		}
+		if !deleteAfterSave {
+			return c.Reply("Saved " + filename)
+		}
+		if err := c.Bot().Delete(c.Message()); err != nil {
+			log.Printf("Error deleting saved message: %v", err)
 		}
-		c.Bot().Delete(c.Message())
 		return nil
 	}
 }
 
 type MessageContext struct {
-	Source   string
-	Created  string
-	Modified string
-	Content  string
-	From     string
+	Source     string
+	Created    string
+	Modified   string
+	Content    string
+	From       string
+	SenderName string
+	Attachment string
 }
 
-func saveMessage(m *tele.Message, saveDir string, filenameTemplate string) error {
-	filename := m.Time().Format(filenameTemplate)
-	filepath := filepath.Join(saveDir, filename)
-	tmpl, err := template.ParseFiles("template.md.tmpl")
-	if err != nil {
-		log.Printf("Error parsing template: %v", err)
-		return err
+// savedMessage is where a message was saved: its note, or its section of a
+// daily note.
+type savedMessage struct {
+	filename string
+	section  string
+}
+
+// messageKey identifies a message across edits.
+type messageKey struct {
+	chat int64
+	id   int
+}
+
+func keyOf(m *tele.Message) messageKey {
+	key := messageKey{id: m.ID}
+	if m.Chat != nil {
+		key.chat = m.Chat.ID
+	}
+	return key
+}
+
+// savedMessages maps the messages saved since the bot started to where they
+// were saved, so that an edit replaces its note or section instead of adding
+// another one. Edits of messages saved before a restart are saved as new
+// messages.
+var savedMessages sync.Map
+
+// editedMessage returns where m was saved before if it is an edit.
+func editedMessage(m *tele.Message) (savedMessage, bool) {
+	if m.LastEdit == 0 {
+		return savedMessage{}, false
 	}
+	saved, ok := savedMessages.Load(keyOf(m))
+	if !ok {
+		return savedMessage{}, false
+	}
+	return saved.(savedMessage), true
+}
+
+// saveMessage writes m to a new note in saveDir, or over the note it was
+// saved to when m is an edit, and returns its filename once the file is fully
+// written.
+func saveMessage(bot tele.API, m *tele.Message, saveDir string, attachmentsDir string, filenameTemplate string, tmpl *template.Template) (string, error) {
+	var f *os.File
+	var err error
+	if previous, ok := editedMessage(m); ok {
+		f, err = os.OpenFile(filepath.Join(saveDir, previous.filename), os.O_WRONLY, 0644)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error opening note file: %v", err)
+			return "", err
+		}
+	}
+	created := f == nil
+	if created {
+		// A new message, or an edit whose note was moved away since
+		f, err = createNote(saveDir, m.Time().Format(filenameTemplate))
+		if err != nil {
+			log.Printf("Error creating note file: %v", err)
+			return "", err
+		}
+	}
+	defer f.Close()
+	saved := false
+	// An edit's attachment replaces the one its note links to, so only a new
+	// note's attachment goes with it
+	var attachment string
+	defer func() {
+		if !saved && created {
+			os.Remove(f.Name())
+			if attachment != "" {
+				os.Remove(attachment)
+			}
+		}
+	}()
+	filename := filepath.Base(f.Name())
 	context := MessageContext{
 		Source:   "telegram",
 		Created:  m.Time().Format(time.RFC3339),
 		Modified: time.Now().Format(time.RFC3339),
-		Content:  formatYamlContent(m.Text),
-		From:     m.OriginalSender.Username,
+		Content:  messageText(m),
+	}
+	context.From, context.SenderName = messageSender(m)
+	if file, ext := messageAttachment(m); file != nil {
+		name := strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+		link, err := saveAttachment(bot, file, name, saveDir, attachmentsDir)
+		if err != nil {
+			log.Printf("Error saving attachment: %v", err)
+			return "", err
+		}
+		attachment = filepath.Join(attachmentsDir, name)
+		context.Attachment = link
 	}
 
 	var content strings.Builder
 	if err := tmpl.Execute(&content, context); err != nil {
 		log.Printf("Error executing template: %v", err)
-		return err
+		return "", err
+	}
+	// The edited note is only emptied once its new content is ready
+	if err := f.Truncate(0); err != nil {
+		log.Printf("Error saving message to file: %v", err)
+		return "", err
+	}
+	if _, err := f.WriteString(content.String()); err != nil {
+		log.Printf("Error saving message to file: %v", err)
+		return "", err
 	}
-	if err := os.WriteFile(filepath, []byte(content.String()), 0644); err != nil {
+	if err := f.Close(); err != nil {
 		log.Printf("Error saving message to file: %v", err)
-		return err
+		return "", err
 	}
-	log.Printf("Message saved to %s", filepath)
-	return nil
+	saved = true
+	savedMessages.Store(keyOf(m), savedMessage{filename: filename})
+	log.Printf("Message saved to %s", f.Name())
+	return filename, nil
 }
 
-func formatYamlContent(content string) string {
-	// Trim trailing whitespace and split by newlines
-	lines := strings.Split(strings.TrimSpace(content), "\n")
+// dailyFilenameLayout names the notes messages are appended to with
+// APPEND_MODE=daily.
+const dailyFilenameLayout = "2006-01-02.md"
+
+// dailyNotes serializes writes to daily notes, so replacing an edited section
+// can't drop a section appended meanwhile.
+var dailyNotes sync.Mutex
+
+// appendMessage appends m as a "## HH:MM" section to the note for the day it
+// was sent, creating the note if needed, and returns the note's filename.
+// When m is an edit its section is replaced instead.
+func appendMessage(bot tele.API, m *tele.Message, saveDir string, attachmentsDir string) (string, error) {
+	filename := m.Time().Format(dailyFilenameLayout)
+	var section strings.Builder
+	fmt.Fprintf(&section, "## %s\n", m.Time().Format("15:04"))
+	if text := messageText(m); text != "" {
+		fmt.Fprintf(&section, "\n%s\n", text)
+	}
+	saved := false
+	// An edit's attachment replaces the one its section links to, so only a
+	// new message's attachment goes when it isn't appended
+	var attachment string
+	defer func() {
+		if !saved && attachment != "" {
+			os.Remove(attachment)
+		}
+	}()
+	if file, ext := messageAttachment(m); file != nil {
+		// Several attachments can land in the same daily note, so name them
+		// after the message rather than the note.
+		name := fmt.Sprintf("%s_%d%s", strings.TrimSuffix(filename, filepath.Ext(filename)), m.ID, ext)
+		link, err := saveAttachment(bot, file, name, saveDir, attachmentsDir)
+		if err != nil {
+			log.Printf("Error saving attachment: %v", err)
+			return "", err
+		}
+		if _, edited := editedMessage(m); !edited {
+			attachment = filepath.Join(attachmentsDir, name)
+		}
+		fmt.Fprintf(&section, "\n![](%s)\n", link)
+	}
+
+	path := filepath.Join(saveDir, filename)
+	content := section.String()
+	dailyNotes.Lock()
+	defer dailyNotes.Unlock()
+	if previous, ok := editedMessage(m); ok {
+		replaced, err := replaceSection(path, previous.section, content)
+		if err != nil {
+			log.Printf("Error updating daily note: %v", err)
+			return "", err
+		}
+		if replaced {
+			saved = true
+			savedMessages.Store(keyOf(m), savedMessage{filename: filename, section: content})
+			log.Printf("Message updated in %s", path)
+			return filename, nil
+		}
+	}
 
-	// Add two-space indentation to each line
-	for i, line := range lines {
-		lines[i] = "  " + line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error opening daily note: %v", err)
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Error opening daily note: %v", err)
+		return "", err
 	}
+	separator := ""
+	if info.Size() > 0 {
+		separator = "\n"
+	}
+	// A single write keeps sections from concurrent handlers apart.
+	if _, err := f.WriteString(separator + content); err != nil {
+		log.Printf("Error appending message to file: %v", err)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Error appending message to file: %v", err)
+		return "", err
+	}
+	saved = true
+	savedMessages.Store(keyOf(m), savedMessage{filename: filename, section: content})
+	log.Printf("Message appended to %s", path)
+	return filename, nil
+}
 
-	// Join back with newlines
-	return strings.Join(lines, "\n")
+// replaceSection replaces the first occurrence of section in the note at path.
+// It reports false when the note or the section is gone, e.g. after the note
+// was edited by hand.
+func replaceSection(path string, section string, replacement string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	note := string(data)
+	if !strings.Contains(note, section) {
+		return false, nil
+	}
+	return true, os.WriteFile(path, []byte(strings.Replace(note, section, replacement, 1)), 0644)
+}
+
+// messageText returns the text or caption of m as markdown.
+func messageText(m *tele.Message) string {
+	text, entities := m.Text, m.Entities
+	if text == "" {
+		text, entities = m.Caption, m.CaptionEntities
+	}
+	return strings.TrimSpace(entitiesToMarkdown(text, entities))
+}
+
+// createNote creates filename in saveDir, adding a -2, -3, ... suffix when a
+// note with that name already exists, e.g. for several messages forwarded
+// within the same second. The file is created exclusively, so concurrent
+// handlers never end up sharing a name.
+func createNote(saveDir string, filename string) (*os.File, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; ; i++ {
+		name := filename
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		f, err := os.OpenFile(filepath.Join(saveDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// messageAttachment returns the file attached to a message, if any, along
+// with the extension it should be saved under.
+func messageAttachment(m *tele.Message) (*tele.File, string) {
+	switch {
+	case m.Photo != nil:
+		// Telegram re-encodes photos as JPEG.
+		return &m.Photo.File, ".jpg"
+	case m.Document != nil:
+		return &m.Document.File, filepath.Ext(m.Document.FileName)
+	}
+	return nil, ""
+}
+
+// saveAttachment downloads file as name into attachmentsDir and returns its
+// path relative to saveDir, for linking from the note.
+func saveAttachment(bot tele.API, file *tele.File, name, saveDir, attachmentsDir string) (string, error) {
+	path := filepath.Join(attachmentsDir, name)
+	if err := bot.Download(file, path); err != nil {
+		return "", err
+	}
+	log.Printf("Attachment saved to %s", path)
+	link, err := filepath.Rel(saveDir, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(link), nil
+}
+
+// messageSender returns an identifier and a display name for whoever wrote
+// the message: the original author for forwards, the sender otherwise.
+func messageSender(m *tele.Message) (string, string) {
+	switch {
+	case m.OriginalSender != nil:
+		return userSender(m.OriginalSender)
+	case m.OriginalChat != nil:
+		return chatSender(m.OriginalChat)
+	case m.OriginalSenderName != "":
+		// Forwarded from a user who hides their account.
+		return m.OriginalSenderName, m.OriginalSenderName
+	case m.Sender != nil:
+		return userSender(m.Sender)
+	case m.SenderChat != nil:
+		return chatSender(m.SenderChat)
+	case m.Chat != nil:
+		return chatSender(m.Chat)
+	}
+	return "", ""
+}
+
+func userSender(u *tele.User) (string, string) {
+	from := u.Username
+	if from == "" {
+		from = u.FirstName
+	}
+	if from == "" {
+		from = strconv.FormatInt(u.ID, 10)
+	}
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		name = from
+	}
+	return from, name
+}
+
+func chatSender(c *tele.Chat) (string, string) {
+	from := c.Username
+	if from == "" {
+		from = c.Title
+	}
+	if from == "" {
+		from = strconv.FormatInt(c.ID, 10)
+	}
+	name := c.Title
+	if name == "" {
+		name = strings.TrimSpace(c.FirstName + " " + c.LastName)
+	}
+	if name == "" {
+		name = from
+	}
+	return from, name
+}
+
+// markdownMarkers returns the markdown written around text carrying entity e.
+// Entities markdown has no syntax for (underline, spoilers) are dropped, as
+// are the ones Telegram derives from the text itself, like plain URLs.
+func markdownMarkers(e tele.MessageEntity) (string, string, bool) {
+	switch e.Type {
+	case tele.EntityBold:
+		return "**", "**", true
+	case tele.EntityItalic:
+		return "*", "*", true
+	case tele.EntityStrikethrough:
+		return "~~", "~~", true
+	case tele.EntityCode:
+		return "`", "`", true
+	case tele.EntityCodeBlock:
+		return "```" + e.Language + "\n", "\n```", true
+	case tele.EntityTextLink:
+		return "[", "](" + e.URL + ")", true
+	case tele.EntityTMention:
+		if e.User != nil {
+			return "[", fmt.Sprintf("](tg://user?id=%d)", e.User.ID), true
+		}
+	}
+	return "", "", false
+}
+
+type markdownMark struct {
+	pos   int
+	text  string
+	open  bool
+	start int
+	end   int
+	index int
+}
+
+// entitiesToMarkdown renders Telegram formatting entities as markdown.
+// Entity offsets count UTF-16 code units, so text is converted to UTF-16 to
+// place the markers.
+func entitiesToMarkdown(text string, entities []tele.MessageEntity) string {
+	u := utf16.Encode([]rune(text))
+	var marks []markdownMark
+	for i, e := range entities {
+		open, close, ok := markdownMarkers(e)
+		if !ok {
+			continue
+		}
+		start := min(max(e.Offset, 0), len(u))
+		end := min(max(e.Offset+e.Length, start), len(u))
+		if e.Type != tele.EntityCodeBlock {
+			// "**bold **" is not bold in markdown, keep spaces outside.
+			for start < end && unicode.IsSpace(rune(u[start])) {
+				start++
+			}
+			for end > start && unicode.IsSpace(rune(u[end-1])) {
+				end--
+			}
+		}
+		if start == end {
+			continue
+		}
+		marks = append(marks,
+			markdownMark{pos: start, text: open, open: true, start: start, end: end, index: i},
+			markdownMark{pos: end, text: close, start: start, end: end, index: i},
+		)
+	}
+	// Close inner entities before outer ones and open outer entities first,
+	// so nested formatting stays properly nested.
+	sort.SliceStable(marks, func(i, j int) bool {
+		a, b := marks[i], marks[j]
+		if a.pos != b.pos {
+			return a.pos < b.pos
+		}
+		if a.open != b.open {
+			return !a.open
+		}
+		if a.open {
+			if a.end != b.end {
+				return a.end > b.end
+			}
+			return a.index < b.index
+		}
+		if a.start != b.start {
+			return a.start > b.start
+		}
+		return a.index > b.index
+	})
+
+	var out strings.Builder
+	prev := 0
+	for _, m := range marks {
+		out.WriteString(string(utf16.Decode(u[prev:m.pos])))
+		out.WriteString(m.text)
+		prev = m.pos
+	}
+	out.WriteString(string(utf16.Decode(u[prev:])))
+	return out.String()
+}
+
+// oldBlockScalar matches frontmatter values written the way templates did
+// before the yaml function, e.g. "summary: |" followed by "{{ .Content }}" on
+// the next line. That relied on .Content being indented line by line, which
+// it no longer is, so the block ends up empty and the frontmatter breaks.
+var oldBlockScalar = regexp.MustCompile(`(?m)^([\w-]+):[ \t]*[|>][-+]?[ \t]*\n\{\{-?\s*\.(\w+)\s*-?\}\}`)
+
+// parseTemplate parses the note template at path, making the yaml function
+// available to it for quoting frontmatter values. Templates still using the
+// old block scalar form are rejected rather than writing broken frontmatter.
+func parseTemplate(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if match := oldBlockScalar.FindSubmatch(text); match != nil {
+		return nil, fmt.Errorf("%s: %s is written as a block scalar, which breaks the frontmatter, use \"%s: {{ yaml .%s }}\" instead", path, match[1], match[1], match[2])
+	}
+	return template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"yaml": yamlScalar,
+	}).Parse(string(text))
+}
+
+// yamlScalar renders s as a YAML value that parses back to s wherever it is
+// placed after a mapping key: plain when that is safe, quoted when s has
+// colons, leading dashes and the like, and a block scalar when it spans
+// several lines.
+func yamlScalar(s string) (string, error) {
+	out, err := yaml.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSaveMessageSameTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	tmpl, err := parseTemplate("template.md.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Unix()
+	for _, text := range []string{"first", "second"} {
+		m := &tele.Message{Unixtime: created, Text: text, Sender: &tele.User{Username: "jot"}}
+		if _, err := saveMessage(nil, m, dir, filepath.Join(dir, "attachments"), "inbox_20060102_150405.md", tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"inbox_20240101_120000-2.md", "inbox_20240101_120000.md"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	second, err := os.ReadFile(filepath.Join(dir, want[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(second), "summary: second\n") {
+		t.Errorf("%s does not contain the second message:\n%s", want[0], second)
+	}
+}
+
+func TestSaveMessageEdited(t *testing.T) {
+	dir := t.TempDir()
+	tmpl, err := parseTemplate("template.md.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	chat := &tele.Chat{ID: 1}
+	sender := &tele.User{Username: "jot"}
+	messages := []*tele.Message{
+		{ID: 101, Chat: chat, Unixtime: created.Unix(), Text: "first", Sender: sender},
+		{ID: 102, Chat: chat, Unixtime: created.Unix(), Text: "second", Sender: sender},
+		// Edits keep the original date
+		{ID: 102, Chat: chat, Unixtime: created.Unix(), LastEdit: created.Add(time.Minute).Unix(), Text: "second, edited", Sender: sender},
+		{ID: 101, Chat: chat, Unixtime: created.Unix(), LastEdit: created.Add(time.Minute).Unix(), Text: "first, edited", Sender: sender},
+	}
+	for _, m := range messages {
+		if _, err := saveMessage(nil, m, dir, filepath.Join(dir, "attachments"), "inbox_20060102_150405.md", tmpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := map[string]string{"inbox_20240101_120000.md": "first, edited", "inbox_20240101_120000-2.md": "second, edited"}
+	if len(names) != len(want) {
+		t.Fatalf("files = %v, want one note per message", names)
+	}
+	for name, summary := range want {
+		note, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(note), "summary: "+summary+"\n") || strings.Count(string(note), "summary:") != 1 {
+			t.Errorf("%s does not hold just the edited message:\n%s", name, note)
+		}
+	}
+}
+
+// downloadBot downloads every file as a placeholder
+type downloadBot struct {
+	tele.API
+}
+
+func (downloadBot) Download(file *tele.File, path string) error {
+	return os.WriteFile(path, []byte("jpeg"), 0644)
+}
+
+func TestSaveMessageTemplateError(t *testing.T) {
+	dir := t.TempDir()
+	attachments := filepath.Join(dir, "attachments")
+	if err := os.Mkdir(attachments, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template.Must(template.New("broken").Parse("{{ .Missing }}"))
+	m := &tele.Message{ID: 301, Unixtime: time.Now().Unix(), Caption: "photo", Photo: &tele.Photo{File: tele.File{FileID: "photo"}}}
+	if _, err := saveMessage(downloadBot{}, m, dir, attachments, "inbox_20060102_150405.md", tmpl); err == nil {
+		t.Fatal("expected the template error")
+	}
+
+	for _, d := range []string{dir, attachments} {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				t.Errorf("%s was left behind", e.Name())
+			}
+		}
+	}
+}
+
+func TestAppendMessageDaily(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)
+	messages := []*tele.Message{
+		{Unixtime: day.Unix(), Text: "first"},
+		{Unixtime: day.Add(2 * time.Hour).Unix(), Text: "second"},
+		{Unixtime: day.Add(24 * time.Hour).Unix(), Text: "next day"},
+	}
+	for _, m := range messages {
+		if _, err := appendMessage(nil, m, dir, filepath.Join(dir, "attachments")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "2024-06-01.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## 09:30\n\nfirst\n\n## 11:30\n\nsecond\n"
+	if string(got) != want {
+		t.Errorf("daily note = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2024-06-02.md")); err != nil {
+		t.Errorf("next day's note: %v", err)
+	}
+}
+
+func TestAppendMessageDailyEdited(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)
+	chat := &tele.Chat{ID: 1}
+	messages := []*tele.Message{
+		{ID: 201, Chat: chat, Unixtime: day.Unix(), Text: "first"},
+		{ID: 202, Chat: chat, Unixtime: day.Add(2 * time.Hour).Unix(), Text: "second"},
+		{ID: 201, Chat: chat, Unixtime: day.Unix(), LastEdit: day.Add(3 * time.Hour).Unix(), Text: "first, edited"},
+	}
+	for _, m := range messages {
+		if _, err := appendMessage(nil, m, dir, filepath.Join(dir, "attachments")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "2024-06-01.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## 09:30\n\nfirst, edited\n\n## 11:30\n\nsecond\n"
+	if string(got) != want {
+		t.Errorf("daily note = %q, want %q", got, want)
+	}
+}
+
+func TestAppendMessageDailyWriteError(t *testing.T) {
+	dir := t.TempDir()
+	attachments := filepath.Join(dir, "attachments")
+	if err := os.Mkdir(attachments, 0755); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2024, 6, 1, 9, 30, 0, 0, time.Local)
+	// A directory in place of the daily note can't be appended to
+	if err := os.Mkdir(filepath.Join(dir, "2024-06-01.md"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := &tele.Message{ID: 401, Unixtime: day.Unix(), Caption: "photo", Photo: &tele.Photo{File: tele.File{FileID: "photo"}}}
+	if _, err := appendMessage(downloadBot{}, m, dir, attachments); err == nil {
+		t.Fatal("expected the daily note error")
+	}
+
+	entries, err := os.ReadDir(attachments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s was left behind", e.Name())
+	}
+}
+
+func TestEntitiesToMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		entities []tele.MessageEntity
+		want     string
+	}{
+		{
+			name: "plain",
+			text: "just text",
+			want: "just text",
+		},
+		{
+			name: "bold and link",
+			text: "read the docs now",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityBold, Offset: 0, Length: 4},
+				{Type: tele.EntityTextLink, Offset: 9, Length: 4, URL: "https://example.com"},
+			},
+			want: "**read** the [docs](https://example.com) now",
+		},
+		{
+			name: "nested",
+			text: "bold italic",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityBold, Offset: 0, Length: 11},
+				{Type: tele.EntityItalic, Offset: 5, Length: 6},
+			},
+			want: "**bold *italic***",
+		},
+		{
+			name: "trailing space",
+			text: "bold text",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityBold, Offset: 0, Length: 5},
+			},
+			want: "**bold** text",
+		},
+		{
+			name: "utf16 offsets",
+			text: "🙂 run go test",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityCode, Offset: 7, Length: 7},
+			},
+			want: "🙂 run `go test`",
+		},
+		{
+			name: "code block",
+			text: "fmt.Println()",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityCodeBlock, Offset: 0, Length: 13, Language: "go"},
+			},
+			want: "```go\nfmt.Println()\n```",
+		},
+		{
+			name: "url left alone",
+			text: "see https://example.com",
+			entities: []tele.MessageEntity{
+				{Type: tele.EntityURL, Offset: 4, Length: 19},
+			},
+			want: "see https://example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entitiesToMarkdown(tt.text, tt.entities); got != tt.want {
+				t.Errorf("entitiesToMarkdown() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTemplateOldBlockScalar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.md.tmpl")
+	old := "---\nsummary: |\n{{ .Content }}\nsource: {{ .Source }}\n---\n"
+	if err := os.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := parseTemplate(path)
+	if err == nil || !strings.Contains(err.Error(), `"summary: {{ yaml .Content }}"`) {
+		t.Errorf("expected the old summary form to be rejected, got %v", err)
+	}
+}
+
+func TestTemplateFrontmatterRoundTrip(t *testing.T) {
+	tmpl, err := parseTemplate("template.md.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{
+		"plain note",
+		"key: value",
+		"- looks like a list",
+		"# not a comment",
+		"  indented first line\nthen not",
+		"multi\nline\n\nwith a blank line",
+		`"quoted" and 'single' and \backslash`,
+		"trailing spaces   \nnext",
+		"",
+	}
+	for _, content := range contents {
+		var out strings.Builder
+		err := tmpl.Execute(&out, MessageContext{
+			Source:     "telegram",
+			Content:    content,
+			From:       "-dash",
+			SenderName: "Name: Surname",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.SplitN(out.String(), "---\n", 3)
+		if len(parts) != 3 {
+			t.Fatalf("no frontmatter in:\n%s", out.String())
+		}
+		var fm map[string]any
+		if err := yaml.Unmarshal([]byte(parts[1]), &fm); err != nil {
+			t.Fatalf("content %q: %v\n%s", content, err, parts[1])
+		}
+		if fm["summary"] != content {
+			t.Errorf("summary = %q, want %q", fm["summary"], content)
+		}
+		if fm["sender"] != "-dash" || fm["sender_name"] != "Name: Surname" {
+			t.Errorf("sender = %q, sender_name = %q", fm["sender"], fm["sender_name"])
+		}
+	}
+}
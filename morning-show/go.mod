@@ -4,6 +4,7 @@ go 1.24.2
 
 require (
 	github.com/caarlos0/env/v11 v11.3.1
+	golang.org/x/net v0.43.0
 	google.golang.org/genai v1.24.0
 	miniflux.app/v2 v2.2.12
 )
@@ -19,7 +20,6 @@ require (
 	github.com/gorilla/websocket v1.5.3 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/crypto v0.41.0 // indirect
-	golang.org/x/net v0.43.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
@@ -3,14 +3,22 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/caarlos0/env/v11"
+	"golang.org/x/net/html"
 	"google.golang.org/genai"
 	mflux "miniflux.app/v2/client"
 )
@@ -19,6 +27,74 @@ type Config struct {
 	MinifluxURL   string `env:"MINIFLUX_URL"`
 	MinifluxToken string `env:"MINIFLUX_TOKEN"`
 	GeminiAPIKey  string `env:"GEMINI_API_KEY"`
+	// FeedWeights maps a feed ID or title to its weight, e.g. "Hacker News:3,12:2".
+	// Feeds without a weight default to 1.
+	FeedWeights map[string]int `env:"FEED_WEIGHTS"`
+	// OutputFormat is "wav" or "mp3". When empty a WAV is written and
+	// converted to MP3 if ffmpeg is available.
+	OutputFormat string `env:"OUTPUT_FORMAT"`
+	// MarkRead marks the summarized entries as read once the show is saved,
+	// so the next run doesn't repeat them
+	MarkRead bool `env:"MARK_READ"`
+	// MaxEntries caps how many unread entries are summarized, 0 reads all
+	MaxEntries int `env:"MAX_ENTRIES"`
+	// SummaryModel is the Gemini model that writes the show
+	SummaryModel string `env:"SUMMARY_MODEL" envDefault:"gemini-2.5-flash-lite"`
+	// SummaryPrompt replaces summary-prompt.md, the entries are still
+	// appended to it
+	SummaryPrompt string `env:"SUMMARY_PROMPT"`
+	// DryRun writes the summary to a text file and stdout and skips TTS,
+	// entries are left unread
+	DryRun bool `env:"DRY_RUN"`
+	// GroupBy is "feed" or "category" to have the show segmented by the
+	// entries' feed or feed category, empty keeps a single list
+	GroupBy string `env:"GROUP_BY"`
+	// IncludeFeedIDs keeps only entries from these feeds, ExcludeFeedIDs
+	// drops entries from them
+	IncludeFeedIDs []int64 `env:"INCLUDE_FEED_IDS"`
+	ExcludeFeedIDs []int64 `env:"EXCLUDE_FEED_IDS"`
+	// IncludeCategories and ExcludeCategories do the same for categories,
+	// matched by ID or title
+	IncludeCategories []string `env:"INCLUDE_CATEGORIES"`
+	ExcludeCategories []string `env:"EXCLUDE_CATEGORIES"`
+	// FeedPath is a podcast RSS file each episode is added to, episodes are
+	// linked under FeedBaseURL. Disabled when empty.
+	FeedPath        string `env:"FEED_PATH"`
+	FeedTitle       string `env:"FEED_TITLE" envDefault:"Morning Show"`
+	FeedBaseURL     string `env:"FEED_BASE_URL"`
+	FeedMaxEpisodes int    `env:"FEED_MAX_EPISODES" envDefault:"30"`
+}
+
+// Validate checks the configuration upfront, reporting every problem at once
+func (c Config) Validate() error {
+	var errs []error
+	for name, value := range map[string]string{
+		"MINIFLUX_URL":   c.MinifluxURL,
+		"MINIFLUX_TOKEN": c.MinifluxToken,
+		"GEMINI_API_KEY": c.GeminiAPIKey,
+	} {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	if c.GroupBy != "" && c.GroupBy != "feed" && c.GroupBy != "category" {
+		errs = append(errs, fmt.Errorf("invalid GROUP_BY %q, expected feed or category", c.GroupBy))
+	}
+	if c.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("MAX_ENTRIES can't be negative"))
+	}
+	// No audio is produced in a dry run
+	if !c.DryRun {
+		if err := checkOutputFormat(c.OutputFormat); err != nil {
+			errs = append(errs, err)
+		}
+		if c.FeedPath != "" && c.FeedBaseURL == "" {
+			errs = append(errs, fmt.Errorf("FEED_PATH needs FEED_BASE_URL to link the episodes"))
+		}
+	}
+	// Map iteration order is random, keep the message stable
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
 }
 
 func main() {
@@ -27,21 +103,23 @@ func main() {
 	if err := env.Parse(&config); err != nil {
 		log.Fatalf("Failed to parse environment variables: %v", err)
 	}
+	// Fail before spending any API quota on a show that can't be saved
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	mfluxClient := mflux.NewClient(config.MinifluxURL, config.MinifluxToken)
 
 	// Step 1: Read unread entries from Miniflux
-	entries, err := mfluxClient.Entries(&mflux.Filter{
-		Status: mflux.EntryStatusUnread,
-	})
+	entries, err := readUnreadEntries(mfluxClient, config)
 	if err != nil {
 		log.Fatalf("Failed to read Miniflux entries: %v", err)
 	}
-	if entries.Total == 0 {
+	if len(entries) == 0 {
 		log.Println("No unread entries found. Exiting.")
 		return
 	}
-	log.Printf("Found %d unread entries", entries.Total)
+	log.Printf("Found %d unread entries", len(entries))
 
 	// Step 2: Summarize entries using Gemini
 	genaiClient, err := genai.NewClient(context.Background(), &genai.ClientConfig{
@@ -52,10 +130,13 @@ func main() {
 		log.Fatalf("Failed to create Gemini client: %v", err)
 	}
 
-	// Read the prompt template from markdown file
-	promptTemplate, err := os.ReadFile("summary-prompt.md")
-	if err != nil {
-		log.Fatalf("Failed to read summary-prompt.md: %v", err)
+	// Read the prompt template from markdown file unless one is configured
+	promptTemplate := []byte(config.SummaryPrompt)
+	if config.SummaryPrompt == "" {
+		promptTemplate, err = os.ReadFile("summary-prompt.md")
+		if err != nil {
+			log.Fatalf("Failed to read summary-prompt.md: %v", err)
+		}
 	}
 
 	var prompt strings.Builder
@@ -64,70 +145,634 @@ func main() {
 	dayOfWeek := currentTime.Format("Monday")
 	date := currentTime.Format("January 2, 2006")
 	prompt.WriteString(fmt.Sprintf("Today is %s, %s.\n\n", dayOfWeek, date))
-	prompt.WriteString(fmt.Sprintf("Number of entries: %d.\n\n", entries.Total))
+	prompt.WriteString(fmt.Sprintf("Number of entries: %d.\n\n", len(entries)))
 	prompt.WriteString(string(promptTemplate))
+	if len(config.FeedWeights) > 0 {
+		prompt.WriteString("Entries are ordered by priority. Cover high priority entries first and in more depth, mention low priority ones only briefly.\n\n")
+	}
+
+	if config.GroupBy != "" {
+		prompt.WriteString(fmt.Sprintf("Entries are grouped by %s under headings. Present each group as its own clearly introduced segment, with a short transition between segments.\n\n", config.GroupBy))
+	}
 
-	for i, entry := range entries.Entries {
-		content := entry.Content
-		// Truncate the content to 200 characters
-		if len(entry.Content) > 200 {
-			content = entry.Content[:200] + "..."
+	i := 0
+	for _, group := range groupEntries(weightEntries(entries, config.FeedWeights), config.GroupBy) {
+		if config.GroupBy != "" {
+			prompt.WriteString(fmt.Sprintf("\n## %s\n\n", group.Name))
+		}
+		for _, weighted := range group.Entries {
+			i++
+			entry := weighted.Entry
+			// Content is HTML, keep the first 200 characters of its text
+			content := truncateWords(plainText(entry.Content), 200)
+			prompt.WriteString(fmt.Sprintf("%d. [%s]%s %s - %s\n", i, feedTitle(entry), weighted.Emphasis, entry.Title, content))
 		}
-		prompt.WriteString(fmt.Sprintf("%d. [%s] %s - %s\n", i+1, entry.Feed.Title, entry.Title, content))
 	}
 
 	sumaryParts := []*genai.Part{
 		{Text: prompt.String()},
 	}
 
-	result, err := genaiClient.Models.GenerateContent(context.Background(), "gemini-2.5-flash-lite", []*genai.Content{{Parts: sumaryParts}}, nil)
+	var result *genai.GenerateContentResponse
+	err = withRetry("summarize entries", func() error {
+		result, err = genaiClient.Models.GenerateContent(context.Background(), config.SummaryModel, []*genai.Content{{Parts: sumaryParts}}, nil)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to generate content: %v", err)
+		fatalAPIError("summarize entries", err)
 	}
 
 	log.Println(result.Text())
 
 	log.Println("Entries summarized successfully")
 
+	timestamp := time.Now().Format("20060102150405")
+	if config.DryRun {
+		fileName := fmt.Sprintf("morning-show-%s.txt", timestamp)
+		if err := os.WriteFile(fileName, []byte(result.Text()), 0644); err != nil {
+			log.Fatalf("Failed to write summary: %v", err)
+		}
+		fmt.Println(result.Text())
+		log.Printf("Dry run, summary written to %s", fileName)
+		return
+	}
+
+	// TTS rejects long inputs, so the summary is spoken in chunks and the
+	// PCM of each is concatenated
+	var audio []byte
+	chunks := splitText(result.Text(), ttsChunkLimit)
+	for i, chunk := range chunks {
+		log.Printf("Generating speech for chunk %d/%d", i+1, len(chunks))
+		pcm, err := generateSpeech(genaiClient, chunk)
+		if err != nil {
+			fatalAPIError("generate speech", err)
+		}
+		audio = append(audio, pcm...)
+	}
+
+	// Save as WAV file with timestamp in the name
+	fileName := fmt.Sprintf("morning-show-%s.wav", timestamp)
+	err = writeWAVFile(fileName, audio, 24000, 1, 16)
+	if err != nil {
+		log.Fatalf("Failed to write WAV file: %v", err)
+	}
+
+	mp3Name := strings.TrimSuffix(fileName, ".wav") + ".mp3"
+	// episode is the file published in the podcast feed
+	episode := fileName
+	switch config.OutputFormat {
+	case "wav":
+		log.Printf("Morning show audio generated successfully: %s", fileName)
+	case "mp3":
+		if err := convertWAVToMP3(fileName, mp3Name); err != nil {
+			log.Fatalf("Failed to encode MP3: %v", err)
+		}
+		os.Remove(fileName)
+		episode = mp3Name
+		log.Printf("Morning show audio generated successfully: %s", mp3Name)
+	default:
+		log.Printf("Morning show audio generated successfully: %s", fileName)
+
+		// Convert WAV to MP3 using ffmpeg if available
+		if err := convertWAVToMP3(fileName, mp3Name); err != nil {
+			log.Printf("WAV->MP3 conversion skipped/failed: %v", err)
+		} else {
+			episode = mp3Name
+			log.Printf("MP3 created: %s", mp3Name)
+		}
+	}
+
+	if config.FeedPath != "" {
+		// 24kHz 16-bit mono is 48000 bytes per second
+		duration := time.Duration(len(audio)) * time.Second / 48000
+		if err := addEpisode(config, episode, currentTime, duration, result.Text()); err != nil {
+			log.Fatalf("Failed to update podcast feed: %v", err)
+		}
+		log.Printf("Podcast feed updated: %s", config.FeedPath)
+	}
+
+	if config.MarkRead {
+		if err := markEntriesRead(mfluxClient, entries); err != nil {
+			log.Fatalf("Failed to mark entries as read: %v", err)
+		}
+		log.Printf("Marked %d entries as read", len(entries))
+	}
+}
+
+// plainText returns the text of an HTML fragment with whitespace collapsed,
+// leaving out scripts and styles
+func plainText(content string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(content))
+	var text strings.Builder
+	skip := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(text.String()), " ")
+		case html.TextToken:
+			if skip == 0 {
+				text.Write(tokenizer.Text())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data == "script" || token.Data == "style" {
+				if token.Type == html.StartTagToken {
+					skip++
+				} else if token.Type == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			}
+			// Tags like <p>, <br> and <br/> separate words
+			text.WriteByte(' ')
+		}
+	}
+}
+
+// truncateWords shortens text to at most limit bytes plus an ellipsis,
+// breaking between words
+func truncateWords(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := strings.LastIndex(text[:limit+1], " ")
+	if cut <= 0 {
+		// A single long word, back up to a rune boundary
+		cut = limit
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+	}
+	return strings.TrimSpace(text[:cut]) + "..."
+}
+
+// filterEntries keeps the entries allowed by the feed and category include
+// and exclude lists. Empty include lists allow everything.
+func filterEntries(entries mflux.Entries, config Config) mflux.Entries {
+	var filtered mflux.Entries
+	for _, entry := range entries {
+		category := entryCategory(entry)
+		if len(config.IncludeFeedIDs) > 0 && !slices.Contains(config.IncludeFeedIDs, entry.FeedID) {
+			continue
+		}
+		if slices.Contains(config.ExcludeFeedIDs, entry.FeedID) {
+			continue
+		}
+		if len(config.IncludeCategories) > 0 && !matchesCategory(category, config.IncludeCategories) {
+			continue
+		}
+		if matchesCategory(category, config.ExcludeCategories) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+func entryCategory(entry *mflux.Entry) *mflux.Category {
+	if entry.Feed == nil {
+		return nil
+	}
+	return entry.Feed.Category
+}
+
+// matchesCategory reports whether category is listed by ID or title
+func matchesCategory(category *mflux.Category, categories []string) bool {
+	if category == nil {
+		return false
+	}
+	return slices.Contains(categories, strconv.FormatInt(category.ID, 10)) ||
+		slices.Contains(categories, category.Title)
+}
+
+// entriesPageSize is how many entries are requested from Miniflux at once
+const entriesPageSize = 100
+
+// readUnreadEntries pages through the unread entries the feed and category
+// filters allow until all of them, or MaxEntries if it's positive, are read.
+// Filtering comes first so excluded entries don't use up MaxEntries.
+func readUnreadEntries(client *mflux.Client, config Config) (mflux.Entries, error) {
+	var entries mflux.Entries
+	for offset := 0; ; {
+		page, err := client.Entries(&mflux.Filter{
+			Status: mflux.EntryStatusUnread,
+			Limit:  entriesPageSize,
+			Offset: offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+		offset += len(page.Entries)
+		entries = append(entries, filterEntries(page.Entries, config)...)
+		if config.MaxEntries > 0 && len(entries) >= config.MaxEntries {
+			return entries[:config.MaxEntries], nil
+		}
+		if len(page.Entries) == 0 || offset >= page.Total {
+			return entries, nil
+		}
+	}
+}
+
+// markEntriesRead sets the status of the entries to read in Miniflux
+func markEntriesRead(client *mflux.Client, entries mflux.Entries) error {
+	ids := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return client.UpdateEntries(ids, mflux.EntryStatusRead)
+}
+
+// ttsChunkLimit is the most bytes of text sent to TTS at once, the endpoint
+// rejects inputs over about 5000 bytes
+const ttsChunkLimit = 4500
+
+// generateSpeech returns the spoken text as 24kHz 16-bit mono PCM
+func generateSpeech(client *genai.Client, text string) ([]byte, error) {
 	showParts := []*genai.Part{
-		{Text: result.Text()},
-	}
-	showResult, err := genaiClient.Models.GenerateContent(
-		context.Background(),
-		"gemini-2.5-flash-preview-tts",
-		[]*genai.Content{{Parts: showParts}}, // Content to be spoken
-		&genai.GenerateContentConfig{
-			ResponseModalities: []string{"AUDIO"},
-			SpeechConfig: &genai.SpeechConfig{
-				VoiceConfig: &genai.VoiceConfig{
-					PrebuiltVoiceConfig: &genai.PrebuiltVoiceConfig{
-						VoiceName: "Aoede",
+		{Text: text},
+	}
+	var showResult *genai.GenerateContentResponse
+	err := withRetry("generate speech", func() error {
+		var err error
+		showResult, err = client.Models.GenerateContent(
+			context.Background(),
+			"gemini-2.5-flash-preview-tts",
+			[]*genai.Content{{Parts: showParts}}, // Content to be spoken
+			&genai.GenerateContentConfig{
+				ResponseModalities: []string{"AUDIO"},
+				SpeechConfig: &genai.SpeechConfig{
+					VoiceConfig: &genai.VoiceConfig{
+						PrebuiltVoiceConfig: &genai.PrebuiltVoiceConfig{
+							VoiceName: "Aoede",
+						},
 					},
 				},
 			},
-		},
-	)
+		)
+		return err
+	})
 	if err != nil {
-		log.Fatalf("Failed to generate content: %v", err)
+		return nil, err
 	}
+	if len(showResult.Candidates) == 0 || showResult.Candidates[0].Content == nil ||
+		len(showResult.Candidates[0].Content.Parts) == 0 || showResult.Candidates[0].Content.Parts[0].InlineData == nil {
+		return nil, errors.New("no audio in the response")
+	}
+	return showResult.Candidates[0].Content.Parts[0].InlineData.Data, nil
+}
 
-	// Save as WAV file with timestamp in the name
-	timestamp := time.Now().Format("20060102150405")
-	fileName := fmt.Sprintf("morning-show-%s.wav", timestamp)
-	err = writeWAVFile(fileName, showResult.Candidates[0].Content.Parts[0].InlineData.Data, 24000, 1, 16)
+// splitText splits text into chunks of at most limit bytes, breaking after
+// sentence ends so the audio doesn't cut off mid-sentence. Sentences longer
+// than limit are broken between words.
+func splitText(text string, limit int) []string {
+	var chunks []string
+	var chunk strings.Builder
+	for _, sentence := range splitSentences(text) {
+		if chunk.Len() > 0 && chunk.Len()+len(sentence) > limit {
+			chunks = append(chunks, strings.TrimSpace(chunk.String()))
+			chunk.Reset()
+		}
+		for len(sentence) > limit {
+			cut := strings.LastIndex(sentence[:limit], " ")
+			if cut <= 0 {
+				// No space to break at, back up to a rune boundary
+				cut = limit
+				for cut > 0 && !utf8.RuneStart(sentence[cut]) {
+					cut--
+				}
+			}
+			chunks = append(chunks, strings.TrimSpace(sentence[:cut]))
+			sentence = sentence[cut:]
+		}
+		chunk.WriteString(sentence)
+	}
+	if strings.TrimSpace(chunk.String()) != "" {
+		chunks = append(chunks, strings.TrimSpace(chunk.String()))
+	}
+	return chunks
+}
+
+// splitSentences splits text after sentence ending punctuation and line
+// breaks, keeping the whitespace so the sentences join back into text
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		end := text[i] == '\n'
+		if strings.IndexByte(".!?", text[i]) >= 0 && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\n') {
+			end = true
+		}
+		if !end {
+			continue
+		}
+		// Keep the following whitespace with the sentence
+		for i+1 < len(text) && (text[i+1] == ' ' || text[i+1] == '\n') {
+			i++
+		}
+		sentences = append(sentences, text[start:i+1])
+		start = i + 1
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
+
+// podcastFeed is the RSS document of the podcast feed
+type podcastFeed struct {
+	XMLName xml.Name       `xml:"rss"`
+	Version string         `xml:"version,attr"`
+	ITunes  string         `xml:"xmlns:itunes,attr"`
+	Channel podcastChannel `xml:"channel"`
+}
+
+type podcastChannel struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description"`
+	Items       []podcastItem `xml:"item"`
+}
+
+type podcastItem struct {
+	Title       string           `xml:"title"`
+	Description string           `xml:"description"`
+	GUID        string           `xml:"guid"`
+	PubDate     string           `xml:"pubDate"`
+	Enclosure   podcastEnclosure `xml:"enclosure"`
+	Duration    string           `xml:"itunes:duration"`
+}
+
+type podcastEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// addEpisode adds the episode file to the podcast feed at config.FeedPath,
+// creating the feed if needed and keeping the newest FeedMaxEpisodes
+func addEpisode(config Config, episode string, published time.Time, duration time.Duration, description string) error {
+	info, err := os.Stat(episode)
 	if err != nil {
-		log.Fatalf("Failed to write WAV file: %v", err)
+		return err
+	}
+	feed, err := readPodcastFeed(config.FeedPath)
+	if err != nil {
+		return err
 	}
+	feed.Channel.Title = config.FeedTitle
+	feed.Channel.Link = config.FeedBaseURL
+	feed.Channel.Description = "Daily summary of unread Miniflux entries"
 
-	log.Printf("Morning show audio generated successfully: %s", fileName)
+	mediaType := "audio/wav"
+	if strings.HasSuffix(episode, ".mp3") {
+		mediaType = "audio/mpeg"
+	}
+	url := strings.TrimSuffix(config.FeedBaseURL, "/") + "/" + filepath.Base(episode)
+	item := podcastItem{
+		Title:       fmt.Sprintf("%s - %s", config.FeedTitle, published.Format("Monday, January 2, 2006")),
+		Description: description,
+		GUID:        url,
+		PubDate:     published.Format(time.RFC1123Z),
+		Enclosure:   podcastEnclosure{URL: url, Length: info.Size(), Type: mediaType},
+		Duration:    fmt.Sprintf("%02d:%02d:%02d", int(duration.Hours()), int(duration.Minutes())%60, int(duration.Seconds())%60),
+	}
+	// Newest episode first
+	feed.Channel.Items = append([]podcastItem{item}, feed.Channel.Items...)
+	if config.FeedMaxEpisodes > 0 && len(feed.Channel.Items) > config.FeedMaxEpisodes {
+		feed.Channel.Items = feed.Channel.Items[:config.FeedMaxEpisodes]
+	}
 
-	// Convert WAV to MP3 using ffmpeg if available
-	mp3Name := strings.TrimSuffix(fileName, ".wav") + ".mp3"
-	if err := convertWAVToMP3(fileName, mp3Name); err != nil {
-		log.Printf("WAV->MP3 conversion skipped/failed: %v", err)
-	} else {
-		log.Printf("MP3 created: %s", mp3Name)
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.FeedPath, append([]byte(xml.Header), data...), 0644)
+}
+
+// readPodcastFeed reads the feed at path, a missing file is an empty feed
+func readPodcastFeed(path string) (podcastFeed, error) {
+	feed := podcastFeed{Version: "2.0", ITunes: "http://www.itunes.com/dtds/podcast-1.0.dtd"}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return feed, nil
+	}
+	if err != nil {
+		return feed, err
+	}
+	// The itunes prefix is resolved to its namespace when decoding, so the
+	// items are read with the element's local name
+	var stored struct {
+		Channel struct {
+			Items []struct {
+				Title       string           `xml:"title"`
+				Description string           `xml:"description"`
+				GUID        string           `xml:"guid"`
+				PubDate     string           `xml:"pubDate"`
+				Enclosure   podcastEnclosure `xml:"enclosure"`
+				Duration    string           `xml:"duration"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(data, &stored); err != nil {
+		return feed, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, item := range stored.Channel.Items {
+		feed.Channel.Items = append(feed.Channel.Items, podcastItem(item))
+	}
+	return feed, nil
+}
+
+// checkOutputFormat validates OUTPUT_FORMAT and that the MP3 encoder is
+// installed when it's required
+func checkOutputFormat(format string) error {
+	switch format {
+	case "", "wav":
+		return nil
+	case "mp3":
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			return fmt.Errorf("OUTPUT_FORMAT=mp3 needs ffmpeg in PATH to encode the show")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid OUTPUT_FORMAT %q, expected wav or mp3", format)
+	}
+}
+
+// Exit codes for Gemini API failures, so callers like cron wrappers can tell
+// a retryable quota error from a configuration problem
+const (
+	exitAPIError   = 1
+	exitQuota      = 3
+	exitAuth       = 4
+	exitBadRequest = 5
+)
+
+// classifyAPIError turns a Gemini API error into an actionable message and
+// exit code. Errors that aren't API errors (e.g. network) use exitAPIError.
+func classifyAPIError(err error) (string, int) {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return err.Error(), exitAPIError
 	}
+
+	reasons := make(map[string]bool)
+	for _, detail := range apiErr.Details {
+		if reason, ok := detail["reason"].(string); ok {
+			reasons[reason] = true
+		}
+	}
+
+	switch {
+	case apiErr.Code == 429 || apiErr.Status == "RESOURCE_EXHAUSTED":
+		return fmt.Sprintf("quota exceeded, retry later or check the limits of your project: %s", apiErr.Message), exitQuota
+	case reasons["SERVICE_DISABLED"]:
+		return fmt.Sprintf("the API is disabled for this project, enable it in the Google Cloud console: %s", apiErr.Message), exitAuth
+	case reasons["API_KEY_INVALID"] || apiErr.Code == 401 || apiErr.Code == 403 ||
+		apiErr.Status == "UNAUTHENTICATED" || apiErr.Status == "PERMISSION_DENIED":
+		return fmt.Sprintf("authentication failed, check GEMINI_API_KEY: %s", apiErr.Message), exitAuth
+	case apiErr.Code == 400 && apiErr.Status == "FAILED_PRECONDITION":
+		return fmt.Sprintf("request rejected, billing may need to be enabled for this project: %s", apiErr.Message), exitBadRequest
+	case apiErr.Code == 400:
+		return fmt.Sprintf("bad request: %s", apiErr.Message), exitBadRequest
+	default:
+		return fmt.Sprintf("status %d %s: %s", apiErr.Code, apiErr.Status, apiErr.Message), exitAPIError
+	}
+}
+
+// Gemini calls are retried on transient errors, quota errors back off
+// longer since rate limits take a while to reset
+const maxAttempts = 4
+
+var (
+	retryBaseDelay = time.Second
+	quotaBaseDelay = 10 * time.Second
+	maxRetryDelay  = 2 * time.Minute
+)
+
+// withRetry runs call until it succeeds, fails permanently or runs out of
+// attempts, returning the last error
+func withRetry(action string, call func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = call(); err == nil {
+			return nil
+		}
+		delay, ok := retryDelay(err, attempt)
+		if !ok || attempt == maxAttempts {
+			return err
+		}
+		message, _ := classifyAPIError(err)
+		log.Printf("Failed to %s (attempt %d/%d), retrying in %s: %s", action, attempt, maxAttempts, delay, message)
+		time.Sleep(delay)
+	}
+	return err
+}
+
+// retryDelay is how long to wait after a failed attempt, it reports false
+// for errors that won't go away on retry like a bad API key
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	base := retryBaseDelay
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == 429 || apiErr.Status == "RESOURCE_EXHAUSTED":
+			base = quotaBaseDelay
+		case apiErr.Code >= 500:
+		default:
+			return 0, false
+		}
+	}
+	return min(base<<(attempt-1), maxRetryDelay), true
+}
+
+func fatalAPIError(action string, err error) {
+	message, code := classifyAPIError(err)
+	log.Printf("Failed to %s: %s", action, message)
+	os.Exit(code)
+}
+
+// weightedEntry is a feed entry annotated with the weight of its feed
+type weightedEntry struct {
+	Entry    *mflux.Entry
+	Weight   int
+	Emphasis string
+}
+
+// weightEntries orders entries by the weight of their feed, highest first,
+// keeping the original order within the same weight. Entries from feeds
+// weighted above or below the default get an emphasis annotation for the prompt.
+func weightEntries(entries mflux.Entries, weights map[string]int) []weightedEntry {
+	weighted := make([]weightedEntry, 0, len(entries))
+	for _, entry := range entries {
+		weight := feedWeight(entry, weights)
+		var emphasis string
+		switch {
+		case weight > 1:
+			emphasis = " (high priority, give it longer treatment)"
+		case weight < 1:
+			emphasis = " (low priority, mention briefly)"
+		}
+		weighted = append(weighted, weightedEntry{Entry: entry, Weight: weight, Emphasis: emphasis})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].Weight > weighted[j].Weight
+	})
+	return weighted
+}
+
+type entryGroup struct {
+	Name    string
+	Entries []weightedEntry
+}
+
+// groupEntries groups entries by "feed" or "category", keeping the order of
+// the entries so groups with higher priority entries come first. Any other
+// value returns a single group.
+func groupEntries(entries []weightedEntry, by string) []entryGroup {
+	var groups []entryGroup
+	index := make(map[string]int)
+	for _, weighted := range entries {
+		var name string
+		switch by {
+		case "feed":
+			name = feedTitle(weighted.Entry)
+		case "category":
+			if category := entryCategory(weighted.Entry); category != nil {
+				name = category.Title
+			}
+		}
+		if name == "" && by != "" {
+			name = "Other"
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(groups)
+			index[name] = i
+			groups = append(groups, entryGroup{Name: name})
+		}
+		groups[i].Entries = append(groups[i].Entries, weighted)
+	}
+	return groups
+}
+
+// feedWeight looks up an entry's weight by feed ID first, then by feed title
+func feedWeight(entry *mflux.Entry, weights map[string]int) int {
+	if weight, ok := weights[strconv.FormatInt(entry.FeedID, 10)]; ok {
+		return weight
+	}
+	if weight, ok := weights[feedTitle(entry)]; ok {
+		return weight
+	}
+	return 1
+}
+
+func feedTitle(entry *mflux.Entry) string {
+	if entry.Feed == nil {
+		return ""
+	}
+	return entry.Feed.Title
 }
 
 // writeWAVFile writes PCM audio data to a WAV file with the specified format
@@ -135,41 +780,39 @@ func main() {
 // channels: number of audio channels (1 for mono, 2 for stereo)
 // bitsPerSample: bits per sample (16 for 16-bit audio)
 func writeWAVFile(filename string, audioData []byte, sampleRate, channels, bitsPerSample int) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	header := wavHeader(len(audioData), sampleRate, channels, bitsPerSample)
+	return os.WriteFile(filename, append(header, audioData...), 0644)
+}
 
+// wavHeader returns the 44 byte RIFF/WAVE header for dataSize bytes of PCM
+// audio in the given format
+func wavHeader(dataSize, sampleRate, channels, bitsPerSample int) []byte {
 	// Calculate derived values
 	bytesPerSample := bitsPerSample / 8
 	blockAlign := channels * bytesPerSample
 	byteRate := sampleRate * blockAlign
-	dataSize := len(audioData)
 	fileSize := 36 + dataSize
 
-	// Write WAV header
+	header := make([]byte, 0, 44)
 	// RIFF header
-	file.WriteString("RIFF")
-	binary.Write(file, binary.LittleEndian, uint32(fileSize))
-	file.WriteString("WAVE")
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(fileSize))
+	header = append(header, "WAVE"...)
 
 	// fmt chunk
-	file.WriteString("fmt ")
-	binary.Write(file, binary.LittleEndian, uint32(16)) // fmt chunk size
-	binary.Write(file, binary.LittleEndian, uint16(1))  // audio format (1 = PCM)
-	binary.Write(file, binary.LittleEndian, uint16(channels))
-	binary.Write(file, binary.LittleEndian, uint32(sampleRate))
-	binary.Write(file, binary.LittleEndian, uint32(byteRate))
-	binary.Write(file, binary.LittleEndian, uint16(blockAlign))
-	binary.Write(file, binary.LittleEndian, uint16(bitsPerSample))
+	header = append(header, "fmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16) // fmt chunk size
+	header = binary.LittleEndian.AppendUint16(header, 1)  // audio format (1 = PCM)
+	header = binary.LittleEndian.AppendUint16(header, uint16(channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(byteRate))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(bitsPerSample))
 
 	// data chunk
-	file.WriteString("data")
-	binary.Write(file, binary.LittleEndian, uint32(dataSize))
-	file.Write(audioData)
-
-	return nil
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(dataSize))
+	return header
 }
 
 // convertWAVToMP3 converts a WAV file to MP3 using ffmpeg if present on PATH.
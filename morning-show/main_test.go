@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+
+	mflux "miniflux.app/v2/client"
+)
+
+func TestWeightEntries(t *testing.T) {
+	entries := mflux.Entries{
+		{Title: "blog post", FeedID: 1, Feed: &mflux.Feed{Title: "Some Blog"}},
+		{Title: "hn top", FeedID: 2, Feed: &mflux.Feed{Title: "Hacker News"}},
+		{Title: "release", FeedID: 3, Feed: &mflux.Feed{Title: "Releases"}},
+		{Title: "hn second", FeedID: 2, Feed: &mflux.Feed{Title: "Hacker News"}},
+		{Title: "noise", FeedID: 4, Feed: &mflux.Feed{Title: "Noisy"}},
+	}
+	weights := map[string]int{
+		"Hacker News": 3,
+		"3":           2,
+		"Noisy":       0,
+	}
+
+	got := weightEntries(entries, weights)
+
+	wantOrder := []string{"hn top", "hn second", "release", "blog post", "noise"}
+	if len(got) != len(wantOrder) {
+		t.Fatalf("expected %d entries, got %d", len(wantOrder), len(got))
+	}
+	for i, title := range wantOrder {
+		if got[i].Entry.Title != title {
+			t.Errorf("position %d: expected %q, got %q", i, title, got[i].Entry.Title)
+		}
+	}
+	if got[0].Emphasis == "" || got[2].Emphasis == "" {
+		t.Errorf("expected weighted feeds to carry an emphasis annotation, got %q and %q", got[0].Emphasis, got[2].Emphasis)
+	}
+	if got[3].Emphasis != "" {
+		t.Errorf("expected no annotation for default weight, got %q", got[3].Emphasis)
+	}
+	if got[4].Emphasis == "" || got[4].Emphasis == got[0].Emphasis {
+		t.Errorf("expected a low priority annotation, got %q", got[4].Emphasis)
+	}
+}
+
+func TestClassifyAPIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		contains string
+		code     int
+	}{
+		{
+			name:   "quota",
+			status: http.StatusTooManyRequests,
+			body: `{"error": {"code": 429, "message": "You exceeded your current quota.", "status": "RESOURCE_EXHAUSTED",
+				"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "21s"}]}}`,
+			contains: "quota exceeded, retry later",
+			code:     exitQuota,
+		},
+		{
+			name:   "service_disabled",
+			status: http.StatusForbidden,
+			body: `{"error": {"code": 403, "message": "Generative Language API has not been used in project 1.", "status": "PERMISSION_DENIED",
+				"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "SERVICE_DISABLED"}]}}`,
+			contains: "enable it",
+			code:     exitAuth,
+		},
+		{
+			name:   "invalid_key",
+			status: http.StatusBadRequest,
+			body: `{"error": {"code": 400, "message": "API key not valid.", "status": "INVALID_ARGUMENT",
+				"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "API_KEY_INVALID"}]}}`,
+			contains: "check GEMINI_API_KEY",
+			code:     exitAuth,
+		},
+		{
+			name:     "bad_request",
+			status:   http.StatusBadRequest,
+			body:     `{"error": {"code": 400, "message": "Invalid value at 'contents'.", "status": "INVALID_ARGUMENT"}}`,
+			contains: "bad request",
+			code:     exitBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
+				APIKey:      "test",
+				Backend:     genai.BackendGeminiAPI,
+				HTTPOptions: genai.HTTPOptions{BaseURL: srv.URL},
+			})
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			_, err = client.Models.GenerateContent(context.Background(), "gemini-2.5-flash-lite", genai.Text("hi"), nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			message, code := classifyAPIError(err)
+			if code != tc.code {
+				t.Errorf("expected exit code %d, got %d (%s)", tc.code, code, message)
+			}
+			if !strings.Contains(message, tc.contains) {
+				t.Errorf("expected message to contain %q, got %q", tc.contains, message)
+			}
+		})
+	}
+}
+
+func TestCheckOutputFormat(t *testing.T) {
+	// No ffmpeg on an empty PATH
+	t.Setenv("PATH", t.TempDir())
+
+	for _, format := range []string{"", "wav"} {
+		if err := checkOutputFormat(format); err != nil {
+			t.Errorf("format %q: unexpected error %v", format, err)
+		}
+	}
+	if err := checkOutputFormat("mp3"); err == nil || !strings.Contains(err.Error(), "ffmpeg") {
+		t.Errorf("expected mp3 without ffmpeg to fail, got %v", err)
+	}
+	if err := checkOutputFormat("ogg"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+func TestWriteWAVFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "show.wav")
+	pcm := make([]byte, 4800)
+	if err := writeWAVFile(path, pcm, 24000, 1, 16); err != nil {
+		t.Fatalf("writeWAVFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 44+len(pcm) {
+		t.Fatalf("expected a 44 byte header, got %d bytes for %d of audio", len(data), len(pcm))
+	}
+
+	le := binary.LittleEndian
+	for _, check := range []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"riff", string(data[0:4]), "RIFF"},
+		{"file size", le.Uint32(data[4:8]), uint32(36 + len(pcm))},
+		{"wave", string(data[8:12]), "WAVE"},
+		{"fmt", string(data[12:16]), "fmt "},
+		{"fmt size", le.Uint32(data[16:20]), uint32(16)},
+		{"audio format", le.Uint16(data[20:22]), uint16(1)},
+		{"channels", le.Uint16(data[22:24]), uint16(1)},
+		{"sample rate", le.Uint32(data[24:28]), uint32(24000)},
+		{"byte rate", le.Uint32(data[28:32]), uint32(48000)},
+		{"block align", le.Uint16(data[32:34]), uint16(2)},
+		{"bits per sample", le.Uint16(data[34:36]), uint16(16)},
+		{"data", string(data[36:40]), "data"},
+		{"data size", le.Uint32(data[40:44]), uint32(len(pcm))},
+	} {
+		if check.got != check.want {
+			t.Errorf("%s: expected %v, got %v", check.name, check.want, check.got)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	text := "First sentence. Second one! Third?\nA fourth line. " + strings.Repeat("word ", 10)
+
+	chunks := splitText(text, 40)
+	if strings.Join(chunks, " ") != strings.Join(strings.Fields(text), " ") {
+		t.Errorf("expected chunks to cover the text, got %q", chunks)
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 40 {
+			t.Errorf("chunk over the limit: %q", chunk)
+		}
+	}
+	if chunks[0] != "First sentence. Second one! Third?" {
+		t.Errorf("expected the first chunk to end on a sentence, got %q", chunks[0])
+	}
+
+	if chunks := splitText("Short.", 40); len(chunks) != 1 || chunks[0] != "Short." {
+		t.Errorf("expected short text in one chunk, got %q", chunks)
+	}
+}
+
+func TestMarkEntriesRead(t *testing.T) {
+	var got struct {
+		EntryIDs []int64 `json:"entry_ids"`
+		Status   string  `json:"status"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/v1/entries" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := mflux.NewClient(server.URL, "token")
+	entries := mflux.Entries{{ID: 1}, {ID: 7}}
+	if err := markEntriesRead(client, entries); err != nil {
+		t.Fatalf("markEntriesRead failed: %v", err)
+	}
+	if got.Status != mflux.EntryStatusRead || len(got.EntryIDs) != 2 || got.EntryIDs[0] != 1 || got.EntryIDs[1] != 7 {
+		t.Errorf("unexpected update %+v", got)
+	}
+}
+
+func TestReadUnreadEntries(t *testing.T) {
+	const total = 250
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		result := mflux.EntryResultSet{Total: total, Entries: mflux.Entries{}}
+		for id := offset; id < min(offset+limit, total); id++ {
+			result.Entries = append(result.Entries, &mflux.Entry{ID: int64(id), FeedID: int64(id % 2)})
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+	client := mflux.NewClient(server.URL, "token")
+
+	entries, err := readUnreadEntries(client, Config{})
+	if err != nil {
+		t.Fatalf("readUnreadEntries failed: %v", err)
+	}
+	if len(entries) != total || entries[total-1].ID != total-1 {
+		t.Errorf("expected all %d entries, got %d", total, len(entries))
+	}
+
+	entries, err = readUnreadEntries(client, Config{MaxEntries: 120})
+	if err != nil {
+		t.Fatalf("readUnreadEntries failed: %v", err)
+	}
+	if len(entries) != 120 {
+		t.Errorf("expected MAX_ENTRIES to cap at 120, got %d", len(entries))
+	}
+
+	// Excluded entries don't count towards MAX_ENTRIES
+	entries, err = readUnreadEntries(client, Config{MaxEntries: 120, ExcludeFeedIDs: []int64{1}})
+	if err != nil {
+		t.Fatalf("readUnreadEntries failed: %v", err)
+	}
+	if len(entries) != 120 || entries[119].ID != 238 {
+		t.Errorf("expected 120 entries of feed 0, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.FeedID == 1 {
+			t.Fatalf("entry %d of excluded feed 1 was read", entry.ID)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	content := `<p>Go 1.25 is <a href="https://go.dev">released</a> &amp; ready.</p><script>track()</script><style>p{}</style><p>Second&nbsp;paragraph</p>`
+	if got, want := plainText(content), "Go 1.25 is released & ready. Second paragraph"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := plainText("line one<br/>line two<script/>still shown"), "line one line two still shown"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTruncateWords(t *testing.T) {
+	for _, tc := range []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"short text", 20, "short text"},
+		{"the quick brown fox", 12, "the quick..."},
+		{"the quick brown fox", 9, "the quick..."},
+		{"unbreakable", 5, "unbre..."},
+	} {
+		if got := truncateWords(tc.text, tc.limit); got != tc.want {
+			t.Errorf("truncateWords(%q, %d): expected %q, got %q", tc.text, tc.limit, tc.want, got)
+		}
+	}
+}
+
+func TestGroupEntries(t *testing.T) {
+	tech := &mflux.Category{Title: "Tech"}
+	news := &mflux.Category{Title: "News"}
+	entries := weightEntries(mflux.Entries{
+		{Title: "hn top", Feed: &mflux.Feed{Title: "Hacker News", Category: tech}},
+		{Title: "headline", Feed: &mflux.Feed{Title: "BBC", Category: news}},
+		{Title: "release", Feed: &mflux.Feed{Title: "Releases", Category: tech}},
+		{Title: "orphan"},
+	}, nil)
+
+	groups := groupEntries(entries, "category")
+	var got []string
+	for _, group := range groups {
+		var titles []string
+		for _, weighted := range group.Entries {
+			titles = append(titles, weighted.Entry.Title)
+		}
+		got = append(got, group.Name+": "+strings.Join(titles, ", "))
+	}
+	want := []string{"Tech: hn top, release", "News: headline", "Other: orphan"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if groups := groupEntries(entries, ""); len(groups) != 1 || len(groups[0].Entries) != 4 {
+		t.Errorf("expected a single group without GROUP_BY, got %+v", groups)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	retryBaseDelay, quotaBaseDelay = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, quotaBaseDelay = time.Second, 10*time.Second })
+
+	tests := []struct {
+		name     string
+		statuses []int
+		calls    int
+		fails    bool
+	}{
+		{"transient", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, 3, false},
+		{"permanent", []int{http.StatusUnauthorized}, 1, true},
+		{"exhausted", []int{500, 500, 500, 500, 500}, maxAttempts, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tc.statuses[calls]
+				calls++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				if status != http.StatusOK {
+					fmt.Fprintf(w, `{"error": {"code": %d, "message": "failed"}}`, status)
+					return
+				}
+				w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "ok"}]}}]}`))
+			}))
+			defer srv.Close()
+
+			client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
+				APIKey:      "test",
+				Backend:     genai.BackendGeminiAPI,
+				HTTPOptions: genai.HTTPOptions{BaseURL: srv.URL},
+			})
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			err = withRetry("summarize", func() error {
+				_, err := client.Models.GenerateContent(context.Background(), "gemini-2.5-flash-lite", genai.Text("hi"), nil)
+				return err
+			})
+			if (err != nil) != tc.fails {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != tc.calls {
+				t.Errorf("expected %d calls, got %d", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	tech := &mflux.Category{ID: 1, Title: "Tech"}
+	news := &mflux.Category{ID: 2, Title: "News"}
+	entries := mflux.Entries{
+		{Title: "hn", FeedID: 10, Feed: &mflux.Feed{Category: tech}},
+		{Title: "release", FeedID: 11, Feed: &mflux.Feed{Category: tech}},
+		{Title: "headline", FeedID: 20, Feed: &mflux.Feed{Category: news}},
+		{Title: "orphan", FeedID: 30},
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"no filters", Config{}, "hn, release, headline, orphan"},
+		{"include feeds", Config{IncludeFeedIDs: []int64{10, 20}}, "hn, headline"},
+		{"exclude feeds", Config{ExcludeFeedIDs: []int64{11}}, "hn, headline, orphan"},
+		{"include category by title", Config{IncludeCategories: []string{"Tech"}}, "hn, release"},
+		{"exclude category by id", Config{ExcludeCategories: []string{"1"}}, "headline, orphan"},
+		{"combined", Config{IncludeCategories: []string{"Tech"}, ExcludeFeedIDs: []int64{10}}, "release"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var titles []string
+			for _, entry := range filterEntries(entries, tc.config) {
+				titles = append(titles, entry.Title)
+			}
+			if got := strings.Join(titles, ", "); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAddEpisode(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		FeedPath:        filepath.Join(dir, "feed.xml"),
+		FeedTitle:       "Morning Show",
+		FeedBaseURL:     "https://example.com/show/",
+		FeedMaxEpisodes: 2,
+	}
+
+	published := time.Date(2025, 3, 1, 7, 0, 0, 0, time.UTC)
+	for day := range 3 {
+		episode := filepath.Join(dir, fmt.Sprintf("morning-show-%d.mp3", day))
+		if err := os.WriteFile(episode, make([]byte, 1000+day), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := addEpisode(config, episode, published.AddDate(0, 0, day), 95*time.Second, "summary"); err != nil {
+			t.Fatalf("addEpisode failed: %v", err)
+		}
+	}
+
+	feed, err := readPodcastFeed(config.FeedPath)
+	if err != nil {
+		t.Fatalf("readPodcastFeed failed: %v", err)
+	}
+	if len(feed.Channel.Items) != 2 {
+		t.Fatalf("expected the newest 2 episodes, got %d", len(feed.Channel.Items))
+	}
+	item := feed.Channel.Items[0]
+	want := podcastItem{
+		Title:       "Morning Show - Monday, March 3, 2025",
+		Description: "summary",
+		GUID:        "https://example.com/show/morning-show-2.mp3",
+		PubDate:     "Mon, 03 Mar 2025 07:00:00 +0000",
+		Enclosure:   podcastEnclosure{URL: "https://example.com/show/morning-show-2.mp3", Length: 1002, Type: "audio/mpeg"},
+		Duration:    "00:01:35",
+	}
+	if item != want {
+		t.Errorf("expected %+v, got %+v", want, item)
+	}
+	if feed.Channel.Items[1].Enclosure.Length != 1001 {
+		t.Errorf("expected the previous episode second, got %+v", feed.Channel.Items[1])
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	// No ffmpeg on an empty PATH
+	t.Setenv("PATH", t.TempDir())
+	valid := Config{MinifluxURL: "http://miniflux", MinifluxToken: "token", GeminiAPIKey: "key"}
+
+	if err := valid.Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+
+	invalid := Config{GroupBy: "day", OutputFormat: "mp3", FeedPath: "feed.xml"}
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	for _, want := range []string{"MINIFLUX_URL", "MINIFLUX_TOKEN", "GEMINI_API_KEY", "GROUP_BY", "ffmpeg", "FEED_BASE_URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%v", want, err)
+		}
+	}
+
+	dryRun := valid
+	dryRun.DryRun = true
+	dryRun.OutputFormat = "mp3"
+	if err := dryRun.Validate(); err != nil {
+		t.Errorf("expected the output format to be ignored in a dry run, got %v", err)
+	}
+}
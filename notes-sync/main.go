@@ -2,18 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gobwas/glob"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -23,56 +39,181 @@ import (
 )
 
 func main() {
+	reconcile := flag.Bool("reconcile", false, "bring storage in line with the files on disk once and exit")
+	serveAddr := flag.String("serve", "", "serve a read-only HTTP API for the stored notes on this address, e.g. :9000")
+	retryFailed := flag.Bool("retry-failed", false, "reprocess the notes recorded in failed_log once and exit")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on /metrics at this address, e.g. :9090")
+	flag.Parse()
+
 	config, err := loadConfig("config.yml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	storage, err := NewStorage(config.StorageType, config.Conn)
+	logger := NewSyncLogger(config.LogFormat, config.StorageType, os.Stderr)
+	backend, err := NewStorage(config.StorageType, config.Conn, config)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer storage.Close()
+	defer backend.Close()
+	storage := &loggingStorage{Storage: backend, logger: logger}
+	failed := NewDeadLetters(config.FailedLog)
+	if *retryFailed {
+		if config.FailedLog == "" {
+			log.Fatal("retry-failed needs failed_log to be configured")
+		}
+		if err := storage.Init(); err != nil {
+			log.Fatal(err)
+		}
+		result, err := failed.Retry(config, NewParser(config), storage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Printf("Retry completed: %d recovered, %d still failing", result.Recovered, result.Failed)
+		return
+	}
+	if *reconcile {
+		if err := storage.Init(); err != nil {
+			log.Fatal(err)
+		}
+		scanner := NewScanner(config, nil, NewParser(config), storage, logger, failed)
+		result, err := scanner.Reconcile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Printf("Reconcile completed: %d inserted, %d updated, %d deleted", result.Inserted, result.Updated, result.Deleted)
+		return
+	}
 	if config.ClearStorage {
 		if err := storage.Clear(); err != nil {
-			log.Printf("Warning: Failed to clear storage: %v", err)
+			logger.Printf("Warning: Failed to clear storage: %v", err)
 		}
 	}
 	// Init may create indices, depending on the storage type
 	if err := storage.Init(); err != nil {
 		log.Fatal(err)
 	}
+	// Stop on SIGINT/SIGTERM from here on, also during the initial scan, so
+	// the deferred Close always disconnects storage
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	status := &SyncStatus{Backend: config.StorageType}
+	var servers []*http.Server
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(shutdownCtx)
+		}
+	}()
+	if config.HealthAddr != "" {
+		healthServer := &http.Server{Addr: config.HealthAddr, Handler: NewHealthHandler(storage, status)}
+		servers = append(servers, healthServer)
+		go func() {
+			logger.Printf("Health endpoint listening on %s", config.HealthAddr)
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Printf("Health endpoint stopped: %v", err)
+			}
+		}()
+	}
+	if *serveAddr != "" {
+		apiServer := &http.Server{Addr: *serveAddr, Handler: NewAPIHandler(storage)}
+		servers = append(servers, apiServer)
+		go func() {
+			logger.Printf("Notes API listening on %s", *serveAddr)
+			if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Printf("Notes API stopped: %v", err)
+			}
+		}()
+	}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", promhttp.Handler())
+		metricsServer := &http.Server{Addr: *metricsAddr, Handler: mux}
+		servers = append(servers, metricsServer)
+		go func() {
+			logger.Printf("Metrics listening on %s", *metricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Printf("Metrics stopped: %v", err)
+			}
+		}()
+	}
 	parser := NewParser(config)
-	watcher := NewWatcher(config, parser, storage)
-	scanner := NewScanner(config, watcher, parser, storage)
-	err = scanner.Scan()
+	watcher := NewWatcher(config, parser, storage, logger, failed)
+	scanner := NewScanner(config, watcher, parser, storage, logger, failed)
+	err = scanner.Scan(ctx)
+	if ctx.Err() != nil {
+		logger.Printf("Shutting down during the initial scan")
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Scan completed")
+	status.ScanCompleted(scanner.scanned)
+	logger.Printf("Scan completed")
 	if err := storage.Watch(); err != nil {
 		log.Fatal(err)
 	}
+	// Stop watching on shutdown, Watch then returns
+	go func() {
+		<-ctx.Done()
+		logger.Printf("Shutting down")
+		if err := watcher.Close(); err != nil {
+			logger.Printf("Error closing watcher: %v", err)
+		}
+	}()
+	status.SetWatcherActive(true)
 	watcher.Watch()
+	status.SetWatcherActive(false)
 }
 
 type Config struct {
-	Path            string   `yaml:"path"`
+	Path string `yaml:"path"`
+	// Paths lists further roots to sync, e.g. several vaults. With more
+	// than one root, relative paths start with the root's directory name.
+	Paths           []string `yaml:"paths"`
 	StorageType     string   `yaml:"storage_type"`
 	Conn            string   `yaml:"connection_uri"`
 	ClearStorage    bool     `yaml:"clear_storage"`
 	ExcludePatterns []string `yaml:"exclude_patterns"`
+	// DebounceInterval coalesces bursts of events for the same file,
+	// e.g. the several writes an editor emits for a single save.
+	DebounceInterval time.Duration `yaml:"debounce_interval"`
+	// FrontMatterFormat is how frontmatter between --- fences is parsed,
+	// "yaml" (default) or "toml". +++ fences are always TOML.
+	FrontMatterFormat string `yaml:"frontmatter_format"`
+	// HealthAddr enables the /healthz and /status endpoints when set
+	HealthAddr string `yaml:"health_addr"`
+	// PreserveFrontMatter keeps the original frontmatter text so notes
+	// synced back to disk aren't reformatted
+	PreserveFrontMatter bool `yaml:"preserve_frontmatter"`
+	// StableIDs keys notes by an id in their frontmatter instead of their
+	// path, so renames keep the stored note. Notes without one get a
+	// generated id written into their frontmatter.
+	StableIDs bool `yaml:"stable_ids"`
+	// Extensions are the file extensions synced as notes, [".md"] by default
+	Extensions []string `yaml:"extensions"`
+	// LogFormat is "text" (default) or "json" for one JSON line per entry
+	LogFormat string `yaml:"log_format"`
+	// FailedLog is a file recording the notes that failed to parse or
+	// store, retried with -retry-failed. Disabled when empty.
+	FailedLog string `yaml:"failed_log"`
 }
 
 func loadConfig(configPath string) (*Config, error) {
 	config := &Config{
-		Path:            ".",
-		StorageType:     "memory",
-		Conn:            "",
-		ExcludePatterns: []string{},
+		Path:              "",
+		StorageType:       "memory",
+		Conn:              "",
+		ExcludePatterns:   []string{},
+		Extensions:        []string{".md"},
+		DebounceInterval:  300 * time.Millisecond,
+		FrontMatterFormat: "yaml",
+		LogFormat:         "text",
 	}
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			config.Path = "."
 			return config, nil
 		}
 		return nil, fmt.Errorf("error reading config file: %w", err)
@@ -80,39 +221,130 @@ func loadConfig(configPath string) (*Config, error) {
 	if err := yaml.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("error parsing config file: %w", err)
 	}
+	if config.Path == "" && len(config.Paths) == 0 {
+		config.Path = "."
+	}
+	names := make(map[string]bool)
+	for _, root := range config.roots() {
+		name := filepath.Base(root)
+		if names[name] {
+			return nil, fmt.Errorf("paths must have distinct directory names, %s is used twice", name)
+		}
+		names[name] = true
+	}
+	if config.FrontMatterFormat != "yaml" && config.FrontMatterFormat != "toml" {
+		return nil, fmt.Errorf("invalid frontmatter_format: %s", config.FrontMatterFormat)
+	}
+	for i, ext := range config.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			config.Extensions[i] = "." + ext
+		}
+	}
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid log_format: %s", config.LogFormat)
+	}
 	return config, nil
 }
 
+// isNote reports whether path has one of the note extensions, no extensions
+// means the default .md
+func isNote(path string, extensions []string) bool {
+	ext := filepath.Ext(path)
+	if len(extensions) == 0 {
+		return ext == ".md"
+	}
+	return slices.Contains(extensions, ext)
+}
+
+// roots returns every directory to sync, path first
+func (c *Config) roots() []string {
+	var roots []string
+	if c.Path != "" {
+		roots = append(roots, c.Path)
+	}
+	for _, root := range c.Paths {
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// relPath returns the storage key for a file: its path relative to the root
+// it is in, prefixed with the root's directory name when there are several
+func (c *Config) relPath(path string) string {
+	roots := c.roots()
+	best := ""
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// Nested roots, the innermost one wins
+		if best == "" || len(root) > len(best) {
+			best = root
+		}
+	}
+	if best == "" && len(roots) > 0 {
+		best = roots[0]
+	}
+	rel, _ := filepath.Rel(best, path)
+	if len(roots) > 1 {
+		rel = filepath.Join(filepath.Base(best), rel)
+	}
+	return rel
+}
+
+// absPath is the inverse of relPath
+func (c *Config) absPath(relPath string) string {
+	roots := c.roots()
+	if len(roots) == 1 {
+		return filepath.Join(roots[0], relPath)
+	}
+	name, rest, _ := strings.Cut(relPath, string(filepath.Separator))
+	for _, root := range roots {
+		if filepath.Base(root) == name {
+			return filepath.Join(root, rest)
+		}
+	}
+	return filepath.Join(roots[0], relPath)
+}
+
 type Scanner interface {
-	Scan()
+	Scan(ctx context.Context) error
 }
 
-func NewScanner(config *Config, watcher Watcher, parser Parser, storage Storage) *DefaultScanner {
+func NewScanner(config *Config, watcher Watcher, parser Parser, storage Storage, logger SyncLogger, failed *DeadLetters) *DefaultScanner {
 	patterns := make([]glob.Glob, 0, len(config.ExcludePatterns))
 	for _, pattern := range config.ExcludePatterns {
 		g, err := glob.Compile(pattern)
 		if err != nil {
-			log.Printf("Invalid glob pattern %s: %v", pattern, err)
+			logger.Printf("Invalid glob pattern %s: %v", pattern, err)
 			continue
 		}
 		patterns = append(patterns, g)
 	}
 
 	return &DefaultScanner{
-		path:    config.Path,
+		config:  config,
 		watcher: watcher,
 		parser:  parser,
 		storage: storage,
+		logger:  logger,
+		failed:  failed,
 		exclude: patterns,
 	}
 }
 
 type DefaultScanner struct {
-	path    string
+	config  *Config
 	watcher Watcher
 	parser  Parser
 	storage Storage
+	logger  SyncLogger
+	failed  *DeadLetters
 	exclude []glob.Glob
+	scanned int
 }
 
 func (s *DefaultScanner) isExcluded(path string) bool {
@@ -124,8 +356,18 @@ func (s *DefaultScanner) isExcluded(path string) bool {
 	return false
 }
 
-func (s *DefaultScanner) Scan() error {
-	err := filepath.Walk(s.path, func(walkPath string, info os.FileInfo, err error) error {
+// walk visits every directory and markdown file under the root that isn't excluded
+func (s *DefaultScanner) walk(visitDir func(path string) error, visitFile func(path string, info os.FileInfo)) error {
+	for _, root := range s.config.roots() {
+		if err := s.walkRoot(root, visitDir, visitFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DefaultScanner) walkRoot(root string, visitDir func(path string) error, visitFile func(path string, info os.FileInfo)) error {
+	return filepath.Walk(root, func(walkPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -138,44 +380,145 @@ func (s *DefaultScanner) Scan() error {
 		}
 
 		if info.IsDir() {
-			if err = s.watcher.Add(walkPath); err != nil {
-				return err
+			if visitDir != nil {
+				return visitDir(walkPath)
 			}
 			return nil
 		}
 
-		if filepath.Ext(walkPath) == ".md" {
-			data, err := s.parser.Parse(walkPath)
-			if err != nil {
-				log.Printf("Error parsing markdown file %s: %v", walkPath, err)
-				return nil
-			}
-			s.storage.Save(data)
+		if isNote(walkPath, s.config.Extensions) {
+			visitFile(walkPath, info)
 		}
 		return nil
 	})
+}
+
+// Scan stores every note and watches every directory, stopping with ctx's
+// error once ctx is cancelled
+func (s *DefaultScanner) Scan(ctx context.Context) error {
+	addDir := func(path string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.watcher.Add(path)
+	}
+	return s.walk(addDir, func(path string, info os.FileInfo) {
+		if ctx.Err() != nil {
+			return
+		}
+		filesScanned.Inc()
+		data, err := s.parser.Parse(path)
+		if err != nil {
+			parseErrors.Inc()
+			s.logger.Printf("Error parsing markdown file %s: %v", path, err)
+			s.failed.Record(path, err)
+			return
+		}
+		s.scanned++
+		if unchanged(s.storage, data) {
+			return
+		}
+		if err := s.storage.Save(data); err != nil {
+			s.failed.Record(path, err)
+		}
+	})
+}
+
+type ReconcileResult struct {
+	Inserted int
+	Updated  int
+	Deleted  int
+}
+
+// Reconcile compares the files on disk with what storage holds, inserting
+// missing notes, updating the ones modified since they were stored and
+// deleting the ones that no longer exist.
+func (s *DefaultScanner) Reconcile() (ReconcileResult, error) {
+	var result ReconcileResult
+	stored, err := s.storage.List()
 	if err != nil {
-		return err
+		return result, fmt.Errorf("failed to list storage: %w", err)
 	}
-	return nil
+
+	onDisk := make(map[string]bool)
+	err = s.walk(nil, func(path string, info os.FileInfo) {
+		filesScanned.Inc()
+		relPath := s.config.relPath(path)
+		onDisk[relPath] = true
+		updated, ok := stored[relPath]
+		if ok && !info.ModTime().After(updated) {
+			return
+		}
+		data, err := s.parser.Parse(path)
+		if err != nil {
+			parseErrors.Inc()
+			s.logger.Printf("Error parsing markdown file %s: %v", path, err)
+			s.failed.Record(path, err)
+			return
+		}
+		// Failed operations are reported by the storage's logger
+		if !ok {
+			if err := s.storage.Save(data); err != nil {
+				s.failed.Record(path, err)
+				return
+			}
+			result.Inserted++
+			return
+		}
+		if err := s.storage.Update(data); err != nil {
+			s.failed.Record(path, err)
+			return
+		}
+		result.Updated++
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for relPath := range stored {
+		if onDisk[relPath] {
+			continue
+		}
+		if err := s.storage.Delete(relPath); err != nil {
+			continue
+		}
+		result.Deleted++
+	}
+	return result, nil
 }
 
 type Storage interface {
 	Save(data File) error
 	Update(data File) error
 	Delete(path string) error
+	// FindByTag returns the stored notes whose frontmatter tags include tag
+	FindByTag(tag string) ([]File, error)
+	// List returns the relative paths of all stored notes along with the
+	// time each was last written
+	List() (map[string]time.Time, error)
+	// GetHash returns the contentHash of the stored note at path, or
+	// ErrNotFound
+	GetHash(path string) (string, error)
+	// Get returns the stored note with slug, or ErrNotFound. Slugs aren't
+	// unique across directories, the note with the first path wins.
+	Get(slug string) (File, error)
+	// ListFiles returns all stored notes ordered by path
+	ListFiles() ([]File, error)
 	Close() error
 	Clear() error
 	Init() error
 	Watch() error
+	Ping() error
 }
 
-func NewStorage(storageType string, conn string) (Storage, error) {
+// NewStorage creates the backend for storageType, config has the notes
+// directories backends that sync changes back to disk write into
+func NewStorage(storageType string, conn string, config *Config) (Storage, error) {
 	switch storageType {
 	case "memory":
 		return NewMemoryStorage()
 	case "mongodb":
-		return NewMongoDBStorage(conn)
+		return NewMongoDBStorage(conn, config)
 	case "sqlite":
 		return NewSQLiteStorage(conn)
 	default:
@@ -186,42 +529,130 @@ func NewStorage(storageType string, conn string) (Storage, error) {
 var ErrNotFound = errors.New("not found")
 
 type MemoryStorage struct {
-	data map[string]File
+	// mu guards the maps, the notes API reads while the watcher writes
+	mu      sync.RWMutex
+	data    map[string]File
+	updated map[string]time.Time
 }
 
 func NewMemoryStorage() (*MemoryStorage, error) {
 	return &MemoryStorage{
-		data: make(map[string]File),
+		data:    make(map[string]File),
+		updated: make(map[string]time.Time),
 	}, nil
 }
 
 func (s *MemoryStorage) Save(data File) error {
-	s.data[data.AbsPath] = data
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The path may be stored under another key, e.g. before it got an id
+	if key, ok := s.keyForPath(data.RelPath); ok && key != data.key() {
+		delete(s.data, key)
+		delete(s.updated, key)
+	}
+	s.data[data.key()] = data
+	s.updated[data.key()] = time.Now()
 	return nil
 }
 
 func (s *MemoryStorage) Update(data File) error {
-	if _, ok := s.data[data.AbsPath]; !ok {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[data.key()]; !ok {
 		return ErrNotFound
 	}
-	s.data[data.AbsPath] = data
+	s.data[data.key()] = data
+	s.updated[data.key()] = time.Now()
 	return nil
 }
 
 func (s *MemoryStorage) Delete(path string) error {
-	if _, ok := s.data[path]; !ok {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keyForPath(path)
+	if !ok {
 		return ErrNotFound
 	}
-	delete(s.data, path)
+	delete(s.data, key)
+	delete(s.updated, key)
 	return nil
 }
 
+// keyForPath finds the key of the note stored for path
+func (s *MemoryStorage) keyForPath(path string) (string, bool) {
+	for key, data := range s.data {
+		if data.RelPath == path {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (s *MemoryStorage) FindByTag(tag string) ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var files []File
+	for _, data := range s.data {
+		if slices.Contains(frontMatterTags(data.FrontMatter), tag) {
+			files = append(files, data)
+		}
+	}
+	return files, nil
+}
+
+func (s *MemoryStorage) List() (map[string]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make(map[string]time.Time, len(s.updated))
+	for key, updated := range s.updated {
+		list[s.data[key].RelPath] = updated
+	}
+	return list, nil
+}
+
+func (s *MemoryStorage) GetHash(path string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keyForPath(path)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return contentHash(s.data[key]), nil
+}
+
+func (s *MemoryStorage) Get(slug string) (File, error) {
+	files, err := s.ListFiles()
+	if err != nil {
+		return File{}, err
+	}
+	for _, data := range files {
+		if data.Slug == slug {
+			return data, nil
+		}
+	}
+	return File{}, ErrNotFound
+}
+
+func (s *MemoryStorage) ListFiles() ([]File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make([]File, 0, len(s.data))
+	for _, data := range s.data {
+		files = append(files, data)
+	}
+	slices.SortFunc(files, func(a, b File) int { return strings.Compare(a.RelPath, b.RelPath) })
+	return files, nil
+}
+
 func (s *MemoryStorage) Close() error {
 	return nil
 }
 
 func (s *MemoryStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.data = make(map[string]File)
+	s.updated = make(map[string]time.Time)
 	return nil
 }
 
@@ -233,13 +664,20 @@ func (s *MemoryStorage) Watch() error {
 	return nil
 }
 
+func (s *MemoryStorage) Ping() error {
+	return nil
+}
+
 type MongoDBStorage struct {
 	client     *mongo.Client
 	collection *mongo.Collection
 	ctx        context.Context
+	cancel     context.CancelFunc
+	// config has the notes directories the change stream writes files into
+	config *Config
 }
 
-func NewMongoDBStorage(conn string) (*MongoDBStorage, error) {
+func NewMongoDBStorage(conn string, config *Config) (*MongoDBStorage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(conn))
@@ -248,38 +686,96 @@ func NewMongoDBStorage(conn string) (*MongoDBStorage, error) {
 	}
 	collection := client.Database("notes").Collection("files")
 
+	// Canceled by Close to stop the change stream
+	storageCtx, storageCancel := context.WithCancel(context.Background())
+
 	return &MongoDBStorage{
 		client:     client,
 		collection: collection,
-		ctx:        context.Background(),
+		ctx:        storageCtx,
+		cancel:     storageCancel,
+		config:     config,
 	}, nil
 }
 
+// pathFilter matches the live document for path, documents keyed by id
+// store their path separately
+func pathFilter(path string) bson.M {
+	return bson.M{
+		"$or":     bson.A{bson.M{"_id": path}, bson.M{"path": path}},
+		"deleted": bson.M{"$exists": false},
+	}
+}
+
 func (s *MongoDBStorage) Save(data File) error {
+	opts := options.Replace().SetUpsert(true)
+	filter := bson.M{"_id": data.key()}
+
+	if _, err := s.collection.ReplaceOne(s.ctx, filter, mongoDocument(data), opts); err != nil {
+		return err
+	}
+
+	// The path may be stored under another key, e.g. before it got an id.
+	// That document goes only once the new one is in place, so the change
+	// stream sees the note is still stored and keeps the file.
+	if data.ID != "" && data.ID != data.RelPath {
+		filter := bson.M{"_id": data.RelPath}
+		if _, err := s.collection.DeleteOne(s.ctx, filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mongoDocument is the document stored for data. The frontmatter format and
+// raw frontmatter use the field names File decodes from, so the change
+// stream writes notes back the way they were read.
+func mongoDocument(data File) bson.M {
 	doc := bson.M{
-		"_id":         data.RelPath,
+		"_id":         data.key(),
+		"path":        data.RelPath,
 		"slug":        data.Slug,
 		"content":     data.Content,
 		"frontmatter": data.FrontMatter,
+		"tags":        frontMatterTags(data.FrontMatter),
+		"hash":        contentHash(data),
 		"updated":     time.Now(),
 	}
-
-	opts := options.Replace().SetUpsert(true)
-	filter := bson.M{"_id": data.RelPath}
-
-	_, err := s.collection.ReplaceOne(s.ctx, filter, doc, opts)
-	return err
+	if data.FrontMatterFormat != "" {
+		doc["frontmatterformat"] = data.FrontMatterFormat
+	}
+	if data.RawFrontMatter != "" {
+		doc["rawfrontmatter"] = data.RawFrontMatter
+	}
+	return doc
 }
 
 func (s *MongoDBStorage) Update(data File) error {
-	filter := bson.M{"_id": data.RelPath}
+	filter := bson.M{"_id": data.key()}
 	update := bson.M{
 		"$set": bson.M{
+			"path":        data.RelPath,
 			"content":     data.Content,
 			"frontmatter": data.FrontMatter,
+			"tags":        frontMatterTags(data.FrontMatter),
+			"hash":        contentHash(data),
 			"updated":     time.Now(),
 		},
 	}
+	// A note recreated at the path of a deleted one is live again
+	unset := bson.M{"deleted": ""}
+	// Optional fields are stored with the names File decodes from
+	for field, value := range map[string]string{
+		"frontmatterformat": data.FrontMatterFormat,
+		"rawfrontmatter":    data.RawFrontMatter,
+	} {
+		if value != "" {
+			update["$set"].(bson.M)[field] = value
+		} else {
+			unset[field] = ""
+		}
+	}
+	update["$unset"] = unset
 
 	result, err := s.collection.UpdateOne(s.ctx, filter, update)
 	if err != nil {
@@ -294,7 +790,7 @@ func (s *MongoDBStorage) Update(data File) error {
 }
 
 func (s *MongoDBStorage) Delete(path string) error {
-	filter := bson.M{"abs_path": path}
+	filter := pathFilter(path)
 	update := bson.M{
 		"$set": bson.M{
 			"deleted": time.Now(),
@@ -313,7 +809,110 @@ func (s *MongoDBStorage) Delete(path string) error {
 	return nil
 }
 
+func (s *MongoDBStorage) FindByTag(tag string) ([]File, error) {
+	return s.findFiles(bson.M{"tags": tag, "deleted": bson.M{"$exists": false}})
+}
+
+func (s *MongoDBStorage) Get(slug string) (File, error) {
+	filter := bson.M{"slug": slug, "deleted": bson.M{"$exists": false}}
+	files, err := s.findFiles(filter, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(1))
+	if err != nil {
+		return File{}, err
+	}
+	if len(files) == 0 {
+		return File{}, ErrNotFound
+	}
+	return files[0], nil
+}
+
+func (s *MongoDBStorage) ListFiles() ([]File, error) {
+	filter := bson.M{"deleted": bson.M{"$exists": false}}
+	return s.findFiles(filter, options.Find().SetSort(bson.M{"_id": 1}))
+}
+
+// findFiles returns the notes matching filter
+func (s *MongoDBStorage) findFiles(filter bson.M, opts ...*options.FindOptions) ([]File, error) {
+	cursor, err := s.collection.Find(s.ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(s.ctx)
+
+	var files []File
+	for cursor.Next(s.ctx) {
+		var doc struct {
+			ID          string                 `bson:"_id"`
+			Path        string                 `bson:"path"`
+			Slug        string                 `bson:"slug"`
+			Content     string                 `bson:"content"`
+			FrontMatter map[string]interface{} `bson:"frontmatter"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		// Documents written before paths were stored are keyed by path
+		var id string
+		if doc.Path == "" {
+			doc.Path = doc.ID
+		} else if doc.ID != doc.Path {
+			id = doc.ID
+		}
+		files = append(files, File{
+			ID:          id,
+			RelPath:     doc.Path,
+			Slug:        doc.Slug,
+			Content:     doc.Content,
+			FrontMatter: doc.FrontMatter,
+		})
+	}
+	return files, cursor.Err()
+}
+
+func (s *MongoDBStorage) List() (map[string]time.Time, error) {
+	filter := bson.M{"deleted": bson.M{"$exists": false}}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "path": 1, "updated": 1})
+	cursor, err := s.collection.Find(s.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(s.ctx)
+
+	list := make(map[string]time.Time)
+	for cursor.Next(s.ctx) {
+		var doc struct {
+			ID      string    `bson:"_id"`
+			Path    string    `bson:"path"`
+			Updated time.Time `bson:"updated"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if doc.Path == "" {
+			doc.Path = doc.ID
+		}
+		list[doc.Path] = doc.Updated
+	}
+	return list, cursor.Err()
+}
+
+func (s *MongoDBStorage) GetHash(path string) (string, error) {
+	filter := pathFilter(path)
+	opts := options.FindOne().SetProjection(bson.M{"hash": 1})
+	var doc struct {
+		Hash string `bson:"hash"`
+	}
+	err := s.collection.FindOne(s.ctx, filter, opts).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.Hash, nil
+}
+
 func (s *MongoDBStorage) Close() error {
+	s.cancel()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	return s.client.Disconnect(ctx)
@@ -324,62 +923,187 @@ func (s *MongoDBStorage) Clear() error {
 }
 
 func (s *MongoDBStorage) Init() error {
+	// Documents are keyed by their relative path in _id, tags is a multikey
+	// index over the array of frontmatter tags
 	_, err := s.collection.Indexes().CreateOne(s.ctx, mongo.IndexModel{
-		Keys:    bson.D{{Key: "abs_path", Value: 1}},
-		Options: options.Index().SetUnique(true),
+		Keys: bson.D{{Key: "tags", Value: 1}},
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create index: %w", err)
 	}
+
+	// Pre-images let the change stream report the path of deleted documents,
+	// this needs MongoDB 6.0+ so older servers only lose delete propagation
+	err = s.collection.Database().RunCommand(s.ctx, bson.D{
+		{Key: "collMod", Value: s.collection.Name()},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		log.Printf("Could not enable change stream pre-images, deletes won't sync to disk: %v", err)
+	}
 	return nil
 }
 
 func (s *MongoDBStorage) Watch() error {
-	pipeline := mongo.Pipeline{}
-	stream, err := s.collection.Watch(s.ctx, pipeline)
+	stream, err := s.openChangeStream(nil)
 	if err != nil {
 		return fmt.Errorf("failed to create change stream: %w", err)
 	}
 
 	go func() {
-		defer stream.Close(s.ctx)
-
-		for stream.Next(s.ctx) {
-			var changeDoc struct {
-				OperationType string `bson:"operationType"`
-				FullDocument  File   `bson:"fullDocument"`
-				DocumentKey   struct {
-					ID interface{} `bson:"_id"`
-				} `bson:"documentKey"`
-			}
-
-			if err := stream.Decode(&changeDoc); err != nil {
-				log.Printf("Error decoding change stream document: %v", err)
-				continue
+		backoff := watchMinBackoff
+		for {
+			s.readChangeStream(stream)
+			resumeToken := stream.ResumeToken()
+			err := stream.Err()
+			stream.Close(context.Background())
+			if s.ctx.Err() != nil {
+				// Storage was closed
+				return
 			}
 
-			switch changeDoc.OperationType {
-			case "insert", "update", "replace":
-				err := writeFileToDisk(changeDoc.FullDocument)
-				if err != nil {
-					log.Printf("Error writing file to disk: %v", err)
+			// The stream ends on errors like a replica set failover, resume
+			// where it left off once a new primary is reachable
+			log.Printf("Change stream closed: %v, reconnecting in %s", err, backoff)
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				stream, err = s.openChangeStream(resumeToken)
+				if err == nil {
+					break
 				}
-			case "delete":
-				// Get path from document key and delete file
-				// This requires storing the path in the _id or retrieving it before deletion
-				// For simplicity, we'll need to query for the path using the document key
-				// This is a limitation of this approach
-				log.Printf("Delete operation detected but path information is not available in change stream")
+				backoff = nextBackoff(backoff)
+				log.Printf("Failed to reopen change stream: %v, retrying in %s", err, backoff)
 			}
+			log.Printf("Change stream reconnected")
+			backoff = watchMinBackoff
 		}
+	}()
+	return nil
+}
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// nextBackoff doubles d up to watchMaxBackoff
+func nextBackoff(d time.Duration) time.Duration {
+	return min(d*2, watchMaxBackoff)
+}
+
+// openChangeStream watches the collection, resuming after resumeToken if set
+func (s *MongoDBStorage) openChangeStream(resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{}
+	opts := options.ChangeStream().SetFullDocumentBeforeChange(options.WhenAvailable)
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return s.collection.Watch(s.ctx, pipeline, opts)
+}
 
-		if err := stream.Err(); err != nil {
-			log.Printf("Error in change stream: %v", err)
+// readChangeStream syncs changes to disk until the stream ends or errors
+func (s *MongoDBStorage) readChangeStream(stream *mongo.ChangeStream) {
+	for stream.Next(s.ctx) {
+		var change changeEvent
+		if err := stream.Decode(&change); err != nil {
+			log.Printf("Error decoding change stream document: %v", err)
+			continue
 		}
-	}()
+		if err := syncChange(s.config, change, s.live); err != nil {
+			log.Printf("Error syncing change to disk: %v", err)
+		}
+	}
+}
+
+// live reports whether a note that isn't deleted is stored for relPath
+func (s *MongoDBStorage) live(relPath string) bool {
+	_, err := s.GetHash(relPath)
+	return err == nil
+}
+
+// changeEvent is a change stream document
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	FullDocument  struct {
+		File    `bson:",inline"`
+		Hash    string     `bson:"hash"`
+		Deleted *time.Time `bson:"deleted"`
+	} `bson:"fullDocument"`
+	FullDocumentBeforeChange struct {
+		ID   string `bson:"_id"`
+		Path string `bson:"path"`
+	} `bson:"fullDocumentBeforeChange"`
+	DocumentKey struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// syncChange applies a change to the notes on disk. live reports whether a
+// note is stored for a path, so a delete doesn't remove a file that is
+// stored again.
+func syncChange(config *Config, change changeEvent, live func(relPath string) bool) error {
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		// Documents are keyed by id or relative path, older ones
+		// don't store the path separately
+		file := change.FullDocument.File
+		if relPath, ok := change.DocumentKey.ID.(string); ok && file.RelPath == "" {
+			file.RelPath = relPath
+		}
+		file.AbsPath = config.absPath(file.RelPath)
+		// Deletes only mark the document, see MongoDBStorage.Delete
+		if change.FullDocument.Deleted != nil {
+			if live(file.RelPath) {
+				return nil
+			}
+			return removeFileFromDisk(file.AbsPath)
+		}
+		// Changes this process stored from disk come back through the
+		// stream, leave the file alone when it already has that content
+		if unchangedOnDisk(config, file.AbsPath, change.FullDocument.Hash) {
+			return nil
+		}
+		return writeFileToDisk(file)
+	case "delete":
+		// The pre-image is only there when the collection has
+		// changeStreamPreAndPostImages enabled, see Init
+		relPath := change.FullDocumentBeforeChange.Path
+		if relPath == "" {
+			relPath = change.FullDocumentBeforeChange.ID
+		}
+		if relPath == "" {
+			return errors.New("delete operation detected but pre-image is not available in change stream")
+		}
+		// Save removes the document a note was stored under before it got
+		// an id, the note itself lives on
+		if live(relPath) {
+			return nil
+		}
+		return removeFileFromDisk(config.absPath(relPath))
+	}
 	return nil
 }
 
+// unchangedOnDisk reports whether the note at path hashes to hash
+func unchangedOnDisk(config *Config, path string, hash string) bool {
+	if hash == "" {
+		return false
+	}
+	// parse rather than Parse, which may write an id into the file
+	data, err := (&DefaultParser{Config: config}).parse(path)
+	return err == nil && contentHash(data) == hash
+}
+
+func (s *MongoDBStorage) Ping() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+	return s.client.Ping(ctx, nil)
+}
+
 type SQLiteStorage struct {
 	db *sql.DB
 }
@@ -393,7 +1117,15 @@ func NewSQLiteStorage(conn string) (*SQLiteStorage, error) {
 		}
 	}
 
-	db, err := sql.Open("sqlite3", conn)
+	// WAL lets readers run alongside the watcher's writes, the busy timeout
+	// waits out the remaining lock contention instead of failing with
+	// "database is locked"
+	dsn := conn + "?_journal_mode=WAL&_busy_timeout=5000"
+	if strings.Contains(conn, "?") {
+		dsn = conn + "&_journal_mode=WAL&_busy_timeout=5000"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
 	}
@@ -414,17 +1146,37 @@ func (s *SQLiteStorage) Save(data File) error {
 		return fmt.Errorf("failed to serialize frontmatter: %w", err)
 	}
 
-	_, err = s.db.Exec(`
-		INSERT INTO files (path, slug, content, frontmatter, updated)
-		VALUES (?, ?, ?, ?, ?)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := moveByID(tx, data); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO files (path, id, slug, content, frontmatter, hash, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(path) DO UPDATE SET
+		id = excluded.id,
 		slug = excluded.slug,
 		content = excluded.content,
 		frontmatter = excluded.frontmatter,
-		updated = excluded.updated
-	`, data.RelPath, data.Slug, data.Content, string(frontmatterJSON), time.Now())
+		hash = excluded.hash,
+		updated = excluded.updated,
+		deleted = NULL
+	`, data.RelPath, nullString(data.ID), data.Slug, data.Content, string(frontmatterJSON), contentHash(data), time.Now())
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := replaceTags(tx, data.RelPath, frontMatterTags(data.FrontMatter)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (s *SQLiteStorage) Update(data File) error {
@@ -434,11 +1186,21 @@ func (s *SQLiteStorage) Update(data File) error {
 		return fmt.Errorf("failed to serialize frontmatter: %w", err)
 	}
 
-	result, err := s.db.Exec(`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := moveByID(tx, data); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
 		UPDATE files
-		SET path = ?, slug = ?, content = ?, frontmatter = ?, updated = ?
+		SET path = ?, id = ?, slug = ?, content = ?, frontmatter = ?, hash = ?, updated = ?, deleted = NULL
 		WHERE path = ?
-	`, data.RelPath, data.Slug, data.Content, string(frontmatterJSON), time.Now(), data.RelPath)
+	`, data.RelPath, nullString(data.ID), data.Slug, data.Content, string(frontmatterJSON), contentHash(data), time.Now(), data.RelPath)
 	if err != nil {
 		return err
 	}
@@ -452,11 +1214,72 @@ func (s *SQLiteStorage) Update(data File) error {
 		return ErrNotFound
 	}
 
-	return nil
-}
+	if err := replaceTags(tx, data.RelPath, frontMatterTags(data.FrontMatter)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// moveByID moves the row of a note with an id to the note's current path,
+// so a renamed note keeps its row. Whatever was stored at the new path is
+// replaced.
+func moveByID(tx *sql.Tx, data File) error {
+	if data.ID == "" {
+		return nil
+	}
+	var oldPath string
+	err := tx.QueryRow("SELECT path FROM files WHERE id = ? AND path != ?", data.ID, data.RelPath).Scan(&oldPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM tags WHERE path = ?",
+		"DELETE FROM files WHERE path = ?",
+	} {
+		if _, err := tx.Exec(query, data.RelPath); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", data.RelPath, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE tags SET path = ? WHERE path = ?", data.RelPath, oldPath); err != nil {
+		return fmt.Errorf("failed to move tags: %w", err)
+	}
+	if _, err := tx.Exec("UPDATE files SET path = ? WHERE path = ?", data.RelPath, oldPath); err != nil {
+		return fmt.Errorf("failed to move %s: %w", oldPath, err)
+	}
+	return nil
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// replaceTags stores tags as the full set of tags for the note at path
+func replaceTags(tx *sql.Tx, path string, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM tags WHERE path = ?", path); err != nil {
+		return fmt.Errorf("failed to clear tags: %w", err)
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (path, tag) VALUES (?, ?)", path, tag); err != nil {
+			return fmt.Errorf("failed to store tag %s: %w", tag, err)
+		}
+	}
+	return nil
+}
 
 func (s *SQLiteStorage) Delete(path string) error {
-	result, err := s.db.Exec("DELETE FROM files WHERE path = ?", path)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Soft delete like MongoDB, keeping the row and its tags; Save and Update
+	// bring a recreated note back
+	result, err := tx.Exec("UPDATE files SET deleted = ? WHERE path = ? AND deleted IS NULL", time.Now(), path)
 	if err != nil {
 		return err
 	}
@@ -470,7 +1293,99 @@ func (s *SQLiteStorage) Delete(path string) error {
 		return ErrNotFound
 	}
 
-	return nil
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) FindByTag(tag string) ([]File, error) {
+	return s.queryFiles(`
+		SELECT files.path, files.id, files.slug, files.content, files.frontmatter
+		FROM files
+		JOIN tags ON tags.path = files.path
+		WHERE tags.tag = ? AND files.deleted IS NULL
+		ORDER BY files.path
+	`, tag)
+}
+
+func (s *SQLiteStorage) Get(slug string) (File, error) {
+	files, err := s.queryFiles(`
+		SELECT path, id, slug, content, frontmatter
+		FROM files
+		WHERE slug = ? AND deleted IS NULL
+		ORDER BY path
+		LIMIT 1
+	`, slug)
+	if err != nil {
+		return File{}, err
+	}
+	if len(files) == 0 {
+		return File{}, ErrNotFound
+	}
+	return files[0], nil
+}
+
+func (s *SQLiteStorage) ListFiles() ([]File, error) {
+	return s.queryFiles(`
+		SELECT path, id, slug, content, frontmatter
+		FROM files
+		WHERE deleted IS NULL
+		ORDER BY path
+	`)
+}
+
+// queryFiles runs a query selecting path, slug, content and frontmatter
+func (s *SQLiteStorage) queryFiles(query string, args ...any) ([]File, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		var data File
+		var id sql.NullString
+		var frontmatterJSON string
+		if err := rows.Scan(&data.RelPath, &id, &data.Slug, &data.Content, &frontmatterJSON); err != nil {
+			return nil, err
+		}
+		data.ID = id.String
+		if err := json.Unmarshal([]byte(frontmatterJSON), &data.FrontMatter); err != nil {
+			return nil, fmt.Errorf("failed to deserialize frontmatter: %w", err)
+		}
+		files = append(files, data)
+	}
+	return files, rows.Err()
+}
+
+func (s *SQLiteStorage) List() (map[string]time.Time, error) {
+	rows, err := s.db.Query("SELECT path, updated FROM files WHERE deleted IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make(map[string]time.Time)
+	for rows.Next() {
+		var path string
+		var updated time.Time
+		if err := rows.Scan(&path, &updated); err != nil {
+			return nil, err
+		}
+		list[path] = updated
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLiteStorage) GetHash(path string) (string, error) {
+	var hash sql.NullString
+	err := s.db.QueryRow("SELECT hash FROM files WHERE path = ? AND deleted IS NULL", path).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return hash.String, nil
 }
 
 func (s *SQLiteStorage) Close() error {
@@ -478,7 +1393,7 @@ func (s *SQLiteStorage) Close() error {
 }
 
 func (s *SQLiteStorage) Clear() error {
-	_, err := s.db.Exec("DROP TABLE IF EXISTS files")
+	_, err := s.db.Exec("DROP TABLE IF EXISTS tags; DROP TABLE IF EXISTS files")
 	return err
 }
 
@@ -486,9 +1401,11 @@ func (s *SQLiteStorage) Init() error {
 	_, err := s.db.Exec(`
 		CREATE TABLE IF NOT EXISTS files (
 			path TEXT PRIMARY KEY,
+			id TEXT,
 			slug TEXT,
 			content TEXT,
 			frontmatter TEXT,
+			hash TEXT,
 			updated DATETIME,
 			deleted DATETIME
 		)
@@ -496,7 +1413,45 @@ func (s *SQLiteStorage) Init() error {
 	if err != nil {
 		return err
 	}
+	// Databases created before the hash and id columns existed
+	if err := s.addColumnIfMissing("files", "hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("files", "id", "TEXT"); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_files_id ON files(id) WHERE id IS NOT NULL`)
+	if err != nil {
+		return err
+	}
 	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_path ON files(path)`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS tags (
+			path TEXT NOT NULL REFERENCES files(path) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (path, tag)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag)`)
+	return err
+}
+
+func (s *SQLiteStorage) addColumnIfMissing(table, column, columnType string) error {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
 	return err
 }
 
@@ -504,6 +1459,388 @@ func (s *SQLiteStorage) Watch() error {
 	return nil
 }
 
+func (s *SQLiteStorage) Ping() error {
+	return s.db.Ping()
+}
+
+// noteResponse is a note as returned by the notes API
+type noteResponse struct {
+	Slug        string                 `json:"slug"`
+	Path        string                 `json:"path"`
+	FrontMatter map[string]interface{} `json:"frontmatter"`
+	Content     string                 `json:"content,omitempty"`
+}
+
+func newNoteResponse(data File, withContent bool) noteResponse {
+	note := noteResponse{Slug: data.Slug, Path: data.RelPath, FrontMatter: data.FrontMatter}
+	if withContent {
+		note.Content = data.Content
+	}
+	return note
+}
+
+// NewAPIHandler returns a read-only API over the stored notes:
+// GET /notes lists them, ?field=status&value=draft filters by a frontmatter
+// field, and GET /notes/{slug} returns one note with its content
+func NewAPIHandler(storage Storage) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /notes", func(w http.ResponseWriter, r *http.Request) {
+		files, err := storage.ListFiles()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list notes: %v", err), http.StatusInternalServerError)
+			return
+		}
+		field, value := r.URL.Query().Get("field"), r.URL.Query().Get("value")
+		notes := make([]noteResponse, 0, len(files))
+		for _, data := range files {
+			if field != "" && !frontMatterMatches(data.FrontMatter, field, value) {
+				continue
+			}
+			notes = append(notes, newNoteResponse(data, false))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notes)
+	})
+	mux.HandleFunc("GET /notes/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := storage.Get(r.PathValue("slug"))
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "note not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to get note: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newNoteResponse(data, true))
+	})
+	return mux
+}
+
+// frontMatterMatches reports whether the frontmatter field equals value, or
+// contains it for lists. Without a value any note having the field matches.
+func frontMatterMatches(frontMatter map[string]interface{}, field, value string) bool {
+	fieldValue, ok := frontMatter[field]
+	if !ok {
+		return false
+	}
+	if value == "" {
+		return true
+	}
+	if items, ok := fieldValue.([]interface{}); ok {
+		for _, item := range items {
+			if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(fieldValue) == value
+}
+
+// SyncLogger reports sync activity. Storage operations go through
+// Operation so they can be shipped as structured events.
+type SyncLogger interface {
+	// Operation records a save, update or delete of the note at path
+	Operation(op string, path string, duration time.Duration, err error)
+	Printf(format string, v ...any)
+}
+
+// NewSyncLogger returns a logger writing to w, as JSON lines when format is
+// "json" and as plain log lines otherwise
+func NewSyncLogger(format string, backend string, w io.Writer) SyncLogger {
+	if format == "json" {
+		return &jsonLogger{
+			logger:  slog.New(slog.NewJSONHandler(w, nil)),
+			backend: backend,
+		}
+	}
+	return &textLogger{logger: log.New(w, "", log.LstdFlags)}
+}
+
+// textLogger keeps the plain log output, successful operations are not logged
+type textLogger struct {
+	logger *log.Logger
+}
+
+func (l *textLogger) Operation(op string, path string, duration time.Duration, err error) {
+	if err != nil {
+		l.logger.Printf("Error in %s of %s: %v", op, path, err)
+	}
+}
+
+func (l *textLogger) Printf(format string, v ...any) {
+	l.logger.Printf(format, v...)
+}
+
+type jsonLogger struct {
+	logger  *slog.Logger
+	backend string
+}
+
+func (l *jsonLogger) Operation(op string, path string, duration time.Duration, err error) {
+	attrs := []slog.Attr{
+		slog.String("operation", op),
+		slog.String("path", path),
+		slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+		slog.String("backend", l.backend),
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	l.logger.LogAttrs(context.Background(), level, "sync", attrs...)
+}
+
+func (l *jsonLogger) Printf(format string, v ...any) {
+	l.logger.Info(fmt.Sprintf(format, v...))
+}
+
+// loggingStorage reports every Save, Update and Delete to a SyncLogger
+type loggingStorage struct {
+	Storage
+	logger SyncLogger
+}
+
+func (s *loggingStorage) Save(data File) error {
+	start := time.Now()
+	err := s.Storage.Save(data)
+	s.record("save", data.RelPath, start, err)
+	return err
+}
+
+func (s *loggingStorage) Update(data File) error {
+	start := time.Now()
+	err := s.Storage.Update(data)
+	s.record("update", data.RelPath, start, err)
+	return err
+}
+
+func (s *loggingStorage) Delete(path string) error {
+	start := time.Now()
+	err := s.Storage.Delete(path)
+	s.record("delete", path, start, err)
+	return err
+}
+
+// record logs the operation and counts it in the metrics
+func (s *loggingStorage) record(op, path string, start time.Time, err error) {
+	s.logger.Operation(op, path, time.Since(start), err)
+	storageOperations.WithLabelValues(op).Inc()
+	if err != nil {
+		storageErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// DeadLetter is a note that failed to parse or store
+type DeadLetter struct {
+	Path  string    `json:"path"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// DeadLetters records failed notes as JSON lines in a file, so they can be
+// found and retried later. A nil DeadLetters records nothing.
+type DeadLetters struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewDeadLetters returns nil for an empty path, which disables recording
+func NewDeadLetters(path string) *DeadLetters {
+	if path == "" {
+		return nil
+	}
+	return &DeadLetters{path: path}
+}
+
+// Record appends a failure for the note at path, which is absolute
+func (d *DeadLetters) Record(path string, failure error) {
+	if d == nil {
+		return
+	}
+	line, err := json.Marshal(DeadLetter{Path: path, Error: failure.Error(), Time: time.Now()})
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error recording failed note %s: %v", path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Error recording failed note %s: %v", path, err)
+	}
+}
+
+// Load returns the recorded failures, the latest one for each note
+func (d *DeadLetters) Load() ([]DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var letters []DeadLetter
+	index := make(map[string]int)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(line), &letter); err != nil {
+			return nil, fmt.Errorf("invalid line in %s: %w", d.path, err)
+		}
+		if i, ok := index[letter.Path]; ok {
+			letters[i] = letter
+			continue
+		}
+		index[letter.Path] = len(letters)
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+type RetryResult struct {
+	Recovered int
+	Failed    int
+}
+
+// Retry reprocesses the recorded notes: the ones still on disk are saved,
+// the others deleted. Only the notes that fail again stay recorded.
+func (d *DeadLetters) Retry(config *Config, parser Parser, storage Storage) (RetryResult, error) {
+	var result RetryResult
+	letters, err := d.Load()
+	if err != nil {
+		return result, err
+	}
+
+	var remaining []string
+	for _, letter := range letters {
+		err := retryNote(config, parser, storage, letter.Path)
+		if err == nil {
+			result.Recovered++
+			continue
+		}
+		result.Failed++
+		line, _ := json.Marshal(DeadLetter{Path: letter.Path, Error: err.Error(), Time: time.Now()})
+		remaining = append(remaining, string(line)+"\n")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := writeFileAtomic(d.path, []byte(strings.Join(remaining, "")), 0644); err != nil {
+		return result, fmt.Errorf("failed to rewrite %s: %w", d.path, err)
+	}
+	return result, nil
+}
+
+func retryNote(config *Config, parser Parser, storage Storage, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := storage.Delete(config.relPath(path))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	data, err := parser.Parse(path)
+	if err != nil {
+		return err
+	}
+	return storage.Save(data)
+}
+
+// Metrics served on /metrics with -metrics-addr
+var (
+	filesScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notes_sync_files_scanned_total",
+		Help: "Note files visited by the initial scan and reconcile.",
+	})
+	parseErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notes_sync_parse_errors_total",
+		Help: "Note files that couldn't be read or parsed.",
+	})
+	storageOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notes_sync_storage_operations_total",
+		Help: "Storage saves, updates and deletes, by operation.",
+	}, []string{"operation"})
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notes_sync_storage_errors_total",
+		Help: "Failed storage saves, updates and deletes, by operation.",
+	}, []string{"operation"})
+	watchedDirectories = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "notes_sync_watched_directories",
+		Help: "Directories currently watched for changes.",
+	})
+)
+
+// SyncStatus is the daemon state reported by the /status endpoint
+type SyncStatus struct {
+	mu            sync.Mutex
+	Backend       string
+	lastScan      time.Time
+	filesTracked  int
+	watcherActive bool
+}
+
+func (s *SyncStatus) ScanCompleted(files int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastScan = time.Now()
+	s.filesTracked = files
+}
+
+func (s *SyncStatus) SetWatcherActive(active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watcherActive = active
+}
+
+type statusResponse struct {
+	Backend       string     `json:"backend"`
+	LastScan      *time.Time `json:"last_scan"`
+	FilesTracked  int        `json:"files_tracked"`
+	WatcherActive bool       `json:"watcher_active"`
+}
+
+func (s *SyncStatus) snapshot() statusResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statusResponse{
+		Backend:       s.Backend,
+		FilesTracked:  s.filesTracked,
+		WatcherActive: s.watcherActive,
+	}
+	if !s.lastScan.IsZero() {
+		lastScan := s.lastScan
+		resp.LastScan = &lastScan
+	}
+	return resp
+}
+
+func NewHealthHandler(storage Storage, status *SyncStatus) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := storage.Ping(); err != nil {
+			http.Error(w, fmt.Sprintf("storage unreachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status.snapshot())
+	})
+	return mux
+}
+
 type WatcherEvent struct {
 	EventType string
 	Path      string
@@ -512,14 +1849,18 @@ type WatcherEvent struct {
 type Watcher interface {
 	Init(path string, handler WatcherEventHandler)
 	Add(path string) error
+	// Watch handles events until the watcher is closed
 	Watch()
+	Close() error
 }
 
-func NewWatcher(config *Config, parser Parser, storage Storage) Watcher {
+func NewWatcher(config *Config, parser Parser, storage Storage, logger SyncLogger, failed *DeadLetters) Watcher {
 	eventHandler := &DefaultEventHandler{
 		config:  config,
 		parser:  parser,
 		storage: storage,
+		logger:  logger,
+		failed:  failed,
 	}
 	fsnotifyWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -529,6 +1870,12 @@ func NewWatcher(config *Config, parser Parser, storage Storage) Watcher {
 		watcher:      fsnotifyWatcher,
 		eventHandler: eventHandler,
 		parser:       parser,
+		logger:       logger,
+		extensions:   config.Extensions,
+		debounce:     config.DebounceInterval,
+		pending:      make(map[string]*pendingEvent),
+		fired:        make(chan *pendingEvent),
+		done:         make(chan struct{}),
 	}
 	return watcher
 }
@@ -537,6 +1884,20 @@ type FSNotifyWatcher struct {
 	watcher      *fsnotify.Watcher
 	eventHandler WatcherEventHandler
 	parser       Parser
+	logger       SyncLogger
+	extensions   []string
+	debounce     time.Duration
+	// pending is only touched from the Watch goroutine, timers hand
+	// expired events back through fired.
+	pending map[string]*pendingEvent
+	fired   chan *pendingEvent
+	// done is closed once Watch stops receiving from fired
+	done chan struct{}
+}
+
+type pendingEvent struct {
+	event WatcherEvent
+	timer *time.Timer
 }
 
 func (w *FSNotifyWatcher) Init(path string, handler WatcherEventHandler) {
@@ -546,48 +1907,134 @@ func (w *FSNotifyWatcher) Add(path string) error {
 	if err := w.watcher.Add(path); err != nil {
 		return err
 	}
+	watchedDirectories.Set(float64(len(w.watcher.WatchList())))
 	return nil
 }
 
+// Close stops the watcher, Watch handles the events still being debounced
+// and returns
+func (w *FSNotifyWatcher) Close() error {
+	return w.watcher.Close()
+}
+
 func (w *FSNotifyWatcher) Watch() {
+	defer w.flush()
 	for {
 		select {
 		case event, ok := <-w.watcher.Events:
 			if !ok {
 				return
 			}
-			if filepath.Ext(event.Name) != ".md" {
-				return
+			// fsnotify drops the watch of a removed or moved directory
+			if event.Op.Has(fsnotify.Remove) || event.Op.Has(fsnotify.Rename) {
+				watchedDirectories.Set(float64(len(w.watcher.WatchList())))
 			}
 			// Handle new directory creation
 			if event.Op&fsnotify.Create == fsnotify.Create {
 				// Check if the created item is a directory
 				fi, err := os.Stat(event.Name)
 				if err == nil && fi.IsDir() {
-					// Skip dotdirs
-					baseName := filepath.Base(event.Name)
-					if len(baseName) > 0 && baseName[0] == '.' {
-						continue
-					}
-
-					// Add the new directory to the watcher
-					if err := w.watcher.Add(event.Name); err != nil {
-						log.Println("Error watching new directory:", err)
-					} else {
-						fmt.Println("Added new directory to watch:", event.Name)
-					}
+					w.addTree(event.Name)
+					continue
 				}
 			}
-			w.eventHandler.Handle(WatcherEvent{EventType: event.Op.String(), Path: event.Name})
+			if !isNote(event.Name, w.extensions) {
+				continue
+			}
+			w.schedule(WatcherEvent{EventType: event.Op.String(), Path: event.Name})
+		case p := <-w.fired:
+			// A timer may fire right before being superseded, skip stale ones
+			if w.pending[p.event.Path] != p {
+				continue
+			}
+			delete(w.pending, p.event.Path)
+			w.eventHandler.Handle(p.event)
 		case err, ok := <-w.watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("Error:", err)
+			w.logger.Printf("Error: %v", err)
 		}
 	}
 }
 
+// addTree watches a newly created directory and every directory below it.
+// fsnotify isn't recursive and a mkdir -p or a moved in tree only reports
+// the top directory, and notes may land before the watches are in place, so
+// the markdown files found are handled as created.
+func (w *FSNotifyWatcher) addTree(root string) {
+	defer func() { watchedDirectories.Set(float64(len(w.watcher.WatchList()))) }()
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			w.logger.Printf("Error walking new directory %s: %v", path, err)
+			return nil
+		}
+		if entry.IsDir() {
+			// Skip dotdirs
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if err := w.watcher.Add(path); err != nil {
+				w.logger.Printf("Error watching new directory: %v", err)
+				return filepath.SkipDir
+			}
+			w.logger.Printf("Added new directory to watch: %s", path)
+			return nil
+		}
+		if isNote(path, w.extensions) {
+			w.schedule(WatcherEvent{EventType: "CREATE", Path: path})
+		}
+		return nil
+	})
+}
+
+// flush handles the pending events right away instead of waiting for their
+// debounce timers, including the ones whose timers fired but that Watch
+// didn't receive anymore, and releases those timers.
+func (w *FSNotifyWatcher) flush() {
+	close(w.done)
+	for path, p := range w.pending {
+		p.timer.Stop()
+		w.eventHandler.Handle(p.event)
+		delete(w.pending, path)
+	}
+}
+
+// schedule delays the event until no other event for the same path arrives
+// within the debounce interval.
+func (w *FSNotifyWatcher) schedule(event WatcherEvent) {
+	if w.debounce <= 0 {
+		w.eventHandler.Handle(event)
+		return
+	}
+	if p, ok := w.pending[event.Path]; ok {
+		event.EventType = mergeEventTypes(p.event.EventType, event.EventType)
+		if p.timer.Stop() {
+			p.event = event
+			p.timer.Reset(w.debounce)
+			return
+		}
+	}
+	p := &pendingEvent{event: event}
+	p.timer = time.AfterFunc(w.debounce, func() {
+		select {
+		case w.fired <- p:
+		case <-w.done:
+			// Watch has returned, flush handles the event
+		}
+	})
+	w.pending[event.Path] = p
+}
+
+// mergeEventTypes keeps a file that was created within the debounce window
+// as created, so that it is saved rather than updated.
+func mergeEventTypes(prev, next string) string {
+	if prev == "CREATE" && next == "WRITE" {
+		return prev
+	}
+	return next
+}
+
 type WatcherEventHandler interface {
 	Handle(event WatcherEvent)
 }
@@ -596,6 +2043,8 @@ type DefaultEventHandler struct {
 	config  *Config
 	storage Storage
 	parser  Parser
+	logger  SyncLogger
+	failed  *DeadLetters
 }
 
 func (h *DefaultEventHandler) Handle(event WatcherEvent) {
@@ -603,27 +2052,144 @@ func (h *DefaultEventHandler) Handle(event WatcherEvent) {
 	case "CREATE", "WRITE":
 		data, err := h.parser.Parse(event.Path)
 		if err != nil {
-			log.Printf("Error parsing markdown file %s: %v", event.Path, err)
+			parseErrors.Inc()
+			h.logger.Printf("Error parsing markdown file %s: %v", event.Path, err)
+			h.failed.Record(event.Path, err)
+			return
+		}
+		if unchanged(h.storage, data) {
 			return
 		}
 
 		if event.EventType == "CREATE" {
-			h.storage.Save(data)
+			err = h.storage.Save(data)
 		} else {
-			h.storage.Update(data)
+			err = h.storage.Update(data)
+		}
+		if err != nil {
+			h.failed.Record(event.Path, err)
+		}
+	case "REMOVE":
+		h.delete(event.Path)
+	case "RENAME":
+		// Editors that save atomically rename a new file over the old one
+		if _, err := os.Stat(event.Path); err == nil {
+			h.save(event.Path)
+			return
+		}
+		h.delete(event.Path)
+		// fsnotify only reports the source of a rename and not every platform
+		// follows up with a CREATE for the destination, so pick up whatever
+		// landed next to the source. Moves into other watched directories
+		// arrive as a CREATE there.
+		h.rescan(filepath.Dir(event.Path))
+	}
+}
+
+func (h *DefaultEventHandler) save(path string) {
+	data, err := h.parser.Parse(path)
+	if err != nil {
+		parseErrors.Inc()
+		h.logger.Printf("Error parsing markdown file %s: %v", path, err)
+		h.failed.Record(path, err)
+		return
+	}
+	if unchanged(h.storage, data) {
+		return
+	}
+	if err := h.storage.Save(data); err != nil {
+		h.failed.Record(path, err)
+	}
+}
+
+// delete removes the note at path from storage, a note that was never
+// stored isn't a failure
+func (h *DefaultEventHandler) delete(path string) {
+	err := h.storage.Delete(h.config.relPath(path))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		h.failed.Record(path, err)
+	}
+}
+
+// unchanged reports whether the stored copy of data has the same content,
+// e.g. after an editor autosave that didn't change anything or a rescan of
+// a note that was already synced
+func unchanged(storage Storage, data File) bool {
+	hash, err := storage.GetHash(data.RelPath)
+	return err == nil && hash == contentHash(data)
+}
+
+// contentHash is the sha256 of a note's content and frontmatter
+func contentHash(data File) string {
+	hash := sha256.New()
+	hash.Write([]byte(data.Content))
+	// Map keys are sorted when marshaling, so equal frontmatter hashes equally
+	frontMatter, err := yaml.Marshal(data.FrontMatter)
+	if err == nil {
+		hash.Write(frontMatter)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (h *DefaultEventHandler) rescan(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		h.logger.Printf("Error rescanning directory %s: %v", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isNote(entry.Name(), h.config.Extensions) {
+			continue
+		}
+		h.save(filepath.Join(dir, entry.Name()))
+	}
+}
+
+// frontMatterTags returns the tags listed in the frontmatter, either as a
+// YAML list or a comma separated string
+func frontMatterTags(frontMatter map[string]interface{}) []string {
+	var tags []string
+	switch value := frontMatter["tags"].(type) {
+	case []interface{}:
+		for _, item := range value {
+			if tag, ok := item.(string); ok && tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	case []string:
+		tags = append(tags, value...)
+	case string:
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
 		}
-	case "REMOVE", "RENAME":
-		relPath, _ := filepath.Rel(h.config.Path, event.Path)
-		h.storage.Delete(relPath)
 	}
+	return tags
 }
 
 type File struct {
+	// ID is the frontmatter id, it identifies the note across renames
+	ID          string
 	FrontMatter map[string]interface{}
-	Content     string
-	AbsPath     string
-	RelPath     string
-	Slug        string
+	// FrontMatterFormat is "yaml" or "toml", empty when there is no frontmatter
+	FrontMatterFormat string
+	// RawFrontMatter is the frontmatter as written in the file, fences
+	// included. Only set with Config.PreserveFrontMatter.
+	RawFrontMatter string
+	Content        string
+	AbsPath        string
+	RelPath        string `bson:"path"`
+	Slug           string
+}
+
+// key is what storage identifies the note by: its id if it has one,
+// otherwise its relative path
+func (f File) key() string {
+	if f.ID != "" {
+		return f.ID
+	}
+	return f.RelPath
 }
 
 type Parser interface {
@@ -640,11 +2206,26 @@ func NewParser(config *Config) Parser {
 	}
 }
 
+// Parse reads the note at path. A note whose frontmatter can't be decoded
+// is an error, the returned File then has everything but the frontmatter.
 func (p *DefaultParser) Parse(path string) (File, error) {
-	relPath, _ := filepath.Rel(p.Config.Path, path)
+	data, err := p.parse(path)
+	if err != nil || data.ID != "" || !p.Config.StableIDs {
+		return data, err
+	}
+	// Give the note an id so it keeps its stored record across renames
+	if err := writeID(path, data.FrontMatterFormat, newID()); err != nil {
+		return data, fmt.Errorf("failed to write id to %s: %w", path, err)
+	}
+	return p.parse(path)
+}
+
+// parse reads the note at path without giving it an id
+func (p *DefaultParser) parse(path string) (data File, err error) {
+	relPath := p.Config.relPath(path)
 	fileName := filepath.Base(path)
 	slug := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	data := File{
+	data = File{
 		AbsPath:     path,
 		RelPath:     relPath,
 		Slug:        slug,
@@ -658,32 +2239,103 @@ func (p *DefaultParser) Parse(path string) (File, error) {
 
 	contentStr := string(content)
 
-	// Check if file has frontmatter (starts with ---)
-	if strings.HasPrefix(contentStr, "---\n") {
-		// Find the closing frontmatter delimiter
-		parts := strings.SplitN(contentStr[4:], "---\n", 2)
-		if len(parts) == 2 {
-			// Parse YAML frontmatter
-			frontMatter := parts[0]
-			err = yaml.Unmarshal([]byte(frontMatter), &data.FrontMatter)
-			if err != nil {
-				log.Printf("Error parsing frontmatter in %s: %v", path, err)
-			}
+	// No frontmatter unless the file starts with one of the fences
+	data.Content = contentStr
 
-			// Set content to everything after frontmatter
-			data.Content = parts[1]
-		} else {
+	for _, fence := range []string{"---", "+++"} {
+		if !strings.HasPrefix(contentStr, fence+"\n") {
+			continue
+		}
+		// Find the closing frontmatter delimiter
+		parts := strings.SplitN(contentStr[len(fence)+1:], fence+"\n", 2)
+		if len(parts) != 2 {
 			// Invalid frontmatter format
-			data.Content = contentStr
+			break
 		}
-	} else {
-		// No frontmatter
-		data.Content = contentStr
+		// --- fences hold frontmatter in the configured default format,
+		// +++ is always TOML like in Hugo
+		format := p.Config.FrontMatterFormat
+		if fence == "+++" {
+			format = "toml"
+		} else if format == "" {
+			format = "yaml"
+		}
+		data.FrontMatterFormat = format
+		if p.Config.PreserveFrontMatter {
+			data.RawFrontMatter = contentStr[:len(contentStr)-len(parts[1])]
+		}
+		// Set content to everything after frontmatter
+		data.Content = parts[1]
+		if err := unmarshalFrontMatter(format, parts[0], &data.FrontMatter); err != nil {
+			data.FrontMatter = make(map[string]interface{})
+			return data, fmt.Errorf("invalid %s frontmatter: %w", format, err)
+		}
+		break
+	}
+
+	// Only a non-empty string is an id, a null or numeric one would be shared
+	// or mangled
+	if id, ok := data.FrontMatter["id"].(string); ok {
+		data.ID = id
 	}
 
 	return data, nil
 }
 
+// newID generates a random note id
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// idLine matches a top-level id in YAML or TOML frontmatter
+var idLine = regexp.MustCompile(`(?m)^id[ \t]*[:=].*\n`)
+
+// writeID adds an id to the frontmatter of the note at path, leaving the rest
+// of the file as it is. An existing unusable id, e.g. an empty or null one, is
+// replaced so the key isn't defined twice. format is the note's frontmatter
+// format, empty if it has none.
+func writeID(path, format, id string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Quoted so hex ids like 1e10 aren't read back as numbers
+	line := fmt.Sprintf("id: %q\n", id)
+	if format == "toml" {
+		line = fmt.Sprintf("id = %q\n", id)
+	}
+	var updated string
+	if format == "" {
+		updated = "---\n" + line + "---\n" + string(content)
+	} else {
+		// Both fences are 3 characters and a newline
+		fence, rest := string(content[:4]), string(content[4:])
+		frontMatter, body, _ := strings.Cut(rest, fence)
+		if loc := idLine.FindStringIndex(frontMatter); loc != nil {
+			frontMatter = frontMatter[:loc[0]] + line + frontMatter[loc[1]:]
+		} else {
+			frontMatter = line + frontMatter
+		}
+		updated = fence + frontMatter + fence + body
+	}
+	return writeFileAtomic(path, []byte(updated), info.Mode().Perm())
+}
+
+func unmarshalFrontMatter(format string, raw string, frontMatter *map[string]interface{}) error {
+	if format == "toml" {
+		_, err := toml.Decode(raw, frontMatter)
+		return err
+	}
+	return yaml.Unmarshal([]byte(raw), frontMatter)
+}
+
 func writeFileToDisk(file File) error {
 	// Ensure directory exists
 	dir := filepath.Dir(file.AbsPath)
@@ -694,7 +2346,17 @@ func writeFileToDisk(file File) error {
 	// Construct file content with frontmatter if it exists
 	var content strings.Builder
 
-	if len(file.FrontMatter) > 0 {
+	if file.RawFrontMatter != "" {
+		// Write the original frontmatter back verbatim
+		content.WriteString(file.RawFrontMatter)
+	} else if len(file.FrontMatter) > 0 && file.FrontMatterFormat == "toml" {
+		// Add frontmatter in the format it was read in
+		content.WriteString("+++\n")
+		if err := toml.NewEncoder(&content).Encode(file.FrontMatter); err != nil {
+			return fmt.Errorf("failed to marshal frontmatter: %w", err)
+		}
+		content.WriteString("+++\n")
+	} else if len(file.FrontMatter) > 0 {
 		// Add frontmatter
 		content.WriteString("---\n")
 		frontmatterBytes, err := yaml.Marshal(file.FrontMatter)
@@ -709,9 +2371,54 @@ func writeFileToDisk(file File) error {
 	content.WriteString(file.Content)
 
 	// Write to file
-	if err := os.WriteFile(file.AbsPath, []byte(content.String()), 0644); err != nil {
+	if err := writeFileAtomic(file.AbsPath, []byte(content.String()), 0644); err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
 
 	return nil
 }
+
+// removeFileFromDisk is the counterpart of writeFileToDisk for deletes, a
+// file that is already gone is not an error
+func removeFileFromDisk(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, so readers never observe a partially written note.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	// Clean up the temp file on any failure below
+	ok := false
+	defer func() {
+		if !ok {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
@@ -1,22 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func TestParseMarkdownFile(t *testing.T) {
-	tmpDir := os.TempDir()
-	defer os.RemoveAll(tmpDir)
+var testLogger = NewSyncLogger("text", "", io.Discard)
+
+func TestDefaultParserParse(t *testing.T) {
+	tmpDir := t.TempDir()
+	parser := NewParser(&Config{Path: tmpDir})
 
 	tests := []struct {
 		name     string
 		content  string
-		expected MarkdownData
+		expected File
+		wantErr  bool
 	}{
 		{
 			name: "with_valid_frontmatter",
@@ -29,11 +45,11 @@ date: 2023-05-01
 ---
 # Test Content
 This is a test markdown file.`,
-			expected: MarkdownData{
+			expected: File{
 				FrontMatter: map[string]interface{}{
 					"title": "Test Document",
 					"tags":  []interface{}{"golang", "testing"},
-					"date":  "2023-05-01",
+					"date":  time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
 				},
 				Content: "# Test Content\nThis is a test markdown file.",
 			},
@@ -42,7 +58,7 @@ This is a test markdown file.`,
 			name: "without_frontmatter",
 			content: `# No Frontmatter
 Just content here.`,
-			expected: MarkdownData{
+			expected: File{
 				FrontMatter: map[string]interface{}{},
 				Content:     "# No Frontmatter\nJust content here.",
 			},
@@ -54,13 +70,27 @@ invalid: yaml:
   - missing colon
 ---
 # Content with invalid frontmatter`,
-			expected: MarkdownData{
+			expected: File{
 				FrontMatter: map[string]interface{}{},
-				Content: `---
-invalid: yaml:
-  - missing colon
----
-# Content with invalid frontmatter`,
+				Content:     "# Content with invalid frontmatter",
+			},
+			wantErr: true,
+		},
+		{
+			name: "with_toml_frontmatter",
+			content: `+++
+title = "Test Document"
+tags = ["golang", "testing"]
+weight = 3
++++
+# TOML Content`,
+			expected: File{
+				FrontMatter: map[string]interface{}{
+					"title":  "Test Document",
+					"tags":   []interface{}{"golang", "testing"},
+					"weight": int64(3),
+				},
+				Content: "# TOML Content",
 			},
 		},
 		{
@@ -68,7 +98,7 @@ invalid: yaml:
 			content: `---
 ---
 # Content with empty frontmatter`,
-			expected: MarkdownData{
+			expected: File{
 				FrontMatter: map[string]interface{}{},
 				Content:     "# Content with empty frontmatter",
 			},
@@ -85,14 +115,17 @@ invalid: yaml:
 			}
 
 			// Parse the file
-			got, err := parseMarkdownFile(filePath)
-			if err != nil {
-				t.Fatalf("parseMarkdownFile failed: %v", err)
+			got, err := parser.Parse(filePath)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Parse error = %v, want error %v", err, tc.wantErr)
 			}
 
-			// Check path
-			if got.Path != filePath {
-				t.Errorf("Expected path %s, got %s", filePath, got.Path)
+			// Check paths
+			if got.AbsPath != filePath {
+				t.Errorf("Expected path %s, got %s", filePath, got.AbsPath)
+			}
+			if got.RelPath != tc.name+".md" {
+				t.Errorf("Expected relative path %s, got %s", tc.name+".md", got.RelPath)
 			}
 
 			// Check content
@@ -109,20 +142,88 @@ invalid: yaml:
 
 	// Test non-existent file
 	t.Run("non_existent_file", func(t *testing.T) {
-		_, err := parseMarkdownFile(filepath.Join(tmpDir, "does-not-exist.md"))
+		_, err := parser.Parse(filepath.Join(tmpDir, "does-not-exist.md"))
 		if err == nil {
 			t.Error("Expected error for non-existent file, got nil")
 		}
 	})
 }
 
-func TestMemoryStorage(t *testing.T) {
-	storage := &MemoryStorage{
-		data: make(map[string]MarkdownData),
+func TestTOMLFrontMatter(t *testing.T) {
+	tmpDir := t.TempDir()
+	parser := NewParser(&Config{Path: tmpDir, FrontMatterFormat: "toml"})
+
+	// --- fences use the configured format
+	path := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(path, []byte("---\ntitle = \"Note\"\n---\nbody\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parser.Parse(path)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got.FrontMatter["title"] != "Note" || got.FrontMatterFormat != "toml" {
+		t.Fatalf("unexpected frontmatter %+v (%s)", got.FrontMatter, got.FrontMatterFormat)
+	}
+
+	// Writing back keeps TOML
+	if err := writeFileToDisk(got); err != nil {
+		t.Fatalf("writeFileToDisk failed: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "+++\ntitle = \"Note\"\n+++\nbody\n"
+	if string(written) != want {
+		t.Errorf("expected %q, got %q", want, written)
+	}
+}
+
+func TestMongoDocumentTOMLRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	path := filepath.Join(tmpDir, "note.md")
+	original := "+++\ntitle = \"Note\"\n+++\nbody\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewParser(config).Parse(path)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// Decode the stored document the way the change stream does and write
+	// it back to disk
+	raw, err := bson.Marshal(mongoDocument(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored File
+	if err := bson.Unmarshal(raw, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.FrontMatterFormat != "toml" {
+		t.Fatalf("Expected the stored document to keep the toml format, got %q", stored.FrontMatterFormat)
 	}
+	stored.AbsPath = config.absPath(stored.RelPath)
+	if err := writeFileToDisk(stored); err != nil {
+		t.Fatalf("writeFileToDisk failed: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != original {
+		t.Errorf("expected %q, got %q", original, written)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage, _ := NewMemoryStorage()
 
-	testData := MarkdownData{
-		Path:    "/test/path.md",
+	testData := File{
+		RelPath: "test/path.md",
 		Content: "Test content",
 		FrontMatter: map[string]interface{}{
 			"title": "Test",
@@ -137,7 +238,7 @@ func TestMemoryStorage(t *testing.T) {
 		}
 
 		// Verify data was stored
-		stored, ok := storage.data[testData.Path]
+		stored, ok := storage.data[testData.RelPath]
 		if !ok {
 			t.Error("Data not found in storage after Save")
 		}
@@ -157,15 +258,15 @@ func TestMemoryStorage(t *testing.T) {
 		}
 
 		// Verify data was updated
-		stored := storage.data[testData.Path]
+		stored := storage.data[testData.RelPath]
 		if stored.Content != updatedData.Content {
 			t.Errorf("Expected updated content %q, got %q", updatedData.Content, stored.Content)
 		}
 	})
 
 	t.Run("Update_NotFound", func(t *testing.T) {
-		nonExistentData := MarkdownData{
-			Path: "/non/existent.md",
+		nonExistentData := File{
+			RelPath: "non/existent.md",
 		}
 
 		err := storage.Update(nonExistentData)
@@ -176,20 +277,20 @@ func TestMemoryStorage(t *testing.T) {
 
 	// Test Delete
 	t.Run("Delete_Success", func(t *testing.T) {
-		err := storage.Delete(testData.Path)
+		err := storage.Delete(testData.RelPath)
 		if err != nil {
 			t.Errorf("Delete failed: %v", err)
 		}
 
 		// Verify data was deleted
-		_, ok := storage.data[testData.Path]
+		_, ok := storage.data[testData.RelPath]
 		if ok {
 			t.Error("Data found in storage after Delete")
 		}
 	})
 
 	t.Run("Delete_NotFound", func(t *testing.T) {
-		err := storage.Delete("/non/existent.md")
+		err := storage.Delete("non/existent.md")
 		if err != ErrNotFound {
 			t.Errorf("Expected ErrNotFound, got %v", err)
 		}
@@ -202,19 +303,19 @@ type MockStorage struct {
 	UpdateCalled bool
 	DeleteCalled bool
 	LastPath     string
-	LastData     MarkdownData
+	LastData     File
 }
 
-func (m *MockStorage) Save(data MarkdownData) error {
+func (m *MockStorage) Save(data File) error {
 	m.SaveCalled = true
-	m.LastPath = data.Path
+	m.LastPath = data.RelPath
 	m.LastData = data
 	return nil
 }
 
-func (m *MockStorage) Update(data MarkdownData) error {
+func (m *MockStorage) Update(data File) error {
 	m.UpdateCalled = true
-	m.LastPath = data.Path
+	m.LastPath = data.RelPath
 	m.LastData = data
 	return nil
 }
@@ -225,10 +326,46 @@ func (m *MockStorage) Delete(path string) error {
 	return nil
 }
 
+func (m *MockStorage) FindByTag(tag string) ([]File, error) {
+	return nil, nil
+}
+
+func (m *MockStorage) List() (map[string]time.Time, error) {
+	return map[string]time.Time{}, nil
+}
+
+func (m *MockStorage) GetHash(path string) (string, error) {
+	return "", ErrNotFound
+}
+
+func (m *MockStorage) Get(slug string) (File, error) {
+	return File{}, ErrNotFound
+}
+
+func (m *MockStorage) ListFiles() ([]File, error) {
+	return nil, nil
+}
+
 func (m *MockStorage) Close() error {
 	return nil
 }
 
+func (m *MockStorage) Clear() error {
+	return nil
+}
+
+func (m *MockStorage) Init() error {
+	return nil
+}
+
+func (m *MockStorage) Watch() error {
+	return nil
+}
+
+func (m *MockStorage) Ping() error {
+	return nil
+}
+
 func TestDefaultEventHandler(t *testing.T) {
 	// Create temp file for testing
 	tmpFile, err := os.CreateTemp("", "handler-test*.md")
@@ -245,8 +382,14 @@ func TestDefaultEventHandler(t *testing.T) {
 		t.Fatalf("Failed to close temp file: %v", err)
 	}
 
+	config := &Config{Path: filepath.Dir(tmpFile.Name())}
 	mockStorage := &MockStorage{}
-	handler := &DefaultEventHandler{storage: mockStorage}
+	handler := &DefaultEventHandler{
+		config:  config,
+		parser:  NewParser(config),
+		storage: mockStorage,
+		logger:  testLogger,
+	}
 
 	tests := []struct {
 		name      string
@@ -284,8 +427,8 @@ func TestDefaultEventHandler(t *testing.T) {
 				if !mockStorage.DeleteCalled {
 					t.Error("Delete was not called for REMOVE event")
 				}
-				if mockStorage.LastPath != tmpFile.Name() {
-					t.Errorf("Wrong path, expected %q, got %q", tmpFile.Name(), mockStorage.LastPath)
+				if want := filepath.Base(tmpFile.Name()); mockStorage.LastPath != want {
+					t.Errorf("Wrong path, expected %q, got %q", want, mockStorage.LastPath)
 				}
 			},
 		},
@@ -294,7 +437,7 @@ func TestDefaultEventHandler(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			*mockStorage = MockStorage{}
-			handler.handle(WatcherEvent{
+			handler.Handle(WatcherEvent{
 				EventType: tc.eventType,
 				Path:      tmpFile.Name(),
 			})
@@ -311,18 +454,18 @@ func TestMongoDBStorage(t *testing.T) {
 	}
 
 	// Setup MongoDB storage
-	storage, err := NewMongoDBStorage(mongoURI)
+	storage, err := NewMongoDBStorage(mongoURI, &Config{Path: t.TempDir()})
 	if err != nil {
 		t.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
 	defer storage.Close()
 
 	// Clean up any test data that might exist
-	testPath := "/test/mongodb-test.md"
+	testPath := "test/mongodb-test.md"
 	_ = storage.Delete(testPath)
 
-	testData := MarkdownData{
-		Path:    testPath,
+	testData := File{
+		RelPath: testPath,
 		Content: "Test content for MongoDB",
 		FrontMatter: map[string]interface{}{
 			"title": "MongoDB Test",
@@ -349,7 +492,7 @@ func TestMongoDBStorage(t *testing.T) {
 		}
 
 		// Verify data was updated by querying MongoDB
-		filter := bson.M{"path": testData.Path}
+		filter := bson.M{"_id": testData.RelPath}
 		var result bson.M
 		err = storage.collection.FindOne(storage.ctx, filter).Decode(&result)
 		if err != nil {
@@ -362,8 +505,8 @@ func TestMongoDBStorage(t *testing.T) {
 	})
 
 	t.Run("Update_NotFound", func(t *testing.T) {
-		nonExistentData := MarkdownData{
-			Path: "/non/existent/mongodb.md",
+		nonExistentData := File{
+			RelPath: "non/existent/mongodb.md",
 		}
 
 		err := storage.Update(nonExistentData)
@@ -374,14 +517,14 @@ func TestMongoDBStorage(t *testing.T) {
 
 	// Test Delete
 	t.Run("Delete_Success", func(t *testing.T) {
-		err := storage.Delete(testData.Path)
+		err := storage.Delete(testData.RelPath)
 		if err != nil {
 			t.Errorf("Delete failed: %v", err)
 		}
 
-		// Verify data was deleted by querying MongoDB
-		filter := bson.M{"path": testData.Path}
-		count, err := storage.collection.CountDocuments(storage.ctx, filter)
+		// Verify data was deleted by querying MongoDB, deletes only mark
+		// the document
+		count, err := storage.collection.CountDocuments(storage.ctx, pathFilter(testData.RelPath))
 		if err != nil {
 			t.Errorf("Failed to count documents: %v", err)
 		}
@@ -391,9 +534,1290 @@ func TestMongoDBStorage(t *testing.T) {
 	})
 
 	t.Run("Delete_NotFound", func(t *testing.T) {
-		err := storage.Delete("/non/existent/mongodb.md")
+		err := storage.Delete("non/existent/mongodb.md")
 		if err != ErrNotFound {
 			t.Errorf("Expected ErrNotFound, got %v", err)
 		}
 	})
+
+	t.Run("Recreate", func(t *testing.T) {
+		// A note written again at a deleted path is live again, whether it
+		// is saved or updated
+		for _, write := range []func(File) error{storage.Save, storage.Update} {
+			if err := write(testData); err != nil {
+				t.Fatalf("Writing recreated note failed: %v", err)
+			}
+			if _, err := storage.GetHash(testData.RelPath); err != nil {
+				t.Errorf("Expected recreated note to be live, got %v", err)
+			}
+			if err := storage.Delete(testData.RelPath); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+		}
+	})
+}
+
+// recordingHandler collects handled events for watcher tests
+type recordingHandler struct {
+	events chan WatcherEvent
+}
+
+func (h *recordingHandler) Handle(event WatcherEvent) {
+	h.events <- event
+}
+
+func newTestWatcher(t *testing.T, dir string, debounce time.Duration) (*FSNotifyWatcher, *recordingHandler) {
+	t.Helper()
+	fsnotifyWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create fsnotify watcher: %v", err)
+	}
+	t.Cleanup(func() { fsnotifyWatcher.Close() })
+
+	handler := &recordingHandler{events: make(chan WatcherEvent, 100)}
+	watcher := &FSNotifyWatcher{
+		watcher:      fsnotifyWatcher,
+		eventHandler: handler,
+		logger:       testLogger,
+		debounce:     debounce,
+		pending:      make(map[string]*pendingEvent),
+		fired:        make(chan *pendingEvent),
+		done:         make(chan struct{}),
+	}
+	if err := watcher.Add(dir); err != nil {
+		t.Fatalf("Failed to watch %s: %v", dir, err)
+	}
+	go watcher.Watch()
+	return watcher, handler
+}
+
+func TestFSNotifyWatcherDebounce(t *testing.T) {
+	tmpDir := t.TempDir()
+	_, handler := newTestWatcher(t, tmpDir, 200*time.Millisecond)
+
+	filePath := filepath.Join(tmpDir, "note.md")
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(filePath, []byte("# Note"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case event := <-handler.events:
+		if event.Path != filePath {
+			t.Errorf("Expected event for %s, got %s", filePath, event.Path)
+		}
+		if event.EventType != "CREATE" {
+			t.Errorf("Expected coalesced CREATE event, got %s", event.EventType)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for debounced event")
+	}
+
+	select {
+	case event := <-handler.events:
+		t.Errorf("Expected a single event, got another %s for %s", event.EventType, event.Path)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	storage, err := NewStorage("memory", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	status := &SyncStatus{Backend: "memory"}
+	status.ScanCompleted(3)
+	status.SetWatcherActive(true)
+	handler := NewHealthHandler(storage, status)
+
+	t.Run("healthz", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", rec.Code)
+		}
+	})
+
+	t.Run("status", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var got statusResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+		if got.Backend != "memory" {
+			t.Errorf("Expected backend memory, got %q", got.Backend)
+		}
+		if got.FilesTracked != 3 || !got.WatcherActive || got.LastScan == nil {
+			t.Errorf("Unexpected status: %+v", got)
+		}
+	})
+}
+
+func TestFSNotifyWatcherSkipsNonMarkdown(t *testing.T) {
+	tmpDir := t.TempDir()
+	_, handler := newTestWatcher(t, tmpDir, 0)
+
+	for _, name := range []string{".note.md.swp", ".DS_Store"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("x"), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+	filePath := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(filePath, []byte("# Note"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	select {
+	case event := <-handler.events:
+		if event.Path != filePath {
+			t.Errorf("Expected event for %s, got %s", filePath, event.Path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watcher stopped after a non-markdown event")
+	}
+}
+
+func TestDefaultEventHandlerRename(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+
+	oldPath := filepath.Join(tmpDir, "old.md")
+	newPath := filepath.Join(tmpDir, "new.md")
+	if err := os.WriteFile(newPath, []byte("# Renamed"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	t.Run("moved_away", func(t *testing.T) {
+		mockStorage := &MockStorage{}
+		handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: mockStorage, logger: testLogger}
+		handler.Handle(WatcherEvent{EventType: "RENAME", Path: oldPath})
+
+		if !mockStorage.DeleteCalled {
+			t.Error("Delete was not called for the rename source")
+		}
+		if !mockStorage.SaveCalled {
+			t.Fatal("Save was not called for the rename destination")
+		}
+		if mockStorage.LastData.RelPath != "new.md" {
+			t.Errorf("Expected destination new.md to be saved, got %q", mockStorage.LastData.RelPath)
+		}
+	})
+
+	t.Run("replaced_in_place", func(t *testing.T) {
+		mockStorage := &MockStorage{}
+		handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: mockStorage, logger: testLogger}
+		handler.Handle(WatcherEvent{EventType: "RENAME", Path: newPath})
+
+		if mockStorage.DeleteCalled {
+			t.Error("Delete was called for a file that still exists")
+		}
+		if !mockStorage.SaveCalled {
+			t.Error("Save was not called for a file replaced in place")
+		}
+	})
+}
+
+func TestDefaultScannerReconcile(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	storage, _ := NewMemoryStorage()
+	parser := NewParser(config)
+	scanner := NewScanner(config, nil, parser, storage, testLogger, nil)
+
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write test file: %v", err)
+		}
+	}
+
+	// Storage drifted while the process was down: one note is stale,
+	// one was removed from disk and one was never stored
+	write("unchanged.md", "# Unchanged")
+	write("changed.md", "# Old")
+	for _, name := range []string{"unchanged.md", "changed.md"} {
+		data, _ := parser.Parse(filepath.Join(tmpDir, name))
+		storage.Save(data)
+	}
+	storage.Save(File{RelPath: "gone.md", Content: "# Gone"})
+
+	later := time.Now().Add(time.Minute)
+	write("changed.md", "# New")
+	os.Chtimes(filepath.Join(tmpDir, "changed.md"), later, later)
+	write("missing.md", "# Missing")
+
+	result, err := scanner.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	expected := ReconcileResult{Inserted: 1, Updated: 1, Deleted: 1}
+	if result != expected {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+	if got := storage.data["changed.md"].Content; got != "# New" {
+		t.Errorf("Expected changed.md to be updated, got %q", got)
+	}
+	if _, ok := storage.data["missing.md"]; !ok {
+		t.Error("Expected missing.md to be inserted")
+	}
+	if _, ok := storage.data["gone.md"]; ok {
+		t.Error("Expected gone.md to be deleted")
+	}
+}
+
+func TestStorageDeleteRecreate(t *testing.T) {
+	sqliteStorage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite storage: %v", err)
+	}
+	defer sqliteStorage.Close()
+	if err := sqliteStorage.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	memoryStorage, _ := NewMemoryStorage()
+
+	for name, storage := range map[string]Storage{"sqlite": sqliteStorage, "memory": memoryStorage} {
+		t.Run(name, func(t *testing.T) {
+			data := File{RelPath: "note.md", Slug: "note", Content: "# Note", FrontMatter: map[string]interface{}{"tags": "a"}}
+			if err := storage.Save(data); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			if err := storage.Delete("note.md"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if err := storage.Delete("note.md"); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+			}
+			list, err := storage.List()
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(list) != 0 {
+				t.Errorf("Expected deleted note to be gone from List, got %v", list)
+			}
+			if files, _ := storage.FindByTag("a"); len(files) != 0 {
+				t.Errorf("Expected deleted note to be gone from FindByTag, got %v", files)
+			}
+
+			// Recreating the path brings the note back
+			data.Content = "# Recreated"
+			if err := storage.Save(data); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			got, err := storage.Get("note")
+			if err != nil {
+				t.Fatalf("Expected note.md after saving again: %v", err)
+			}
+			if got.Content != "# Recreated" {
+				t.Errorf("Expected recreated content, got %q", got.Content)
+			}
+			if files, _ := storage.FindByTag("a"); len(files) != 1 {
+				t.Errorf("Expected recreated note in FindByTag, got %v", files)
+			}
+		})
+	}
+}
+
+func TestSQLiteSoftDelete(t *testing.T) {
+	storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	data := File{RelPath: "note.md", Slug: "note", Content: "# Note", FrontMatter: map[string]interface{}{"tags": "a"}}
+	if err := storage.Save(data); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := storage.Delete("note.md"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// The row and its tags stay, only marked deleted
+	var deleted sql.NullTime
+	var tags int
+	if err := storage.db.QueryRow("SELECT deleted FROM files WHERE path = ?", "note.md").Scan(&deleted); err != nil {
+		t.Fatalf("Expected the deleted note's row to be kept: %v", err)
+	}
+	if !deleted.Valid {
+		t.Error("Expected the row to be marked deleted")
+	}
+	if err := storage.db.QueryRow("SELECT COUNT(*) FROM tags WHERE path = ?", "note.md").Scan(&tags); err != nil || tags != 1 {
+		t.Errorf("Expected the deleted note's tags to be kept, got %d (%v)", tags, err)
+	}
+	if _, err := storage.GetHash("note.md"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for the deleted note's hash, got %v", err)
+	}
+
+	// Like in MongoDB, an update of the recreated note brings it back
+	if err := storage.Update(data); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := storage.GetHash("note.md"); err != nil {
+		t.Errorf("Expected the updated note to be live again: %v", err)
+	}
+}
+
+func TestFindByTag(t *testing.T) {
+	sqliteStorage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite storage: %v", err)
+	}
+	defer sqliteStorage.Close()
+	memoryStorage, _ := NewMemoryStorage()
+
+	backends := map[string]Storage{
+		"memory": memoryStorage,
+		"sqlite": sqliteStorage,
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			if err := storage.Init(); err != nil {
+				t.Fatalf("Init failed: %v", err)
+			}
+			notes := []File{
+				{RelPath: "a.md", Slug: "a", FrontMatter: map[string]interface{}{"tags": []interface{}{"project-x", "golang"}}},
+				{RelPath: "b.md", Slug: "b", FrontMatter: map[string]interface{}{"tags": "golang, project-y"}},
+				{RelPath: "c.md", Slug: "c", FrontMatter: map[string]interface{}{}},
+			}
+			for _, note := range notes {
+				if err := storage.Save(note); err != nil {
+					t.Fatalf("Save failed: %v", err)
+				}
+			}
+
+			files, err := storage.FindByTag("project-x")
+			if err != nil {
+				t.Fatalf("FindByTag failed: %v", err)
+			}
+			if len(files) != 1 || files[0].RelPath != "a.md" {
+				t.Errorf("Expected only a.md tagged project-x, got %+v", files)
+			}
+
+			files, _ = storage.FindByTag("golang")
+			if len(files) != 2 {
+				t.Errorf("Expected 2 notes tagged golang, got %d", len(files))
+			}
+
+			// Retagging a note replaces its tags
+			notes[0].FrontMatter = map[string]interface{}{"tags": []interface{}{"golang"}}
+			if err := storage.Update(notes[0]); err != nil {
+				t.Fatalf("Update failed: %v", err)
+			}
+			files, _ = storage.FindByTag("project-x")
+			if len(files) != 0 {
+				t.Errorf("Expected no notes tagged project-x after update, got %+v", files)
+			}
+		})
+	}
+}
+
+func TestWriteFileToDiskAtomic(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "sub", "note.md")
+
+	// Overwrite an existing note to exercise the rename path
+	for _, body := range []string{"first\n", "second\n"} {
+		file := File{
+			FrontMatter: map[string]interface{}{"title": "Note"},
+			Content:     body,
+			AbsPath:     path,
+		}
+		if err := writeFileToDisk(file); err != nil {
+			t.Fatalf("writeFileToDisk failed: %v", err)
+		}
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "---\ntitle: Note\n---\nsecond\n"; string(got) != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "note.md" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("expected only note.md, got %v", names)
+	}
+}
+
+func TestRemoveFileFromDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "note.md")
+	if err := writeFileToDisk(File{Content: "body\n", AbsPath: path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeFileFromDisk(path); err != nil {
+		t.Fatalf("removeFileFromDisk failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed, got %v", err)
+	}
+	// Deleting twice (e.g. replayed change event) is fine
+	if err := removeFileFromDisk(path); err != nil {
+		t.Errorf("expected no error for missing file, got %v", err)
+	}
+}
+
+// decodeChange round trips a change stream document through BSON the way
+// readChangeStream receives it
+func decodeChange(t *testing.T, doc bson.M) changeEvent {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var change changeEvent
+	if err := bson.Unmarshal(raw, &change); err != nil {
+		t.Fatal(err)
+	}
+	return change
+}
+
+func TestSyncChange(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	path := filepath.Join(tmpDir, "note.md")
+	notLive := func(string) bool { return false }
+
+	// Formatted so that writing the stored frontmatter back would change it
+	original := "---\ntitle:   Note\n---\nbody\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewParser(config).Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		change := decodeChange(t, bson.M{
+			"operationType": "update",
+			"documentKey":   bson.M{"_id": "note.md"},
+			"fullDocument":  mongoDocument(data),
+		})
+		if err := syncChange(config, change, notLive); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		written, _ := os.ReadFile(path)
+		if string(written) != original {
+			t.Errorf("Expected a change already on disk to leave the file alone, got %q", written)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		changed := data
+		changed.Content = "changed\n"
+		change := decodeChange(t, bson.M{
+			"operationType": "update",
+			"documentKey":   bson.M{"_id": "note.md"},
+			"fullDocument":  mongoDocument(changed),
+		})
+		if err := syncChange(config, change, notLive); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		written, _ := os.ReadFile(path)
+		if want := "---\ntitle: Note\n---\nchanged\n"; string(written) != want {
+			t.Errorf("Expected %q, got %q", want, written)
+		}
+	})
+
+	t.Run("soft_delete", func(t *testing.T) {
+		doc := mongoDocument(data)
+		doc["deleted"] = time.Now()
+		change := decodeChange(t, bson.M{
+			"operationType": "update",
+			"documentKey":   bson.M{"_id": "note.md"},
+			"fullDocument":  doc,
+		})
+
+		// Stored again in the meantime, the file stays
+		if err := syncChange(config, change, func(string) bool { return true }); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected the file of a live note to stay: %v", err)
+		}
+
+		if err := syncChange(config, change, notLive); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected the deleted note to be removed from disk, got %v", err)
+		}
+	})
+
+	t.Run("delete_migrated", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Saving a note that got an id removes the document keyed by its path
+		change := decodeChange(t, bson.M{
+			"operationType":            "delete",
+			"documentKey":              bson.M{"_id": "note.md"},
+			"fullDocumentBeforeChange": bson.M{"_id": "note.md", "path": "note.md"},
+		})
+		if err := syncChange(config, change, func(string) bool { return true }); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected the file of a note stored under its id to stay: %v", err)
+		}
+
+		if err := syncChange(config, change, notLive); err != nil {
+			t.Fatalf("syncChange failed: %v", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected the deleted note to be removed from disk, got %v", err)
+		}
+	})
+}
+
+func TestNextBackoff(t *testing.T) {
+	d := watchMinBackoff
+	var got []time.Duration
+	for range 8 {
+		got = append(got, d)
+		d = nextBackoff(d)
+	}
+	want := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backoff sequence = %v, want %v", got, want)
+	}
+}
+
+// countingStorage counts the writes that reach the wrapped storage
+type countingStorage struct {
+	Storage
+	writes int
+}
+
+func (s *countingStorage) Save(data File) error {
+	s.writes++
+	return s.Storage.Save(data)
+}
+
+func (s *countingStorage) Update(data File) error {
+	s.writes++
+	return s.Storage.Update(data)
+}
+
+func TestSkipUnchangedWrites(t *testing.T) {
+	newSQLite := func(t *testing.T) Storage {
+		storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite storage: %v", err)
+		}
+		t.Cleanup(func() { storage.Close() })
+		if err := storage.Init(); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		return storage
+	}
+	newMemory := func(t *testing.T) Storage {
+		storage, _ := NewMemoryStorage()
+		return storage
+	}
+
+	for name, newStorage := range map[string]func(*testing.T) Storage{"memory": newMemory, "sqlite": newSQLite} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			config := &Config{Path: tmpDir}
+			storage := &countingStorage{Storage: newStorage(t)}
+			handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: storage, logger: testLogger}
+
+			path := filepath.Join(tmpDir, "note.md")
+			write := func(content string) {
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write("---\ntitle: Note\n---\nbody\n")
+			handler.Handle(WatcherEvent{EventType: "CREATE", Path: path})
+			// Autosave without changes
+			handler.Handle(WatcherEvent{EventType: "WRITE", Path: path})
+			if storage.writes != 1 {
+				t.Errorf("expected unchanged write to be skipped, got %d writes", storage.writes)
+			}
+
+			write("---\ntitle: Renamed\n---\nbody\n")
+			handler.Handle(WatcherEvent{EventType: "WRITE", Path: path})
+			if storage.writes != 2 {
+				t.Errorf("expected frontmatter change to be written, got %d writes", storage.writes)
+			}
+
+			hash, err := storage.GetHash("note.md")
+			if err != nil {
+				t.Fatalf("GetHash failed: %v", err)
+			}
+			data, _ := handler.parser.Parse(path)
+			if hash != contentHash(data) {
+				t.Errorf("stored hash %s doesn't match content", hash)
+			}
+			if _, err := storage.GetHash("missing.md"); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound for missing note, got %v", err)
+			}
+
+			// A rescan of notes that are already synced writes nothing
+			watcher, _ := newTestWatcher(t, tmpDir, time.Millisecond)
+			scanner := NewScanner(config, watcher, handler.parser, storage, testLogger, nil)
+			if err := scanner.Scan(context.Background()); err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if storage.writes != 2 {
+				t.Errorf("expected scan of unchanged note to be skipped, got %d writes", storage.writes)
+			}
+			if scanner.scanned != 1 {
+				t.Errorf("expected unchanged note to count as scanned, got %d", scanner.scanned)
+			}
+		})
+	}
+}
+
+func TestScanCancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "note.md"), []byte("# Note"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Path: tmpDir}
+	storage, _ := NewMemoryStorage()
+	watcher, _ := newTestWatcher(t, tmpDir, time.Millisecond)
+	scanner := NewScanner(config, watcher, NewParser(config), storage, testLogger, nil)
+
+	// A signal arriving during the scan stops it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := scanner.Scan(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the scan to stop with context.Canceled, got %v", err)
+	}
+	if files, _ := storage.ListFiles(); len(files) != 0 {
+		t.Errorf("expected nothing stored after cancelling, got %+v", files)
+	}
+}
+
+func TestJSONSyncLogger(t *testing.T) {
+	var buf bytes.Buffer
+	storage, _ := NewMemoryStorage()
+	logged := &loggingStorage{Storage: storage, logger: NewSyncLogger("json", "memory", &buf)}
+
+	logged.Save(File{RelPath: "note.md"})
+	logged.Delete("missing.md")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	var entries []map[string]any
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	save := entries[0]
+	if save["operation"] != "save" || save["path"] != "note.md" || save["backend"] != "memory" || save["level"] != "INFO" {
+		t.Errorf("unexpected save entry %v", save)
+	}
+	if _, ok := save["duration_ms"].(float64); !ok {
+		t.Errorf("expected numeric duration_ms, got %v", save["duration_ms"])
+	}
+	if _, ok := save["error"]; ok {
+		t.Errorf("expected no error on save, got %v", save["error"])
+	}
+
+	del := entries[1]
+	if del["operation"] != "delete" || del["level"] != "ERROR" || del["error"] != ErrNotFound.Error() {
+		t.Errorf("unexpected delete entry %v", del)
+	}
+}
+
+func TestTextSyncLoggerOnlyLogsErrors(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSyncLogger("text", "memory", &buf)
+	logger.Operation("save", "note.md", time.Millisecond, nil)
+	if buf.Len() != 0 {
+		t.Errorf("expected successful operations to be silent, got %q", buf.String())
+	}
+	logger.Operation("update", "note.md", time.Millisecond, errors.New("boom"))
+	if !strings.Contains(buf.String(), "Error in update of note.md: boom") {
+		t.Errorf("unexpected error line %q", buf.String())
+	}
+}
+
+func TestFSNotifyWatcherNestedDirectories(t *testing.T) {
+	tmpDir := t.TempDir()
+	_, events := newTestWatcher(t, tmpDir, 0)
+
+	config := &Config{Path: tmpDir}
+	storage, _ := NewMemoryStorage()
+	handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: storage, logger: testLogger}
+
+	deepDir := filepath.Join(tmpDir, "a", "b", "c")
+	if err := os.MkdirAll(deepDir, 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	// Give the watcher a moment to pick up the tree, the note is stored either
+	// through its own event or the walk of the new directory
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(deepDir, "note.md"), []byte("# Deep"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	relPath := filepath.Join("a", "b", "c", "note.md")
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-events.events:
+			handler.Handle(event)
+			if _, err := storage.GetHash(relPath); err == nil {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s was not stored", relPath)
+		}
+	}
+}
+
+func TestPreserveFrontMatter(t *testing.T) {
+	tmpDir := t.TempDir()
+	parser := NewParser(&Config{Path: tmpDir, PreserveFrontMatter: true})
+
+	original := "---\ntitle:   Note\ntags: [b, a]\ndate: 2023-05-01\n---\nbody\n"
+	path := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := parser.Parse(path)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if data.RawFrontMatter != "---\ntitle:   Note\ntags: [b, a]\ndate: 2023-05-01\n---\n" {
+		t.Errorf("unexpected raw frontmatter %q", data.RawFrontMatter)
+	}
+
+	if err := writeFileToDisk(data); err != nil {
+		t.Fatalf("writeFileToDisk failed: %v", err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != original {
+		t.Errorf("round trip changed the note\nExpected: %q\nGot: %q", original, written)
+	}
+
+	// Without the option the raw text isn't kept
+	data, _ = NewParser(&Config{Path: tmpDir}).Parse(path)
+	if data.RawFrontMatter != "" {
+		t.Errorf("expected no raw frontmatter, got %q", data.RawFrontMatter)
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	tmpDir := t.TempDir()
+	work := filepath.Join(tmpDir, "work")
+	personal := filepath.Join(tmpDir, "personal")
+	for _, dir := range []string{work, filepath.Join(personal, "journal")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(work, "note.md"), []byte("# Work"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(personal, "journal", "note.md"), []byte("# Personal"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Path: work, Paths: []string{personal}}
+	parser := NewParser(config)
+	data, err := parser.Parse(filepath.Join(personal, "journal", "note.md"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	wantRel := filepath.Join("personal", "journal", "note.md")
+	if data.RelPath != wantRel {
+		t.Errorf("expected relative path %s, got %s", wantRel, data.RelPath)
+	}
+	if got := config.absPath(wantRel); got != data.AbsPath {
+		t.Errorf("absPath(%s) = %s, want %s", wantRel, got, data.AbsPath)
+	}
+
+	storage, _ := NewMemoryStorage()
+	result, err := NewScanner(config, nil, parser, storage, testLogger, nil).Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if result.Inserted != 2 {
+		t.Errorf("expected notes from both roots, got %+v", result)
+	}
+	for _, relPath := range []string{filepath.Join("work", "note.md"), wantRel} {
+		if _, err := storage.GetHash(relPath); err != nil {
+			t.Errorf("%s not stored: %v", relPath, err)
+		}
+	}
+
+	// A single root keeps plain relative paths
+	single := &Config{Path: work}
+	if got := single.relPath(filepath.Join(work, "note.md")); got != "note.md" {
+		t.Errorf("expected note.md for a single root, got %s", got)
+	}
+}
+
+func TestFSNotifyWatcherCloseFlushesPending(t *testing.T) {
+	tmpDir := t.TempDir()
+	watcher, handler := newTestWatcher(t, tmpDir, time.Hour)
+
+	filePath := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(filePath, []byte("# Note"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	// Let the event reach the debounce queue
+	time.Sleep(100 * time.Millisecond)
+
+	if err := watcher.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	select {
+	case event := <-handler.events:
+		if event.Path != filePath {
+			t.Errorf("Expected event for %s, got %s", filePath, event.Path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Pending event was not handled on close")
+	}
+}
+
+func TestFSNotifyWatcherFlushFiredTimers(t *testing.T) {
+	handler := &recordingHandler{events: make(chan WatcherEvent, 10)}
+	watcher := &FSNotifyWatcher{
+		eventHandler: handler,
+		debounce:     time.Millisecond,
+		pending:      make(map[string]*pendingEvent),
+		fired:        make(chan *pendingEvent),
+		done:         make(chan struct{}),
+	}
+	// The timer fires while nothing receives from fired, like during
+	// shutdown
+	watcher.schedule(WatcherEvent{EventType: "WRITE", Path: "note.md"})
+	time.Sleep(50 * time.Millisecond)
+	watcher.flush()
+
+	select {
+	case event := <-handler.events:
+		if event.Path != "note.md" {
+			t.Errorf("Expected event for note.md, got %s", event.Path)
+		}
+	default:
+		t.Fatal("Event whose timer fired during shutdown was lost")
+	}
+	if len(handler.events) != 0 {
+		t.Errorf("Expected the event to be handled once, got %d more", len(handler.events))
+	}
+}
+
+func TestConfiguredExtensions(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.md", "b.markdown", "c.mdx", "d.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("# "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configPath := filepath.Join(tmpDir, "config.yml")
+	configYAML := "path: " + tmpDir + "\nextensions: [.md, markdown, .mdx]\n"
+	if err := os.WriteFile(configPath, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if want := []string{".md", ".markdown", ".mdx"}; !reflect.DeepEqual(config.Extensions, want) {
+		t.Errorf("extensions = %v, want %v", config.Extensions, want)
+	}
+
+	storage, _ := NewMemoryStorage()
+	result, err := NewScanner(config, nil, NewParser(config), storage, testLogger, nil).Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if result.Inserted != 3 {
+		t.Errorf("expected 3 notes, got %+v", result)
+	}
+	if _, err := storage.GetHash("d.txt"); err != ErrNotFound {
+		t.Errorf("expected d.txt to be skipped, got %v", err)
+	}
+
+	// Without a list only .md counts, e.g. for watchers built without a config
+	if isNote("b.markdown", nil) || !isNote("a.md", nil) {
+		t.Error("expected .md to be the default extension")
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	newSQLite := func(t *testing.T) Storage {
+		storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite storage: %v", err)
+		}
+		t.Cleanup(func() { storage.Close() })
+		if err := storage.Init(); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		return storage
+	}
+	newMemory := func(t *testing.T) Storage {
+		storage, _ := NewMemoryStorage()
+		return storage
+	}
+
+	for name, newStorage := range map[string]func(*testing.T) Storage{"memory": newMemory, "sqlite": newSQLite} {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			for _, data := range []File{
+				{RelPath: "b.md", Slug: "b", Content: "# B", FrontMatter: map[string]interface{}{"status": "draft"}},
+				{RelPath: "a.md", Slug: "a", Content: "# A", FrontMatter: map[string]interface{}{"status": "done", "tags": []interface{}{"x", "y"}}},
+			} {
+				if err := storage.Save(data); err != nil {
+					t.Fatalf("Save failed: %v", err)
+				}
+			}
+			handler := NewAPIHandler(storage)
+
+			get := func(target string) *httptest.ResponseRecorder {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+				return rec
+			}
+			slugs := func(rec *httptest.ResponseRecorder) []string {
+				var notes []noteResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &notes); err != nil {
+					t.Fatalf("Failed to decode notes: %v", err)
+				}
+				var slugs []string
+				for _, note := range notes {
+					slugs = append(slugs, note.Slug)
+				}
+				return slugs
+			}
+
+			if got := slugs(get("/notes")); !reflect.DeepEqual(got, []string{"a", "b"}) {
+				t.Errorf("list = %v, want [a b]", got)
+			}
+			if got := slugs(get("/notes?field=status&value=draft")); !reflect.DeepEqual(got, []string{"b"}) {
+				t.Errorf("filtered list = %v, want [b]", got)
+			}
+			if got := slugs(get("/notes?field=tags&value=y")); !reflect.DeepEqual(got, []string{"a"}) {
+				t.Errorf("list filtered by tag = %v, want [a]", got)
+			}
+
+			rec := get("/notes/a")
+			var note noteResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &note); err != nil {
+				t.Fatalf("Failed to decode note: %v", err)
+			}
+			if note.Path != "a.md" || note.Content != "# A" {
+				t.Errorf("unexpected note %+v", note)
+			}
+			if rec := get("/notes/missing"); rec.Code != http.StatusNotFound {
+				t.Errorf("expected 404 for a missing note, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestStableIDs(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir, FrontMatterFormat: "yaml", StableIDs: true}
+	parser := NewParser(config)
+
+	for name, content := range map[string]string{
+		"yaml.md": "---\ntitle: Note\n---\nbody\n",
+		"toml.md": "+++\ntitle = \"Note\"\n+++\nbody\n",
+		"none.md": "body\n",
+		// Unusable ids are replaced instead of defined a second time
+		"null.md":       "---\nid:\ntitle: Note\n---\nbody\n",
+		"empty.md":      "---\nid: \"\"\ntitle: Note\n---\nbody\n",
+		"empty-toml.md": "+++\nid = \"\"\n+++\nbody\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := parser.Parse(path)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if file.ID == "" {
+				t.Fatal("expected an id to be generated")
+			}
+			if file.Content != "body\n" {
+				t.Errorf("expected content to be kept, got %q", file.Content)
+			}
+
+			again, err := parser.Parse(path)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if again.ID != file.ID {
+				t.Errorf("expected id %q to be persisted, got %q", file.ID, again.ID)
+			}
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(written), "id"); n != 1 {
+				t.Errorf("expected a single id in the note, found %d:\n%s", n, written)
+			}
+		})
+	}
+}
+
+func TestStableIDRename(t *testing.T) {
+	newSQLite := func(t *testing.T) Storage {
+		storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite storage: %v", err)
+		}
+		t.Cleanup(func() { storage.Close() })
+		if err := storage.Init(); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		return storage
+	}
+	newMemory := func(t *testing.T) Storage {
+		storage, _ := NewMemoryStorage()
+		return storage
+	}
+
+	for name, newStorage := range map[string]func(*testing.T) Storage{"memory": newMemory, "sqlite": newSQLite} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			config := &Config{Path: tmpDir, StableIDs: true}
+			storage := newStorage(t)
+			handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: storage, logger: testLogger}
+
+			oldPath := filepath.Join(tmpDir, "old.md")
+			newPath := filepath.Join(tmpDir, "new.md")
+			if err := os.WriteFile(oldPath, []byte("---\ntags: [a]\n---\nbody\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			handler.Handle(WatcherEvent{EventType: "CREATE", Path: oldPath})
+
+			if err := os.Rename(oldPath, newPath); err != nil {
+				t.Fatal(err)
+			}
+			handler.Handle(WatcherEvent{EventType: "RENAME", Path: oldPath})
+			handler.Handle(WatcherEvent{EventType: "CREATE", Path: newPath})
+
+			files, err := storage.ListFiles()
+			if err != nil {
+				t.Fatalf("ListFiles failed: %v", err)
+			}
+			if len(files) != 1 || files[0].RelPath != "new.md" || files[0].ID == "" {
+				t.Fatalf("expected a single note with an id at new.md, got %+v", files)
+			}
+			tagged, err := storage.FindByTag("a")
+			if err != nil {
+				t.Fatalf("FindByTag failed: %v", err)
+			}
+			if len(tagged) != 1 || tagged[0].RelPath != "new.md" {
+				t.Errorf("expected tags to follow the note, got %+v", tagged)
+			}
+		})
+	}
+}
+
+func TestSQLiteConcurrencySettings(t *testing.T) {
+	storage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite storage: %v", err)
+	}
+	defer storage.Close()
+
+	var journalMode string
+	if err := storage.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("expected WAL journal mode, got %s", journalMode)
+	}
+
+	var busyTimeout int
+	if err := storage.db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if busyTimeout != 5000 {
+		t.Errorf("expected a 5000ms busy timeout, got %d", busyTimeout)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	backend, _ := NewMemoryStorage()
+	storage := &loggingStorage{Storage: backend, logger: testLogger}
+	handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: storage, logger: testLogger}
+
+	saves := testutil.ToFloat64(storageOperations.WithLabelValues("save"))
+	updateErrors := testutil.ToFloat64(storageErrors.WithLabelValues("update"))
+	parseFailures := testutil.ToFloat64(parseErrors)
+
+	path := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(path, []byte("body\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler.Handle(WatcherEvent{EventType: "CREATE", Path: path})
+	// Updating a note that was never stored fails
+	storage.Update(File{RelPath: "missing.md"})
+	handler.Handle(WatcherEvent{EventType: "WRITE", Path: filepath.Join(tmpDir, "gone.md")})
+	malformed := filepath.Join(tmpDir, "malformed.md")
+	if err := os.WriteFile(malformed, []byte("---\ninvalid: yaml:\n---\nbody\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler.Handle(WatcherEvent{EventType: "CREATE", Path: malformed})
+
+	if got := testutil.ToFloat64(storageOperations.WithLabelValues("save")) - saves; got != 1 {
+		t.Errorf("expected 1 save, got %v", got)
+	}
+	if got := testutil.ToFloat64(storageErrors.WithLabelValues("update")) - updateErrors; got != 1 {
+		t.Errorf("expected 1 update error, got %v", got)
+	}
+	// The missing file and the malformed frontmatter
+	if got := testutil.ToFloat64(parseErrors) - parseFailures; got != 2 {
+		t.Errorf("expected 2 parse errors, got %v", got)
+	}
+}
+
+type failingStorage struct {
+	Storage
+}
+
+func (s *failingStorage) Save(data File) error {
+	return errors.New("storage unavailable")
+}
+
+func TestDeadLetters(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	failed := NewDeadLetters(filepath.Join(t.TempDir(), "notes-sync.failed"))
+	backend, _ := NewMemoryStorage()
+	handler := &DefaultEventHandler{config: config, parser: NewParser(config), storage: &failingStorage{Storage: backend}, logger: testLogger, failed: failed}
+
+	path := filepath.Join(tmpDir, "note.md")
+	if err := os.WriteFile(path, []byte("body\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler.Handle(WatcherEvent{EventType: "CREATE", Path: path})
+	handler.Handle(WatcherEvent{EventType: "CREATE", Path: path})
+
+	letters, err := failed.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(letters) != 1 || letters[0].Path != path || letters[0].Error != "storage unavailable" {
+		t.Fatalf("expected one failure for %s, got %+v", path, letters)
+	}
+
+	result, err := failed.Retry(config, NewParser(config), backend)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if result.Recovered != 1 || result.Failed != 0 {
+		t.Errorf("expected the note to be recovered, got %+v", result)
+	}
+	if _, err := backend.GetHash("note.md"); err != nil {
+		t.Errorf("expected the note to be stored: %v", err)
+	}
+	if letters, _ := failed.Load(); len(letters) != 0 {
+		t.Errorf("expected no failures left, got %+v", letters)
+	}
+}
+
+func TestDeadLettersMalformedFrontMatter(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{Path: tmpDir}
+	failed := NewDeadLetters(filepath.Join(t.TempDir(), "notes-sync.failed"))
+	storage, _ := NewMemoryStorage()
+	parser := NewParser(config)
+	handler := &DefaultEventHandler{config: config, parser: parser, storage: storage, logger: testLogger, failed: failed}
+
+	watched := filepath.Join(tmpDir, "watched.md")
+	scanned := filepath.Join(tmpDir, "scanned.md")
+	for _, path := range []string{watched, scanned} {
+		if err := os.WriteFile(path, []byte("---\ninvalid: yaml:\n---\nbody\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler.Handle(WatcherEvent{EventType: "CREATE", Path: watched})
+	if _, err := NewScanner(config, nil, parser, storage, testLogger, failed).Reconcile(); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	letters, err := failed.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	var paths []string
+	for _, letter := range letters {
+		if !strings.Contains(letter.Error, "frontmatter") {
+			t.Errorf("expected a frontmatter error for %s, got %q", letter.Path, letter.Error)
+		}
+		paths = append(paths, letter.Path)
+	}
+	// Reconcile records the watched note again
+	if !slices.Equal(paths, []string{watched, scanned}) {
+		t.Fatalf("expected failures for %s and %s, got %+v", watched, scanned, letters)
+	}
+	if files, _ := storage.ListFiles(); len(files) != 0 {
+		t.Errorf("expected malformed notes not to be stored, got %+v", files)
+	}
+
+	// Retrying keeps them until the frontmatter is fixed
+	result, err := failed.Retry(config, parser, storage)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if result.Recovered != 0 || result.Failed != 2 {
+		t.Errorf("expected both notes to fail again, got %+v", result)
+	}
+	if err := os.WriteFile(watched, []byte("---\ntitle: Fixed\n---\nbody\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = failed.Retry(config, parser, storage)
+	if err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if result.Recovered != 1 || result.Failed != 1 {
+		t.Errorf("expected the fixed note to be recovered, got %+v", result)
+	}
 }
@@ -6,6 +6,7 @@ require (
 	github.com/urfave/cli-altsrc/v3 v3.1.0
 	github.com/urfave/cli/v3 v3.4.1
 	go.etcd.io/etcd/client/v3 v3.5.17
+	golang.org/x/crypto v0.21.0
 )
 
 require (
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -15,12 +30,16 @@ import (
 	"github.com/urfave/cli-altsrc/v3/yaml"
 	"github.com/urfave/cli/v3"
 	etcd "go.etcd.io/etcd/client/v3"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type config struct {
 	EtcdEndpoint   string
 	EtcdUser       string
 	EtcdPassword   string
+	EtcdCA         string
+	EtcdCert       string
+	EtcdKey        string
 	EtcdRootKey    string
 	TargetIP       string
 	DomainTemplate string
@@ -29,12 +48,39 @@ type config struct {
 	SlugLength     int
 }
 
-func configFromCmd(cmd *cli.Command) config {
+// healthFlags configure Traefik's health check of a run app
+var healthFlags = []cli.Flag{
+	&cli.StringFlag{Name: "health-path", Value: "/", Usage: "let Traefik health check the app at this path and stop routing to it while it is down"},
+	&cli.StringFlag{Name: "health-interval", Value: "10s", Usage: "how often Traefik runs the health check (enables it at the default path)"},
+}
+
+// healthCheckFromCmd returns the health check set by healthFlags. Setting either flag enables it,
+// the other keeps its default.
+func healthCheckFromCmd(cmd *cli.Command) (healthCheck, error) {
+	if !cmd.IsSet("health-path") && !cmd.IsSet("health-interval") {
+		return healthCheck{}, nil
+	}
+	health := healthCheck{Path: cmd.String("health-path"), Interval: cmd.String("health-interval")}
+	if !strings.HasPrefix(health.Path, "/") {
+		return healthCheck{}, fmt.Errorf("health-path must start with /")
+	}
+	if _, err := time.ParseDuration(health.Interval); err != nil {
+		return healthCheck{}, fmt.Errorf("invalid health-interval: %w", err)
+	}
+	return health, nil
+}
+
+// configFromCmd loads the config every subcommand runs with. The domain template is validated here, so
+// no subcommand formats a bad one.
+func configFromCmd(cmd *cli.Command) (config, error) {
 	root := cmd.Root()
-	return config{
+	cfg := config{
 		EtcdEndpoint:   root.String("etcd-endpoint"),
 		EtcdUser:       root.String("etcd-user"),
 		EtcdPassword:   root.String("etcd-password"),
+		EtcdCA:         root.String("etcd-ca"),
+		EtcdCert:       root.String("etcd-cert"),
+		EtcdKey:        root.String("etcd-key"),
 		EtcdRootKey:    root.String("etcd-root-key"),
 		TargetIP:       root.String("target-ip"),
 		DomainTemplate: root.String("domain-template"),
@@ -42,6 +88,10 @@ func configFromCmd(cmd *cli.Command) config {
 		KeyPrefix:      root.String("key-prefix"),
 		SlugLength:     root.Int("slug-length"),
 	}
+	if err := validateDomainTemplate(cfg.DomainTemplate); err != nil {
+		return config{}, err
+	}
+	return cfg, nil
 }
 
 func main() {
@@ -70,7 +120,7 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:  "etcd-endpoint",
-				Usage: "etcd server endpoint",
+				Usage: "etcd server endpoint, or a comma-separated list of cluster members",
 				Value: "localhost:2379",
 				Sources: cli.NewValueSourceChain(
 					cli.EnvVar("SERVE_ETCD_ENDPOINT"),
@@ -93,6 +143,30 @@ func main() {
 					yaml.YAML("serve.etcd_password", configFileSourcer),
 				),
 			},
+			&cli.StringFlag{
+				Name:  "etcd-ca",
+				Usage: "CA certificate file to verify etcd with (enables TLS)",
+				Sources: cli.NewValueSourceChain(
+					cli.EnvVar("SERVE_ETCD_CA"),
+					yaml.YAML("serve.etcd_ca", configFileSourcer),
+				),
+			},
+			&cli.StringFlag{
+				Name:  "etcd-cert",
+				Usage: "client certificate file for etcd (enables TLS, requires etcd-key)",
+				Sources: cli.NewValueSourceChain(
+					cli.EnvVar("SERVE_ETCD_CERT"),
+					yaml.YAML("serve.etcd_cert", configFileSourcer),
+				),
+			},
+			&cli.StringFlag{
+				Name:  "etcd-key",
+				Usage: "client key file for etcd (requires etcd-cert)",
+				Sources: cli.NewValueSourceChain(
+					cli.EnvVar("SERVE_ETCD_KEY"),
+					yaml.YAML("serve.etcd_key", configFileSourcer),
+				),
+			},
 			&cli.StringFlag{
 				Name:  "etcd-root-key",
 				Usage: "etcd key prefix for Traefik (e.g. traefik-vortex, traefik-andromeda)",
@@ -155,64 +229,137 @@ func main() {
 			{
 				Name:      "run",
 				Aliases:   []string{"start"},
-				Usage:     "Add Traefik config for a local app",
-				ArgsUsage: "<port>",
-				Flags: []cli.Flag{
+				Usage:     "Add Traefik config for a local app, load balanced when given several ports",
+				ArgsUsage: "<port> [port...]",
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{Name: "slug", Required: false, Usage: "Name of the app, e.g. myapp (auto-generated if not provided)"},
 					&cli.BoolFlag{Name: "detach", Aliases: []string{"d"}, Usage: "run in background (don't block; don't remove config on exit)"},
-				},
+					&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Usage: "replace an existing app with the same slug"},
+					&cli.BoolFlag{Name: "open", Aliases: []string{"o"}, Usage: "open the app's URL in the default browser"},
+					&cli.BoolFlag{Name: "copy", Usage: "copy the app's URL to the clipboard"},
+					&cli.StringSliceFlag{Name: "alias", Usage: "additional hostname for the app; a full domain or a name for the domain template (repeatable)"},
+					&cli.StringSliceFlag{Name: "basic-auth", Usage: "require HTTP basic auth, as user:password (repeatable)"},
+					&cli.StringSliceFlag{Name: "ip-allow", Usage: "only allow clients from this IP or CIDR range, e.g. 1.2.3.0/24 (repeatable)"},
+					&cli.StringFlag{Name: "scheme", Value: "http", Usage: "scheme the app serves, http or https (https backends may use self-signed certificates)"},
+				}, healthFlags...),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					if cmd.NArg() != 1 {
-						return fmt.Errorf("exactly one argument (port) is required")
+					if cmd.NArg() < 1 {
+						return fmt.Errorf("at least one argument (port) is required")
+					}
+
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
+
+					opts := appOptions{Scheme: cmd.String("scheme")}
+					if opts.Scheme != "http" && opts.Scheme != "https" {
+						return fmt.Errorf("scheme must be http or https, got %q", opts.Scheme)
+					}
+
+					health, err := healthCheckFromCmd(cmd)
+					if err != nil {
+						return err
 					}
+					opts.Health = health
 
-					cfg := configFromCmd(cmd)
-					if cfg.DomainTemplate == "" {
-						return fmt.Errorf("domain-template is required (set in config file, env SERVE_DOMAIN_TEMPLATE, or --domain-template)")
+					for _, credentials := range cmd.StringSlice("basic-auth") {
+						user, err := htpasswdEntry(credentials)
+						if err != nil {
+							return err
+						}
+						opts.BasicAuth = append(opts.BasicAuth, user)
+					}
+					for _, source := range cmd.StringSlice("ip-allow") {
+						sourceRange, err := parseSourceRange(source)
+						if err != nil {
+							return err
+						}
+						opts.IPAllow = append(opts.IPAllow, sourceRange)
 					}
 
-					port := cmd.Args().Get(0)
+					// Normalize ports: remove colon if present
+					var ports []string
+					for _, port := range cmd.Args().Slice() {
+						ports = append(ports, strings.TrimPrefix(port, ":"))
+					}
 					appName := cmd.String("slug")
 					if appName == "" {
 						appName = cmd.Root().String("slug")
 					}
 
+					activeServices, err := getActiveServices(cfg)
+					if err != nil {
+						return fmt.Errorf("could not get active services: %w", err)
+					}
+					exists := func(slug string) bool {
+						_, ok := activeServices[slug]
+						return ok
+					}
+
 					// Generate random app name if not provided
+					replace := false
 					if appName == "" {
-						length := cfg.SlugLength
-						if length < 1 {
-							length = 3
+						appName, err = generateUniqueSlug(cfg.SlugLength, exists)
+						if err != nil {
+							return err
 						}
-						appName = generateRandomSlug(length)
 						fmt.Printf("Generated app name: %s\n", appName)
+					} else if exists(appName) {
+						if !cmd.Bool("force") {
+							return fmt.Errorf("app %s already exists (use --force to replace it)", appName)
+						}
+						replace = true
 					}
 
-					// Normalize port: remove colon if present
-					normalizedPort := strings.TrimPrefix(port, ":")
-
-					activeServices, err := getActiveServices(cfg)
-					if err != nil {
-						return fmt.Errorf("could not get active services: %w", err)
-					}
-					for appName, port := range activeServices {
-						if port == normalizedPort {
-							return fmt.Errorf("port %s is already in use by app %s", normalizedPort, appName)
+					for name, svc := range activeServices {
+						if replace && name == appName {
+							continue
+						}
+						for _, port := range ports {
+							if slices.Contains(svc.Ports, port) {
+								return fmt.Errorf("port %s is already in use by app %s", port, name)
+							}
 						}
 					}
 
 					domain := fmt.Sprintf(cfg.DomainTemplate, appName)
+					domains := []string{domain}
+					for _, alias := range cmd.StringSlice("alias") {
+						domains = append(domains, aliasDomain(cfg, alias))
+					}
 					resName := resourceName(cfg, appName)
-
-					if err := createTraefikConfig(cfg, appName, domain, port); err != nil {
+					if replace {
+						fmt.Printf("Replacing existing app: %s\n", appName)
+					}
+					if err := createTraefikConfig(cfg, appName, domains, ports, opts, replace); err != nil {
 						return fmt.Errorf("failed to create traefik config: %w", err)
 					}
+					appURL := "https://" + domain
+					fmt.Printf("\n    %s\n\n", appURL)
+					for _, alias := range domains[1:] {
+						fmt.Printf("Alias: https://%s\n", alias)
+					}
+					// The app is up already, so failing to open or copy only warns
+					if cmd.Bool("copy") {
+						if err := copyToClipboard(appURL); err != nil {
+							fmt.Printf("Warning: could not copy URL: %v\n", err)
+						} else {
+							fmt.Println("URL copied to clipboard.")
+						}
+					}
+					if cmd.Bool("open") {
+						if err := openBrowser(appURL); err != nil {
+							fmt.Printf("Warning: could not open browser: %v\n", err)
+						}
+					}
 
 					if cmd.Bool("detach") {
-						fmt.Printf("Service available at https://%s (forwarding to :%s)\n", domain, normalizedPort)
+						fmt.Printf("Service available at https://%s (forwarding to %s)\n", domain, formatPorts(ports))
 						return nil
 					}
 
-					fmt.Printf("Serving at https://%s (forwarding to :%s). Press Ctrl+C to stop and remove from Traefik.\n", domain, normalizedPort)
+					fmt.Printf("Serving at https://%s (forwarding to %s). Press Ctrl+C to stop and remove from Traefik.\n", domain, formatPorts(ports))
 					sigCh := make(chan os.Signal, 1)
 					signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 					<-sigCh
@@ -223,6 +370,50 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "redirect",
+				Usage:     "Add a Traefik route that redirects a slug to another URL",
+				ArgsUsage: "<slug> <target-url>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Usage: "replace an existing app or redirect with the same slug"},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					if cmd.NArg() != 2 {
+						return fmt.Errorf("exactly two arguments (slug and target url) are required")
+					}
+
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
+
+					appName := cmd.Args().Get(0)
+					target := cmd.Args().Get(1)
+					u, err := url.Parse(target)
+					if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+						return fmt.Errorf("target must be an absolute http(s) url, got %q", target)
+					}
+
+					activeServices, err := getActiveServices(cfg)
+					if err != nil {
+						return fmt.Errorf("could not get active services: %w", err)
+					}
+					_, replace := activeServices[appName]
+					if replace {
+						if !cmd.Bool("force") {
+							return fmt.Errorf("app %s already exists (use --force to replace it)", appName)
+						}
+						fmt.Printf("Replacing existing app: %s\n", appName)
+					}
+
+					domain := fmt.Sprintf(cfg.DomainTemplate, appName)
+					if err := createRedirectConfig(cfg, appName, domain, target, replace); err != nil {
+						return fmt.Errorf("failed to create traefik config: %w", err)
+					}
+					fmt.Printf("Redirecting https://%s to %s\n", domain, target)
+					return nil
+				},
+			},
 			{
 				Name:      "stop",
 				Usage:     "Remove a local app's Traefik config",
@@ -232,7 +423,10 @@ func main() {
 						return fmt.Errorf("exactly one argument (slug or port) is required")
 					}
 
-					cfg := configFromCmd(cmd)
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
 					identifier := cmd.Args().Get(0)
 					var resourceNameForDelete string
 					if isDigits(identifier) {
@@ -264,7 +458,10 @@ func main() {
 				Usage:     "Remove all Traefik config for services managed by this utility (key prefix)",
 				ArgsUsage: " ",
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					cfg := configFromCmd(cmd)
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
 					activeServices, err := getActiveServices(cfg)
 					if err != nil {
 						return fmt.Errorf("could not get active services: %w", err)
@@ -283,32 +480,67 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "prune",
+				Usage:     "Remove orphaned Traefik config and apps whose local ports are all closed",
+				ArgsUsage: " ",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}, Usage: "only show what would be removed"},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
+					dryRun := cmd.Bool("dry-run")
+					pruned, err := pruneTraefikConfig(cfg, dryRun)
+					for _, entry := range pruned {
+						if dryRun {
+							fmt.Printf("Would remove %s\n", entry.Reason)
+						} else {
+							fmt.Printf("Removed %s\n", entry.Reason)
+						}
+					}
+					if err != nil {
+						return err
+					}
+					if len(pruned) == 0 {
+						fmt.Println("Nothing to prune.")
+					} else if !dryRun {
+						fmt.Printf("Pruned %d item(s).\n", len(pruned))
+					}
+					return nil
+				},
+			},
 			{
 				Name:    "status",
 				Aliases: []string{"ls", "list"},
 				Usage:   "Show currently active services",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "wide", Aliases: []string{"w"}, Usage: "don't truncate slugs and domains"},
+					&cli.BoolFlag{Name: "json", Usage: "print services as JSON"},
+				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
-					cfg := configFromCmd(cmd)
+					cfg, err := configFromCmd(cmd)
+					if err != nil {
+						return err
+					}
 					activeServices, err := getActiveServices(cfg)
 					if err != nil {
 						return fmt.Errorf("could not get active services: %w", err)
 					}
-					if len(activeServices) == 0 {
+					if len(activeServices) == 0 && !cmd.Bool("json") {
 						fmt.Println("No active services found.")
 						return nil
 					}
 
-					fmt.Printf("%-20s %-40s %s\n", "SLUG", "DOMAIN", "PORT")
-					fmt.Printf("%-20s %-40s %s\n", strings.Repeat("-", 20), strings.Repeat("-", 40), "----")
-					for appName, port := range activeServices {
-						var domainStr string
-						domain := fmt.Sprintf(cfg.DomainTemplate, appName)
-						domainStr = fmt.Sprintf("https://%s", domain)
-						fmt.Printf("%-20s %-40s :%s\n",
-							truncateString(appName, 20),
-							truncateString(domainStr, 40),
-							port)
+					statuses := serviceStatuses(cfg, activeServices)
+					if cmd.Bool("json") {
+						enc := json.NewEncoder(os.Stdout)
+						enc.SetIndent("", "  ")
+						return enc.Encode(statuses)
 					}
+					printStatusTable(os.Stdout, statuses, cmd.Bool("wide"))
 					return nil
 				},
 			},
@@ -328,8 +560,111 @@ func etcdRoot(cfg config) string {
 	return cfg.EtcdRootKey
 }
 
-// getActiveServices scans etcd for traefik routers and services and returns a map of app_name -> port.
-func getActiveServices(cfg config) (map[string]string, error) {
+// activeService is an app exposed through Traefik: its backend ports and every hostname routed to it.
+// Redirects have no ports, Redirect holds their target URL instead. HealthPath is set when Traefik health checks the app.
+type activeService struct {
+	Ports      []string
+	Domains    []string
+	Redirect   string
+	Scheme     string
+	HealthPath string
+}
+
+// healthCheck is Traefik's health check of an app's servers. A zero value means no health check.
+type healthCheck struct {
+	Path     string
+	Interval string
+}
+
+// appOptions are the optional parts of an app's Traefik config. The zero value is a plain http app.
+type appOptions struct {
+	Scheme    string      // http (default) or https
+	Health    healthCheck // health check of the app's servers
+	BasicAuth []string    // htpasswd entries (user:bcrypt-hash) allowed through basic auth
+	IPAllow   []string    // client IP ranges allowed to reach the app
+}
+
+// serviceStatus is an app as shown by status, in the table and as JSON.
+type serviceStatus struct {
+	Slug     string   `json:"slug"`
+	Domains  []string `json:"domains"`
+	Backends []string `json:"backends,omitempty"`
+	Redirect string   `json:"redirect,omitempty"`
+	Health   string   `json:"health"`
+}
+
+// serviceStatuses describes every active service for status, sorted by slug. Apps without explicit
+// domains show the one from the domain template, backends are the URLs Traefik forwards to.
+func serviceStatuses(cfg config, services map[string]activeService) []serviceStatus {
+	statuses := make([]serviceStatus, 0, len(services))
+	for _, slug := range slices.Sorted(maps.Keys(services)) {
+		svc := services[slug]
+		status := serviceStatus{
+			Slug:     slug,
+			Domains:  svc.Domains,
+			Redirect: svc.Redirect,
+			Health:   healthStatus(cfg, svc),
+		}
+		if len(status.Domains) == 0 {
+			status.Domains = []string{fmt.Sprintf(cfg.DomainTemplate, slug)}
+		}
+		for _, port := range svc.Ports {
+			status.Backends = append(status.Backends, fmt.Sprintf("%s://%s:%s", cmp.Or(svc.Scheme, "http"), cfg.TargetIP, port))
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// printStatusTable prints one row per domain of each service. Slugs and domains are cut to 20 and 40
+// characters unless wide is set, then columns grow to fit.
+func printStatusTable(w io.Writer, statuses []serviceStatus, wide bool) {
+	slugWidth, domainWidth, healthWidth := 20, 40, 10
+	if wide {
+		slugWidth, domainWidth = len("SLUG"), len("DOMAIN")
+		for _, status := range statuses {
+			slugWidth = max(slugWidth, len(status.Slug))
+			for _, domain := range status.Domains {
+				domainWidth = max(domainWidth, len("https://"+domain))
+			}
+		}
+	}
+	cut := func(s string, maxLen int) string {
+		if wide {
+			return s
+		}
+		return truncateString(s, maxLen)
+	}
+
+	fmt.Fprintf(w, "%-*s %-*s %-*s %s\n", slugWidth, "SLUG", domainWidth, "DOMAIN", healthWidth, "HEALTH", "BACKEND")
+	fmt.Fprintf(w, "%s %s %s %s\n", strings.Repeat("-", slugWidth), strings.Repeat("-", domainWidth), strings.Repeat("-", healthWidth), "-------")
+	for _, status := range statuses {
+		backend := strings.Join(status.Backends, ", ")
+		if status.Redirect != "" {
+			backend = "redirect -> " + status.Redirect
+		}
+		slug, health := cut(status.Slug, slugWidth), status.Health
+		for i, domain := range status.Domains {
+			if i > 0 {
+				slug, health, backend = "", "", ""
+			}
+			line := fmt.Sprintf("%-*s %-*s %-*s %s",
+				slugWidth, slug,
+				domainWidth, cut("https://"+domain, domainWidth),
+				healthWidth, health,
+				backend)
+			fmt.Fprintln(w, strings.TrimRight(line, " "))
+		}
+	}
+}
+
+// redirectService is Traefik's built-in service for routers that never reach a backend.
+const redirectService = "noop@internal"
+
+var hostRulePattern = regexp.MustCompile("Host\\(`([^`]+)`\\)")
+
+// getActiveServices scans etcd for traefik routers and services and returns a map of app_name -> service.
+func getActiveServices(cfg config) (map[string]activeService, error) {
 	client, err := createEtcdClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create etcd client: %w", err)
@@ -348,11 +683,13 @@ func getActiveServices(cfg config) (map[string]string, error) {
 		return nil, fmt.Errorf("failed to list etcd keys: %w", err)
 	}
 
-	services := make(map[string]string)
+	services := make(map[string]activeService)
 
 	// Extract unique router names
 	routerNames := make(map[string]bool)
+	routerFields := make(map[string]string)
 	for _, kv := range resp.Kvs {
+		routerFields[string(kv.Key)] = string(kv.Value)
 		key := string(kv.Key)
 
 		// Remove prefix {root}/http/routers/ and get first part
@@ -377,31 +714,204 @@ func getActiveServices(cfg config) (map[string]string, error) {
 	// For each router, get the service and extract port
 	for routerName := range routerNames {
 		// Get service name
-		svcResp, err := client.Get(ctx, fmt.Sprintf("%s/http/routers/%s/service", root, routerName))
-		if err != nil || len(svcResp.Kvs) == 0 {
+		serviceName, ok := routerFields[routersPrefix+routerName+"/service"]
+		if !ok {
+			continue
+		}
+		if serviceName == redirectService {
+			middleware := redirectMiddlewareName(routerName)
+			if routerFields[routersPrefix+routerName+"/middlewares/0"] != middleware {
+				continue
+			}
+			replacementKey := fmt.Sprintf("%s/http/middlewares/%s/redirectregex/replacement", root, middleware)
+			replacementResp, err := client.Get(ctx, replacementKey)
+			if err != nil || len(replacementResp.Kvs) == 0 {
+				continue
+			}
+			var domains []string
+			for _, m := range hostRulePattern.FindAllStringSubmatch(routerFields[routersPrefix+routerName+"/rule"], -1) {
+				domains = append(domains, m[1])
+			}
+			services[slugFromResourceName(cfg, routerName)] = activeService{
+				Domains:  domains,
+				Redirect: string(replacementResp.Kvs[0].Value),
+			}
+			continue
+		}
+		// Alias routers share the service of their app and are listed with it
+		if serviceName != routerName {
 			continue
 		}
-		serviceName := string(svcResp.Kvs[0].Value)
 
-		// Get service URL
-		serviceURLKey := fmt.Sprintf("%s/http/services/%s/loadbalancer/servers/0/url", root, serviceName)
-		serviceResp, err := client.Get(ctx, serviceURLKey)
-		if err != nil || len(serviceResp.Kvs) == 0 {
+		// Get service URLs and health check
+		loadBalancerPrefix := fmt.Sprintf("%s/http/services/%s/loadbalancer/", root, serviceName)
+		serversPrefix := loadBalancerPrefix + "servers/"
+		serviceResp, err := client.Get(ctx, loadBalancerPrefix, etcd.WithPrefix())
+		if err != nil {
+			continue
+		}
+		serviceFields := make(map[string]string)
+		for _, kv := range serviceResp.Kvs {
+			serviceFields[string(kv.Key)] = string(kv.Value)
+		}
+		ports := serverPorts(serversPrefix, serviceFields)
+		if len(ports) == 0 {
 			continue
 		}
 
-		serviceURL := string(serviceResp.Kvs[0].Value)
-		u, _ := url.Parse(serviceURL)
 		slug := slugFromResourceName(cfg, routerName)
-		services[slug] = u.Port()
+		var domains []string
+		for _, name := range routersForService(routersPrefix, routerFields, serviceName) {
+			for _, m := range hostRulePattern.FindAllStringSubmatch(routerFields[routersPrefix+name+"/rule"], -1) {
+				domains = append(domains, m[1])
+			}
+		}
+		scheme := "http"
+		if u, err := url.Parse(serviceFields[serversPrefix+"0/url"]); err == nil && u.Scheme != "" {
+			scheme = u.Scheme
+		}
+		services[slug] = activeService{
+			Ports:      ports,
+			Domains:    domains,
+			Scheme:     scheme,
+			HealthPath: serviceFields[loadBalancerPrefix+"healthcheck/path"],
+		}
 	}
 
 	return services, nil
 }
 
+// serverPorts returns the ports of a service's load balancer servers under serversPrefix
+// ({root}/http/services/{name}/loadbalancer/servers/), in server order.
+func serverPorts(serversPrefix string, serviceFields map[string]string) []string {
+	type server struct {
+		index int
+		port  string
+	}
+	var servers []server
+	for key, value := range serviceFields {
+		index, ok := strings.CutSuffix(strings.TrimPrefix(key, serversPrefix), "/url")
+		if !ok || !isDigits(index) {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.Atoi(index)
+		servers = append(servers, server{n, u.Port()})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].index < servers[j].index })
+	ports := make([]string, len(servers))
+	for i, s := range servers {
+		ports[i] = s.port
+	}
+	return ports
+}
+
+// formatPorts lists ports for display, e.g. ":3000, :3001".
+func formatPorts(ports []string) string {
+	formatted := make([]string, len(ports))
+	for i, port := range ports {
+		formatted[i] = ":" + port
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// routersForService returns the names of routers under routersPrefix whose service is serviceName,
+// the app's own router first followed by its aliases in name order.
+func routersForService(routersPrefix string, routerFields map[string]string, serviceName string) []string {
+	var names []string
+	for key, value := range routerFields {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(key, routersPrefix), "/service")
+		if !ok || strings.Contains(name, "/") || value != serviceName {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == serviceName) != (names[j] == serviceName) {
+			return names[i] == serviceName
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// validateDomainTemplate checks that the domain template has exactly one %s for the slug and no other
+// verbs, so a bad template fails before a broken Host rule ends up in etcd.
+func validateDomainTemplate(template string) error {
+	if template == "" {
+		return fmt.Errorf("domain-template is required (set in config file, env SERVE_DOMAIN_TEMPLATE, or --domain-template)")
+	}
+	verbs := strings.ReplaceAll(template, "%%", "")
+	if strings.Count(verbs, "%s") != 1 || strings.Count(verbs, "%") != 1 {
+		return fmt.Errorf("domain-template must contain exactly one %%s for the slug and no other verbs, got %q", template)
+	}
+	if strings.ContainsAny(template, " /:`") {
+		return fmt.Errorf("domain-template must be a bare hostname like %%s.example.com, got %q", template)
+	}
+	return nil
+}
+
+// aliasDomain expands an alias to a hostname: full domains are used as is, bare names go through the domain template.
+func aliasDomain(cfg config, alias string) string {
+	if strings.Contains(alias, ".") {
+		return alias
+	}
+	return fmt.Sprintf(cfg.DomainTemplate, alias)
+}
+
+// etcdEndpoints splits a comma-separated etcd endpoint setting into its endpoints.
+func etcdEndpoints(setting string) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(setting, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// etcdTLSConfig builds the TLS config for etcd from the CA and client certificate files. It returns nil,
+// a plaintext connection, when none of them is set.
+func etcdTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.EtcdCA == "" && cfg.EtcdCert == "" && cfg.EtcdKey == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.EtcdCA != "" {
+		pem, err := os.ReadFile(cfg.EtcdCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read etcd CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in etcd CA %s", cfg.EtcdCA)
+		}
+	}
+	if cfg.EtcdCert != "" || cfg.EtcdKey != "" {
+		if cfg.EtcdCert == "" || cfg.EtcdKey == "" {
+			return nil, fmt.Errorf("etcd-cert and etcd-key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.EtcdCert, cfg.EtcdKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load etcd client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// createEtcdClient connects to every configured etcd endpoint and checks that at least one of them
+// answers, so a single node outage doesn't fail commands and a full one fails with a clear error.
 func createEtcdClient(cfg config) (*etcd.Client, error) {
+	endpoints := etcdEndpoints(cfg.EtcdEndpoint)
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcd-endpoint is required")
+	}
 	clientCfg := etcd.Config{
-		Endpoints:   []string{cfg.EtcdEndpoint},
+		Endpoints:   endpoints,
 		DialTimeout: 5 * time.Second,
 	}
 
@@ -410,10 +920,94 @@ func createEtcdClient(cfg config) (*etcd.Client, error) {
 		clientCfg.Password = cfg.EtcdPassword
 	}
 
-	return etcd.New(clientCfg)
+	tlsConfig, err := etcdTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	clientCfg.TLS = tlsConfig
+
+	client, err := etcd.New(clientCfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to etcd (tried %s): %w", strings.Join(endpoints, ", "), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientCfg.DialTimeout)
+	defer cancel()
+	if _, err := client.Get(ctx, etcdRoot(cfg), etcd.WithCountOnly()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not reach etcd (tried %s): %w", strings.Join(endpoints, ", "), err)
+	}
+	return client, nil
+}
+
+// traefikConfigKeys builds the router and service keys for an app. The first domain gets the app's own
+// router, every further domain an alias router ({res_name}-alias{n}) pointing at the same service.
+// Each port becomes a server of the service, which Traefik round-robins between. With a health check
+// Traefik skips servers that fail it. https backends get a servers transport ({res_name}) that skips
+// certificate verification, since local apps mostly use self-signed certificates. Basic auth and IP
+// allowlists become middlewares ({res_name}-auth, {res_name}-ipallow) attached to every router.
+func traefikConfigKeys(cfg config, appName string, domains []string, ports []string, opts appOptions) (routerKeys, serviceKeys, middlewareKeys map[string]string) {
+	resName := resourceName(cfg, appName)
+	root := etcdRoot(cfg)
+
+	// Create middleware configuration
+	middlewareKeys = make(map[string]string)
+	var middlewares []string
+	if len(opts.IPAllow) > 0 {
+		name := ipAllowMiddlewareName(resName)
+		for i, sourceRange := range opts.IPAllow {
+			middlewareKeys[fmt.Sprintf("%s/http/middlewares/%s/ipallowlist/sourcerange/%d", root, name, i)] = sourceRange
+		}
+		middlewares = append(middlewares, name)
+	}
+	if len(opts.BasicAuth) > 0 {
+		name := authMiddlewareName(resName)
+		for i, user := range opts.BasicAuth {
+			middlewareKeys[fmt.Sprintf("%s/http/middlewares/%s/basicauth/users/%d", root, name, i)] = user
+		}
+		middlewares = append(middlewares, name)
+	}
+
+	// Create router configuration
+	routerKeys = make(map[string]string)
+	for i, domain := range domains {
+		routerName := resName
+		if i > 0 {
+			routerName = fmt.Sprintf("%s-alias%d", resName, i)
+		}
+		hostRule := fmt.Sprintf("Host(`%s`)", domain)
+		routerKeys[fmt.Sprintf("%s/http/routers/%s/entrypoints", root, routerName)] = "https"
+		routerKeys[fmt.Sprintf("%s/http/routers/%s/tls", root, routerName)] = "true"
+		routerKeys[fmt.Sprintf("%s/http/routers/%s/tls/certresolver", root, routerName)] = cfg.CertResolver
+		routerKeys[fmt.Sprintf("%s/http/routers/%s/rule", root, routerName)] = hostRule
+		routerKeys[fmt.Sprintf("%s/http/routers/%s/service", root, routerName)] = resName
+		for j, middleware := range middlewares {
+			routerKeys[fmt.Sprintf("%s/http/routers/%s/middlewares/%d", root, routerName, j)] = middleware
+		}
+	}
+
+	// Create service configuration
+	scheme := cmp.Or(opts.Scheme, "http")
+	serviceKeys = make(map[string]string)
+	for i, port := range ports {
+		// Normalize port: remove colon if present, then ensure it has colon for URL
+		serviceURL := fmt.Sprintf("%s://%s:%s", scheme, cfg.TargetIP, strings.TrimPrefix(port, ":"))
+		serviceKeys[fmt.Sprintf("%s/http/services/%s/loadbalancer/servers/%d/url", root, resName, i)] = serviceURL
+	}
+	if scheme == "https" {
+		serviceKeys[fmt.Sprintf("%s/http/serverstransports/%s/insecureskipverify", root, resName)] = "true"
+		serviceKeys[fmt.Sprintf("%s/http/services/%s/loadbalancer/serverstransport", root, resName)] = resName
+	}
+	if opts.Health.Path != "" {
+		serviceKeys[fmt.Sprintf("%s/http/services/%s/loadbalancer/healthcheck/path", root, resName)] = opts.Health.Path
+		serviceKeys[fmt.Sprintf("%s/http/services/%s/loadbalancer/healthcheck/interval", root, resName)] = opts.Health.Interval
+	}
+	return routerKeys, serviceKeys, middlewareKeys
 }
 
-func createTraefikConfig(cfg config, appName, domain string, port string) error {
+// createTraefikConfig stores an app's config in etcd. With replace, whatever is left of the app's
+// old config is deleted in the same transaction.
+func createTraefikConfig(cfg config, appName string, domains []string, ports []string, opts appOptions, replace bool) error {
 	client, err := createEtcdClient(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to create etcd client: %w", err)
@@ -423,44 +1017,238 @@ func createTraefikConfig(cfg config, appName, domain string, port string) error
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Normalize port: remove colon if present, then ensure it has colon for URL
-	normalizedPort := strings.TrimPrefix(port, ":")
-	portWithColon := ":" + normalizedPort
+	var existing []string
+	if replace {
+		if existing, err = appKeys(ctx, client, cfg, resourceName(cfg, appName)); err != nil {
+			return err
+		}
+	}
+
+	routerKeys, serviceKeys, middlewareKeys := traefikConfigKeys(cfg, appName, domains, ports, opts)
+
+	// Store keys in etcd: service and middlewares first, then routers (deterministic order, one transaction)
+	return putKeys(ctx, client, existing, serviceKeys, middlewareKeys, routerKeys)
+}
+
+// probeHealth requests path on a local port the way Traefik's health check does: any 2xx or 3xx is healthy.
+// Like the servers transport of https apps, it does not verify the app's certificate.
+func probeHealth(scheme, targetIP, port, path string) bool {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(fmt.Sprintf("%s://%s:%s%s", cmp.Or(scheme, "http"), targetIP, port, path))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+// healthStatus probes every server of a health checked app for status: "healthy", "unhealthy", or
+// "n/m healthy" when only some servers pass. Apps without a health check show "-".
+func healthStatus(cfg config, svc activeService) string {
+	if svc.HealthPath == "" || len(svc.Ports) == 0 {
+		return "-"
+	}
+	healthy := 0
+	for _, port := range svc.Ports {
+		if probeHealth(svc.Scheme, cfg.TargetIP, port, svc.HealthPath) {
+			healthy++
+		}
+	}
+	switch healthy {
+	case len(svc.Ports):
+		return "healthy"
+	case 0:
+		return "unhealthy"
+	}
+	return fmt.Sprintf("%d/%d healthy", healthy, len(svc.Ports))
+}
+
+// redirectMiddlewareName is the name of the redirectregex middleware of a redirect router.
+func redirectMiddlewareName(resName string) string {
+	return resName + "-redirect"
+}
 
+// authMiddlewareName is the name of the basicauth middleware of an app.
+func authMiddlewareName(resName string) string {
+	return resName + "-auth"
+}
+
+// ipAllowMiddlewareName is the name of the ipallowlist middleware of an app.
+func ipAllowMiddlewareName(resName string) string {
+	return resName + "-ipallow"
+}
+
+// htpasswdEntry turns user:password into the user:bcrypt-hash entry Traefik's basicauth expects,
+// so the plain password never reaches etcd.
+func htpasswdEntry(credentials string) (string, error) {
+	user, password, ok := strings.Cut(credentials, ":")
+	if !ok || user == "" || password == "" {
+		return "", fmt.Errorf("basic-auth must be user:password, got %q", credentials)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password for %s: %w", user, err)
+	}
+	return user + ":" + string(hash), nil
+}
+
+// parseSourceRange validates an IP allowlist entry, accepting a CIDR range or a single IP.
+func parseSourceRange(source string) (string, error) {
+	if prefix, err := netip.ParsePrefix(source); err == nil {
+		return prefix.String(), nil
+	}
+	if addr, err := netip.ParseAddr(source); err == nil {
+		return addr.String(), nil
+	}
+	return "", fmt.Errorf("ip-allow must be an IP or CIDR range, got %q", source)
+}
+
+// redirectConfigKeys builds the router and middleware keys for a redirect: a router for the domain that
+// sends every request to target through a redirectregex middleware, with no backend service.
+func redirectConfigKeys(cfg config, appName string, domain string, target string) (routerKeys, middlewareKeys map[string]string) {
 	resName := resourceName(cfg, appName)
-	serviceURL := fmt.Sprintf("http://%s%s", cfg.TargetIP, portWithColon)
-	hostRule := fmt.Sprintf("Host(`%s`)", domain)
+	middleware := redirectMiddlewareName(resName)
 	root := etcdRoot(cfg)
 
-	// Create router configuration
-	routerKeys := map[string]string{
+	routerKeys = map[string]string{
 		fmt.Sprintf("%s/http/routers/%s/entrypoints", root, resName):      "https",
 		fmt.Sprintf("%s/http/routers/%s/tls", root, resName):              "true",
 		fmt.Sprintf("%s/http/routers/%s/tls/certresolver", root, resName): cfg.CertResolver,
-		fmt.Sprintf("%s/http/routers/%s/rule", root, resName):             hostRule,
-		fmt.Sprintf("%s/http/routers/%s/service", root, resName):          resName,
+		fmt.Sprintf("%s/http/routers/%s/rule", root, resName):             fmt.Sprintf("Host(`%s`)", domain),
+		fmt.Sprintf("%s/http/routers/%s/service", root, resName):          redirectService,
+		fmt.Sprintf("%s/http/routers/%s/middlewares/0", root, resName):    middleware,
+	}
+	middlewareKeys = map[string]string{
+		fmt.Sprintf("%s/http/middlewares/%s/redirectregex/regex", root, middleware):       "^.*$",
+		fmt.Sprintf("%s/http/middlewares/%s/redirectregex/replacement", root, middleware): target,
+		fmt.Sprintf("%s/http/middlewares/%s/redirectregex/permanent", root, middleware):   "false",
 	}
+	return routerKeys, middlewareKeys
+}
 
-	// Create service configuration
-	serviceKeys := map[string]string{
-		fmt.Sprintf("%s/http/services/%s/loadbalancer/servers/0/url", root, resName): serviceURL,
+// createRedirectConfig stores a redirect's config in etcd, replacing an app or redirect with the
+// same slug like createTraefikConfig does.
+func createRedirectConfig(cfg config, appName string, domain string, target string, replace bool) error {
+	client, err := createEtcdClient(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create etcd client: %w", err)
 	}
+	defer client.Close()
 
-	// Store keys in etcd: service first, then routers (deterministic order)
-	for key, value := range serviceKeys {
-		_, err := client.Put(ctx, key, value)
-		if err != nil {
-			return fmt.Errorf("failed to put key %s: %w", key, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var existing []string
+	if replace {
+		if existing, err = appKeys(ctx, client, cfg, resourceName(cfg, appName)); err != nil {
+			return err
 		}
 	}
-	for key, value := range routerKeys {
-		_, err := client.Put(ctx, key, value)
-		if err != nil {
-			return fmt.Errorf("failed to put key %s: %w", key, err)
+
+	routerKeys, middlewareKeys := redirectConfigKeys(cfg, appName, domain, target)
+
+	// Middleware first so the router never references a missing one
+	return putKeys(ctx, client, existing, middlewareKeys, routerKeys)
+}
+
+// putKeys stores every group of keys in etcd in a single transaction, so a config either appears
+// completely or not at all. Existing keys the groups don't overwrite are deleted in the same
+// transaction.
+func putKeys(ctx context.Context, client *etcd.Client, existing []string, groups ...map[string]string) error {
+	ops := append(deleteOps(existing, groups...), putOps(groups...)...)
+	if _, err := client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return fmt.Errorf("failed to put keys: %w", err)
+	}
+	return nil
+}
+
+// deleteOps deletes the existing keys that none of the groups puts. etcd rejects a transaction that
+// both deletes and puts a key, so keys are deleted one by one rather than by prefix.
+func deleteOps(existing []string, groups ...map[string]string) []etcd.Op {
+	var ops []etcd.Op
+	for _, key := range existing {
+		if !slices.ContainsFunc(groups, func(keys map[string]string) bool {
+			_, ok := keys[key]
+			return ok
+		}) {
+			ops = append(ops, etcd.OpDelete(key))
 		}
 	}
+	return ops
+}
 
-	return nil
+// putOps turns groups of keys into put operations, in the order the groups are given and sorted by key within a group.
+func putOps(groups ...map[string]string) []etcd.Op {
+	var ops []etcd.Op
+	for _, keys := range groups {
+		for _, key := range slices.Sorted(maps.Keys(keys)) {
+			ops = append(ops, etcd.OpPut(key, keys[key]))
+		}
+	}
+	return ops
+}
+
+// configPrefixes returns the etcd prefixes holding an app's config: its routers, its service, the
+// servers transport of https apps and its redirect, basic auth and IP allowlist middlewares, if any.
+func configPrefixes(root, appName string, routerNames []string) []string {
+	var prefixes []string
+	for _, routerName := range routerNames {
+		prefixes = append(prefixes, fmt.Sprintf("%s/http/routers/%s/", root, routerName))
+	}
+	return append(prefixes,
+		fmt.Sprintf("%s/http/services/%s/", root, appName),
+		fmt.Sprintf("%s/http/serverstransports/%s/", root, appName),
+		fmt.Sprintf("%s/http/middlewares/%s/", root, redirectMiddlewareName(appName)),
+		fmt.Sprintf("%s/http/middlewares/%s/", root, authMiddlewareName(appName)),
+		fmt.Sprintf("%s/http/middlewares/%s/", root, ipAllowMiddlewareName(appName)),
+	)
+}
+
+// appPrefixes returns the etcd prefixes holding the config of the app with resource name appName,
+// including the routers of its aliases.
+func appPrefixes(ctx context.Context, client *etcd.Client, cfg config, appName string) ([]string, error) {
+	root := etcdRoot(cfg)
+	routersPrefix := root + "/http/routers/"
+
+	// Find the app's router along with any alias routers sharing its service
+	resp, err := client.Get(ctx, routersPrefix, etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list router config: %w", err)
+	}
+	routerFields := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		routerFields[string(kv.Key)] = string(kv.Value)
+	}
+	routerNames := routersForService(routersPrefix, routerFields, appName)
+	if len(routerNames) == 0 {
+		routerNames = []string{appName}
+	}
+	return configPrefixes(root, appName, routerNames), nil
+}
+
+// appKeys lists the etcd keys currently holding the config of the app with resource name appName.
+func appKeys(ctx context.Context, client *etcd.Client, cfg config, appName string) ([]string, error) {
+	prefixes, err := appPrefixes(ctx, client, cfg, appName)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, prefix := range prefixes {
+		resp, err := client.Get(ctx, prefix, etcd.WithPrefix(), etcd.WithKeysOnly())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list config: %w", err)
+		}
+		for _, kv := range resp.Kvs {
+			keys = append(keys, string(kv.Key))
+		}
+	}
+	return keys, nil
 }
 
 func removeTraefikConfig(cfg config, appName string) error {
@@ -473,23 +1261,235 @@ func removeTraefikConfig(cfg config, appName string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	prefixes, err := appPrefixes(ctx, client, cfg, appName)
+	if err != nil {
+		return err
+	}
+
+	// Delete routers, service and redirect middleware in one transaction
+	var ops []etcd.Op
+	for _, prefix := range prefixes {
+		ops = append(ops, etcd.OpDelete(prefix, etcd.WithPrefix()))
+	}
+	if _, err := client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return fmt.Errorf("failed to delete config: %w", err)
+	}
+	return nil
+}
+
+// maxSlugAttempts is how many random slugs generateUniqueSlug tries before giving up.
+const maxSlugAttempts = 10
+
+// generateUniqueSlug generates random slugs of the given length until one is not taken yet.
+func generateUniqueSlug(length int, exists func(string) bool) (string, error) {
+	for range maxSlugAttempts {
+		if slug := generateRandomSlug(length); !exists(slug) {
+			return slug, nil
+		}
+	}
+	return "", fmt.Errorf("could not generate a free slug in %d attempts, pass --slug or raise slug-length", maxSlugAttempts)
+}
+
+// staleEntry is config prune removes: Reason says what is wrong, Prefixes are the etcd prefixes to delete.
+type staleEntry struct {
+	Reason   string
+	Prefixes []string
+}
+
+// findStale looks through every key under {root}/http/ for config of this utility (key prefix) that
+// Traefik can't use: routers whose service or redirect middleware is gone, services, middlewares and
+// servers transports nothing references anymore, and apps none of whose ports is open.
+func findStale(cfg config, fields map[string]string, portOpen func(port string) bool) []staleEntry {
 	root := etcdRoot(cfg)
+	routersPrefix := root + "/http/routers/"
+	servicesPrefix := root + "/http/services/"
+	middlewaresPrefix := root + "/http/middlewares/"
+	transportsPrefix := root + "/http/serverstransports/"
+
+	managed := func(name string) bool {
+		return cfg.KeyPrefix == "" || strings.HasPrefix(name, cfg.KeyPrefix+"-")
+	}
+	// names returns the managed resource names under prefix
+	names := func(prefix string) []string {
+		seen := make(map[string]bool)
+		for key := range fields {
+			rest, ok := strings.CutPrefix(key, prefix)
+			if !ok {
+				continue
+			}
+			name, _, _ := strings.Cut(rest, "/")
+			if managed(name) {
+				seen[name] = true
+			}
+		}
+		return slices.Sorted(maps.Keys(seen))
+	}
+	// referenced reports whether any key under prefix ending in suffix has value name
+	referenced := func(prefix, suffix, name string) bool {
+		for key, value := range fields {
+			if value == name && strings.HasPrefix(key, prefix) && strings.Contains(strings.TrimPrefix(key, prefix), suffix) {
+				return true
+			}
+		}
+		return false
+	}
+	exists := func(prefix string) bool {
+		for key := range fields {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
 
-	// Delete router configuration
-	routerPrefix := fmt.Sprintf("%s/http/routers/%s/", root, appName)
-	_, err = client.Delete(ctx, routerPrefix, etcd.WithPrefix())
+	var stale []staleEntry
+	for _, router := range names(routersPrefix) {
+		service := fields[routersPrefix+router+"/service"]
+		switch {
+		case service == redirectService:
+			middleware := redirectMiddlewareName(router)
+			if !exists(middlewaresPrefix + middleware + "/") {
+				stale = append(stale, staleEntry{
+					Reason:   fmt.Sprintf("router %s (redirect middleware %s is missing)", router, middleware),
+					Prefixes: []string{routersPrefix + router + "/"},
+				})
+			}
+		case service == "" || !exists(servicesPrefix+service+"/"):
+			stale = append(stale, staleEntry{
+				Reason:   fmt.Sprintf("router %s (service %q is missing)", router, service),
+				Prefixes: []string{routersPrefix + router + "/"},
+			})
+		}
+	}
+	for _, service := range names(servicesPrefix) {
+		routers := routersForService(routersPrefix, fields, service)
+		if len(routers) == 0 {
+			stale = append(stale, staleEntry{
+				Reason:   fmt.Sprintf("service %s (no router uses it)", service),
+				Prefixes: []string{servicesPrefix + service + "/", transportsPrefix + service + "/"},
+			})
+			continue
+		}
+		ports := serverPorts(servicesPrefix+service+"/loadbalancer/servers/", fields)
+		if len(ports) > 0 && !slices.ContainsFunc(ports, portOpen) {
+			stale = append(stale, staleEntry{
+				Reason:   fmt.Sprintf("app %s (nothing listening on %s)", slugFromResourceName(cfg, service), formatPorts(ports)),
+				Prefixes: configPrefixes(root, service, routers),
+			})
+		}
+	}
+	for _, middleware := range names(middlewaresPrefix) {
+		if !referenced(routersPrefix, "/middlewares/", middleware) {
+			stale = append(stale, staleEntry{
+				Reason:   fmt.Sprintf("middleware %s (no router uses it)", middleware),
+				Prefixes: []string{middlewaresPrefix + middleware + "/"},
+			})
+		}
+	}
+	for _, transport := range names(transportsPrefix) {
+		if !referenced(servicesPrefix, "/loadbalancer/serverstransport", transport) {
+			stale = append(stale, staleEntry{
+				Reason:   fmt.Sprintf("servers transport %s (no service uses it)", transport),
+				Prefixes: []string{transportsPrefix + transport + "/"},
+			})
+		}
+	}
+	return stale
+}
+
+// portOpen reports whether something accepts TCP connections on a local port.
+func portOpen(targetIP, port string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(targetIP, port), time.Second)
 	if err != nil {
-		return fmt.Errorf("failed to delete router config: %w", err)
+		return false
 	}
+	conn.Close()
+	return true
+}
 
-	// Delete service configuration
-	servicePrefix := fmt.Sprintf("%s/http/services/%s/", root, appName)
-	_, err = client.Delete(ctx, servicePrefix, etcd.WithPrefix())
+// pruneTraefikConfig removes the stale config findStale reports, each entry in its own transaction.
+// With dryRun it only reports.
+func pruneTraefikConfig(cfg config, dryRun bool) ([]staleEntry, error) {
+	client, err := createEtcdClient(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to delete service config: %w", err)
+		return nil, fmt.Errorf("failed to create etcd client: %w", err)
 	}
+	defer client.Close()
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	resp, err := client.Get(ctx, etcdRoot(cfg)+"/http/", etcd.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list etcd keys: %w", err)
+	}
+	fields := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		fields[string(kv.Key)] = string(kv.Value)
+	}
+
+	stale := findStale(cfg, fields, func(port string) bool { return portOpen(cfg.TargetIP, port) })
+	if dryRun {
+		return stale, nil
+	}
+	for i, entry := range stale {
+		var ops []etcd.Op
+		for _, prefix := range entry.Prefixes {
+			ops = append(ops, etcd.OpDelete(prefix, etcd.WithPrefix()))
+		}
+		if _, err := client.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return stale[:i], fmt.Errorf("failed to remove %s: %w", entry.Reason, err)
+		}
+	}
+	return stale, nil
+}
+
+// browserCommand returns the command that opens url in the default browser on goos.
+func browserCommand(goos, url string) []string {
+	switch goos {
+	case "darwin":
+		return []string{"open", url}
+	case "windows":
+		return []string{"rundll32", "url.dll,FileProtocolHandler", url}
+	default:
+		return []string{"xdg-open", url}
+	}
+}
+
+// openBrowser opens url in the default browser without waiting for it.
+func openBrowser(url string) error {
+	command := browserCommand(runtime.GOOS, url)
+	return exec.Command(command[0], command[1:]...).Start()
+}
+
+// clipboardCommands returns the commands that copy stdin to the clipboard on goos, in order of preference.
+func clipboardCommands(goos string) [][]string {
+	switch goos {
+	case "darwin":
+		return [][]string{{"pbcopy"}}
+	case "windows":
+		return [][]string{{"clip"}}
+	default:
+		return [][]string{{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	}
+}
+
+// copyToClipboard copies text with the first clipboard command that is installed.
+func copyToClipboard(text string) error {
+	commands := clipboardCommands(runtime.GOOS)
+	for _, command := range commands {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		c := exec.Command(command[0], command[1:]...)
+		c.Stdin = strings.NewReader(text)
+		return c.Run()
+	}
+	var names []string
+	for _, command := range commands {
+		names = append(names, command[0])
+	}
+	return fmt.Errorf("no clipboard command found (tried %s)", strings.Join(names, ", "))
 }
 
 // generateRandomSlug creates a random alphanumeric string of the given length
@@ -525,25 +1525,25 @@ func findAppNameByPort(cfg config, port string) string {
 		return ""
 	}
 
-	targetURL := fmt.Sprintf(":%s", port)
-
+	serviceFields := make(map[string]string)
 	for _, kv := range resp.Kvs {
-		key := string(kv.Key)
-		value := string(kv.Value)
-
-		// Look for service URL keys like {root}/http/services/{app-name}/loadbalancer/servers/0/url
-		if strings.HasSuffix(key, "/loadbalancer/servers/0/url") {
-			if strings.HasSuffix(value, targetURL) {
-				// Extract app name: key is {root}/http/services/{appName}/loadbalancer/...
-				afterPrefix, _ := strings.CutPrefix(key, servicesPrefix)
-				if idx := strings.Index(afterPrefix, "/"); idx >= 0 {
-					return afterPrefix[:idx]
-				}
-				return afterPrefix
-			}
-		}
+		serviceFields[string(kv.Key)] = string(kv.Value)
 	}
+	return serviceByPort(servicesPrefix, serviceFields, port)
+}
 
+// serviceByPort returns the name of the service under servicesPrefix with a server on port, any of its servers.
+func serviceByPort(servicesPrefix string, serviceFields map[string]string, port string) string {
+	for key := range serviceFields {
+		// Service URL keys look like {root}/http/services/{app-name}/loadbalancer/servers/{n}/url
+		name, _, ok := strings.Cut(strings.TrimPrefix(key, servicesPrefix), "/loadbalancer/servers/")
+		if !ok || strings.Contains(name, "/") {
+			continue
+		}
+		if slices.Contains(serverPorts(servicesPrefix+name+"/loadbalancer/servers/", serviceFields), port) {
+			return name
+		}
+	}
 	return ""
 }
 
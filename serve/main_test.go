@@ -0,0 +1,572 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testConfig() config {
+	return config{
+		EtcdRootKey:    "traefik",
+		TargetIP:       "100.64.0.1",
+		DomainTemplate: "%s.example.com",
+		CertResolver:   "lecf",
+		KeyPrefix:      "serve",
+	}
+}
+
+func TestAliasRoutersShareService(t *testing.T) {
+	cfg := testConfig()
+	domains := []string{"myapp.example.com", aliasDomain(cfg, "www.myapp.example.com"), aliasDomain(cfg, "api")}
+	routerKeys, serviceKeys, _ := traefikConfigKeys(cfg, "myapp", domains, []string{"3000"}, appOptions{})
+
+	routersPrefix := "traefik/http/routers/"
+	var services []string
+	for key, value := range routerKeys {
+		if strings.HasSuffix(key, "/service") {
+			services = append(services, value)
+		}
+	}
+	if len(services) != 3 {
+		t.Fatalf("expected 3 routers, got %d", len(services))
+	}
+	for _, svc := range services {
+		if svc != "serve-myapp" {
+			t.Errorf("router references service %q, want serve-myapp", svc)
+		}
+	}
+	if len(serviceKeys) != 1 {
+		t.Errorf("expected a single service, got %v", serviceKeys)
+	}
+	if rule := routerKeys[routersPrefix+"serve-myapp-alias2/rule"]; rule != "Host(`api.example.com`)" {
+		t.Errorf("unexpected alias rule %q", rule)
+	}
+
+	// stop removes every router that references the app's service
+	got := routersForService(routersPrefix, routerKeys, "serve-myapp")
+	want := []string{"serve-myapp", "serve-myapp-alias1", "serve-myapp-alias2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routersForService() = %v, want %v", got, want)
+	}
+	if got := routersForService(routersPrefix, routerKeys, "serve-other"); len(got) != 0 {
+		t.Errorf("expected no routers for another service, got %v", got)
+	}
+}
+
+func TestRedirectConfigKeys(t *testing.T) {
+	cfg := testConfig()
+	routerKeys, middlewareKeys := redirectConfigKeys(cfg, "docs", "docs.example.com", "https://example.org/handbook")
+
+	wantRouter := map[string]string{
+		"traefik/http/routers/serve-docs/entrypoints":      "https",
+		"traefik/http/routers/serve-docs/tls":              "true",
+		"traefik/http/routers/serve-docs/tls/certresolver": "lecf",
+		"traefik/http/routers/serve-docs/rule":             "Host(`docs.example.com`)",
+		"traefik/http/routers/serve-docs/service":          "noop@internal",
+		"traefik/http/routers/serve-docs/middlewares/0":    "serve-docs-redirect",
+	}
+	if !reflect.DeepEqual(routerKeys, wantRouter) {
+		t.Errorf("router keys = %v, want %v", routerKeys, wantRouter)
+	}
+
+	wantMiddleware := map[string]string{
+		"traefik/http/middlewares/serve-docs-redirect/redirectregex/regex":       "^.*$",
+		"traefik/http/middlewares/serve-docs-redirect/redirectregex/replacement": "https://example.org/handbook",
+		"traefik/http/middlewares/serve-docs-redirect/redirectregex/permanent":   "false",
+	}
+	if !reflect.DeepEqual(middlewareKeys, wantMiddleware) {
+		t.Errorf("middleware keys = %v, want %v", middlewareKeys, wantMiddleware)
+	}
+
+	// A redirect has no service of its own, so it never shows up as an app's router
+	if got := routersForService("traefik/http/routers/", routerKeys, "serve-docs"); len(got) != 0 {
+		t.Errorf("expected no routers for the redirect's resource name, got %v", got)
+	}
+}
+
+func TestLoadBalancedServers(t *testing.T) {
+	cfg := testConfig()
+	_, serviceKeys, _ := traefikConfigKeys(cfg, "myapp", []string{"myapp.example.com"}, []string{"3000", ":3001"}, appOptions{})
+
+	serversPrefix := "traefik/http/services/serve-myapp/loadbalancer/servers/"
+	want := map[string]string{
+		serversPrefix + "0/url": "http://100.64.0.1:3000",
+		serversPrefix + "1/url": "http://100.64.0.1:3001",
+	}
+	if !reflect.DeepEqual(serviceKeys, want) {
+		t.Errorf("service keys = %v, want %v", serviceKeys, want)
+	}
+
+	if got := serverPorts(serversPrefix, serviceKeys); !reflect.DeepEqual(got, []string{"3000", "3001"}) {
+		t.Errorf("serverPorts() = %v, want [3000 3001]", got)
+	}
+
+	// stop by port finds the app through any of its servers
+	_, otherKeys, _ := traefikConfigKeys(cfg, "other", []string{"other.example.com"}, []string{"8080"}, appOptions{})
+	for key, value := range otherKeys {
+		serviceKeys[key] = value
+	}
+	for port, want := range map[string]string{"3000": "serve-myapp", "3001": "serve-myapp", "8080": "serve-other", "9999": ""} {
+		if got := serviceByPort("traefik/http/services/", serviceKeys, port); got != want {
+			t.Errorf("serviceByPort(%s) = %q, want %q", port, got, want)
+		}
+	}
+	if got := formatPorts([]string{"3000", "3001"}); got != ":3000, :3001" {
+		t.Errorf("formatPorts() = %q", got)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	cfg := testConfig()
+	_, serviceKeys, _ := traefikConfigKeys(cfg, "myapp", []string{"myapp.example.com"}, []string{"3000"}, appOptions{Health: healthCheck{Path: "/healthz", Interval: "10s"}})
+
+	loadBalancerPrefix := "traefik/http/services/serve-myapp/loadbalancer/"
+	if got := serviceKeys[loadBalancerPrefix+"healthcheck/path"]; got != "/healthz" {
+		t.Errorf("healthcheck path = %q, want /healthz", got)
+	}
+	if got := serviceKeys[loadBalancerPrefix+"healthcheck/interval"]; got != "10s" {
+		t.Errorf("healthcheck interval = %q, want 10s", got)
+	}
+	if got := serverPorts(loadBalancerPrefix+"servers/", serviceKeys); !reflect.DeepEqual(got, []string{"3000"}) {
+		t.Errorf("serverPorts() = %v, want [3000]", got)
+	}
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthyPort := healthy.URL[strings.LastIndex(healthy.URL, ":")+1:]
+	failingPort := failing.URL[strings.LastIndex(failing.URL, ":")+1:]
+	cfg.TargetIP = "127.0.0.1"
+	for _, tc := range []struct {
+		svc  activeService
+		want string
+	}{
+		{activeService{Ports: []string{healthyPort}, HealthPath: "/healthz"}, "healthy"},
+		{activeService{Ports: []string{healthyPort}, HealthPath: "/missing"}, "unhealthy"},
+		{activeService{Ports: []string{healthyPort, failingPort}, HealthPath: "/healthz"}, "1/2 healthy"},
+		{activeService{Ports: []string{failingPort}}, "-"},
+	} {
+		if got := healthStatus(cfg, tc.svc); got != tc.want {
+			t.Errorf("healthStatus(%v) = %q, want %q", tc.svc, got, tc.want)
+		}
+	}
+}
+
+func TestHealthCheckFromFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		want    healthCheck
+		wantErr bool
+	}{
+		{nil, healthCheck{}, false},
+		{[]string{"--health-path", "/healthz"}, healthCheck{Path: "/healthz", Interval: "10s"}, false},
+		{[]string{"--health-interval", "30s"}, healthCheck{Path: "/", Interval: "30s"}, false},
+		{[]string{"--health-path", "healthz"}, healthCheck{}, true},
+		{[]string{"--health-interval", "often"}, healthCheck{}, true},
+	} {
+		var got healthCheck
+		var err error
+		cmd := &cli.Command{Name: "run", Flags: healthFlags, Action: func(_ context.Context, cmd *cli.Command) error {
+			got, err = healthCheckFromCmd(cmd)
+			return nil
+		}}
+		if runErr := cmd.Run(context.Background(), append([]string{"run"}, tc.args...)); runErr != nil {
+			t.Fatalf("Run(%v) failed: %v", tc.args, runErr)
+		}
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("healthCheckFromCmd(%v) = %+v, %v, want %+v, error %v", tc.args, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestTransactionOps(t *testing.T) {
+	cfg := testConfig()
+	routerKeys, serviceKeys, _ := traefikConfigKeys(cfg, "myapp", []string{"myapp.example.com", "api.example.com"}, []string{"3000"}, appOptions{})
+
+	ops := putOps(serviceKeys, routerKeys)
+	if len(ops) != len(serviceKeys)+len(routerKeys) {
+		t.Fatalf("expected %d put ops, got %d", len(serviceKeys)+len(routerKeys), len(ops))
+	}
+	if key := string(ops[0].KeyBytes()); key != "traefik/http/services/serve-myapp/loadbalancer/servers/0/url" {
+		t.Errorf("first op puts %q, want the service before any router", key)
+	}
+	for i, op := range ops {
+		if !op.IsPut() {
+			t.Errorf("op %d is not a put", i)
+		}
+		key := string(op.KeyBytes())
+		if want := cmp.Or(serviceKeys[key], routerKeys[key]); string(op.ValueBytes()) != want {
+			t.Errorf("op %d puts %q = %q, want %q", i, key, op.ValueBytes(), want)
+		}
+		if i > 1 && string(ops[i-1].KeyBytes()) > key {
+			t.Errorf("router ops not sorted: %q before %q", ops[i-1].KeyBytes(), key)
+		}
+	}
+
+	// Replacing an app only deletes the old keys the new config doesn't put again
+	existing := []string{
+		"traefik/http/services/serve-myapp/loadbalancer/servers/0/url",
+		"traefik/http/services/serve-myapp/loadbalancer/servers/1/url",
+		"traefik/http/routers/serve-myapp-alias2/rule",
+	}
+	var deleted []string
+	for _, op := range deleteOps(existing, serviceKeys, routerKeys) {
+		if !op.IsDelete() {
+			t.Errorf("op on %q is not a delete", op.KeyBytes())
+		}
+		deleted = append(deleted, string(op.KeyBytes()))
+	}
+	if want := existing[1:]; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleteOps() deletes %v, want %v", deleted, want)
+	}
+
+	got := configPrefixes("traefik", "serve-myapp", []string{"serve-myapp", "serve-myapp-alias1"})
+	want := []string{
+		"traefik/http/routers/serve-myapp/",
+		"traefik/http/routers/serve-myapp-alias1/",
+		"traefik/http/services/serve-myapp/",
+		"traefik/http/serverstransports/serve-myapp/",
+		"traefik/http/middlewares/serve-myapp-redirect/",
+		"traefik/http/middlewares/serve-myapp-auth/",
+		"traefik/http/middlewares/serve-myapp-ipallow/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("configPrefixes() = %v, want %v", got, want)
+	}
+}
+
+func TestGenerateUniqueSlug(t *testing.T) {
+	var tried []string
+	slug, err := generateUniqueSlug(3, func(s string) bool {
+		tried = append(tried, s)
+		return len(tried) < 3
+	})
+	if err != nil {
+		t.Fatalf("generateUniqueSlug() error: %v", err)
+	}
+	if len(tried) != 3 || slug != tried[2] {
+		t.Errorf("expected the third slug to be used, got %q after %v", slug, tried)
+	}
+	if len(slug) != 3 {
+		t.Errorf("expected a 3 character slug, got %q", slug)
+	}
+
+	if _, err := generateUniqueSlug(3, func(string) bool { return true }); err == nil {
+		t.Error("expected an error when every slug is taken")
+	}
+}
+
+func TestHTTPSBackend(t *testing.T) {
+	cfg := testConfig()
+	_, serviceKeys, _ := traefikConfigKeys(cfg, "myapp", []string{"myapp.example.com"}, []string{"8443"}, appOptions{Scheme: "https"})
+
+	want := map[string]string{
+		"traefik/http/services/serve-myapp/loadbalancer/servers/0/url":    "https://100.64.0.1:8443",
+		"traefik/http/services/serve-myapp/loadbalancer/serverstransport": "serve-myapp",
+		"traefik/http/serverstransports/serve-myapp/insecureskipverify":   "true",
+	}
+	if !reflect.DeepEqual(serviceKeys, want) {
+		t.Errorf("service keys = %v, want %v", serviceKeys, want)
+	}
+	if got := serverPorts("traefik/http/services/serve-myapp/loadbalancer/servers/", serviceKeys); !reflect.DeepEqual(got, []string{"8443"}) {
+		t.Errorf("serverPorts() = %v, want [8443]", got)
+	}
+
+	// the app's self-signed certificate does not fail the probe
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	port := backend.URL[strings.LastIndex(backend.URL, ":")+1:]
+	if !probeHealth("https", "127.0.0.1", port, "/") {
+		t.Error("expected https backend with a self-signed certificate to be healthy")
+	}
+	if probeHealth("http", "127.0.0.1", port, "/") {
+		t.Error("expected plain http against a TLS backend to be unhealthy")
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	cfg := testConfig()
+	user, err := htpasswdEntry("alice:s3cret")
+	if err != nil {
+		t.Fatalf("htpasswdEntry() error: %v", err)
+	}
+	name, hash, _ := strings.Cut(user, ":")
+	if name != "alice" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cret")) != nil {
+		t.Errorf("htpasswdEntry() = %q, want alice with a bcrypt hash of the password", user)
+	}
+	for _, bad := range []string{"alice", ":s3cret", "alice:"} {
+		if _, err := htpasswdEntry(bad); err == nil {
+			t.Errorf("htpasswdEntry(%q) expected an error", bad)
+		}
+	}
+
+	for source, want := range map[string]string{"1.2.3.0/24": "1.2.3.0/24", "10.0.0.1": "10.0.0.1", "fd00::/8": "fd00::/8"} {
+		if got, err := parseSourceRange(source); err != nil || got != want {
+			t.Errorf("parseSourceRange(%q) = %q, %v, want %q", source, got, err, want)
+		}
+	}
+	if _, err := parseSourceRange("example.com"); err == nil {
+		t.Error("expected an error for a hostname")
+	}
+
+	opts := appOptions{BasicAuth: []string{user}, IPAllow: []string{"1.2.3.0/24"}}
+	routerKeys, _, middlewareKeys := traefikConfigKeys(cfg, "myapp", []string{"myapp.example.com", "api.example.com"}, []string{"3000"}, opts)
+	wantMiddleware := map[string]string{
+		"traefik/http/middlewares/serve-myapp-ipallow/ipallowlist/sourcerange/0": "1.2.3.0/24",
+		"traefik/http/middlewares/serve-myapp-auth/basicauth/users/0":            user,
+	}
+	if !reflect.DeepEqual(middlewareKeys, wantMiddleware) {
+		t.Errorf("middleware keys = %v, want %v", middlewareKeys, wantMiddleware)
+	}
+	for _, router := range []string{"serve-myapp", "serve-myapp-alias1"} {
+		prefix := "traefik/http/routers/" + router + "/middlewares/"
+		if routerKeys[prefix+"0"] != "serve-myapp-ipallow" || routerKeys[prefix+"1"] != "serve-myapp-auth" {
+			t.Errorf("router %s middlewares = %q, %q", router, routerKeys[prefix+"0"], routerKeys[prefix+"1"])
+		}
+	}
+
+	// stop cleans up both middlewares
+	prefixes := configPrefixes("traefik", "serve-myapp", []string{"serve-myapp"})
+	for _, want := range []string{"traefik/http/middlewares/serve-myapp-auth/", "traefik/http/middlewares/serve-myapp-ipallow/"} {
+		if !slices.Contains(prefixes, want) {
+			t.Errorf("configPrefixes() = %v, missing %s", prefixes, want)
+		}
+	}
+}
+
+func TestStatusTable(t *testing.T) {
+	cfg := testConfig()
+	services := map[string]activeService{
+		"zeta":  {Ports: []string{"3000", "3001"}},
+		"alpha": {Ports: []string{"8443"}, Scheme: "https", Domains: []string{"alpha.example.com", "a-very-long-alias-for-the-alpha-app.example.com"}},
+		"docs":  {Redirect: "https://example.org/handbook"},
+	}
+	statuses := serviceStatuses(cfg, services)
+	var slugs []string
+	for _, status := range statuses {
+		slugs = append(slugs, status.Slug)
+	}
+	if !reflect.DeepEqual(slugs, []string{"alpha", "docs", "zeta"}) {
+		t.Fatalf("expected services sorted by slug, got %v", slugs)
+	}
+	if want := []string{"https://100.64.0.1:8443"}; !reflect.DeepEqual(statuses[0].Backends, want) {
+		t.Errorf("alpha backends = %v, want %v", statuses[0].Backends, want)
+	}
+	if want := []string{"zeta.example.com"}; !reflect.DeepEqual(statuses[2].Domains, want) {
+		t.Errorf("zeta domains = %v, want the templated domain", statuses[2].Domains)
+	}
+
+	var narrow strings.Builder
+	printStatusTable(&narrow, statuses, false)
+	want := `SLUG                 DOMAIN                                   HEALTH     BACKEND
+-------------------- ---------------------------------------- ---------- -------
+alpha                https://alpha.example.com                -          https://100.64.0.1:8443
+                     https://a-very-long-alias-for-the-alp...
+docs                 https://docs.example.com                 -          redirect -> https://example.org/handbook
+zeta                 https://zeta.example.com                 -          http://100.64.0.1:3000, http://100.64.0.1:3001
+`
+	if narrow.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", narrow.String(), want)
+	}
+
+	var wide strings.Builder
+	printStatusTable(&wide, statuses, true)
+	if !strings.Contains(wide.String(), "https://a-very-long-alias-for-the-alpha-app.example.com\n") {
+		t.Errorf("wide table truncated the alias:\n%s", wide.String())
+	}
+}
+
+func TestFindStale(t *testing.T) {
+	cfg := testConfig()
+	fields := make(map[string]string)
+	add := func(groups ...map[string]string) {
+		for _, keys := range groups {
+			for key, value := range keys {
+				fields[key] = value
+			}
+		}
+	}
+	// healthy app, app whose ports are closed, redirect
+	add(traefikConfigKeys(cfg, "live", []string{"live.example.com"}, []string{"3000", "3001"}, appOptions{}))
+	add(traefikConfigKeys(cfg, "dead", []string{"dead.example.com", "api.example.com"}, []string{"4000"}, appOptions{BasicAuth: []string{"alice:hash"}}))
+	add(redirectConfigKeys(cfg, "docs", "docs.example.com", "https://example.org"))
+	// leftovers of crashed runs
+	add(map[string]string{
+		"traefik/http/routers/serve-lost/rule":                          "Host(`lost.example.com`)",
+		"traefik/http/routers/serve-lost/service":                       "serve-lost",
+		"traefik/http/services/serve-alone/loadbalancer/servers/0/url":  "http://100.64.0.1:5000",
+		"traefik/http/middlewares/serve-gone-auth/basicauth/users/0":    "bob:hash",
+		"traefik/http/serverstransports/serve-gone/insecureskipverify":  "true",
+		"traefik/http/routers/someone-else/service":                     "missing",
+		"traefik/http/services/someone-else/loadbalancer/servers/0/url": "http://10.0.0.1:80",
+		"traefik/http/middlewares/someone-else-auth/basicauth/users/0":  "carol:hash",
+	})
+
+	open := map[string]bool{"3001": true}
+	stale := findStale(cfg, fields, func(port string) bool { return open[port] })
+	got := make(map[string][]string)
+	for _, entry := range stale {
+		got[entry.Reason] = entry.Prefixes
+	}
+	want := map[string][]string{
+		`router serve-lost (service "serve-lost" is missing)`: {"traefik/http/routers/serve-lost/"},
+		"service serve-alone (no router uses it)":             {"traefik/http/services/serve-alone/", "traefik/http/serverstransports/serve-alone/"},
+		"app dead (nothing listening on :4000)":               configPrefixes("traefik", "serve-dead", []string{"serve-dead", "serve-dead-alias1"}),
+		"middleware serve-gone-auth (no router uses it)":      {"traefik/http/middlewares/serve-gone-auth/"},
+		"servers transport serve-gone (no service uses it)":   {"traefik/http/serverstransports/serve-gone/"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findStale() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestEtcdEndpoints(t *testing.T) {
+	for setting, want := range map[string][]string{
+		"localhost:2379":                    {"localhost:2379"},
+		"etcd1:2379, etcd2:2379,etcd3:2379": {"etcd1:2379", "etcd2:2379", "etcd3:2379"},
+		" etcd1:2379,,":                     {"etcd1:2379"},
+		"":                                  nil,
+	} {
+		if got := etcdEndpoints(setting); !reflect.DeepEqual(got, want) {
+			t.Errorf("etcdEndpoints(%q) = %v, want %v", setting, got, want)
+		}
+	}
+}
+
+func TestEtcdTLSConfig(t *testing.T) {
+	if tlsConfig, err := etcdTLSConfig(testConfig()); err != nil || tlsConfig != nil {
+		t.Fatalf("expected plaintext without certificate files, got %v, %v", tlsConfig, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "serve"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.EtcdCA, cfg.EtcdCert, cfg.EtcdKey = certFile, certFile, keyFile
+	tlsConfig, err := etcdTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("etcdTLSConfig() error: %v", err)
+	}
+	if tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 {
+		t.Errorf("expected CA pool and client certificate, got %+v", tlsConfig)
+	}
+
+	cfg.EtcdKey = ""
+	if _, err := etcdTLSConfig(cfg); err == nil {
+		t.Error("expected an error for a certificate without key")
+	}
+	cfg.EtcdCA, cfg.EtcdCert = keyFile, ""
+	if _, err := etcdTLSConfig(cfg); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
+
+func TestBrowserAndClipboardCommands(t *testing.T) {
+	url := "https://myapp.example.com"
+	for goos, want := range map[string][]string{
+		"darwin":  {"open", url},
+		"windows": {"rundll32", "url.dll,FileProtocolHandler", url},
+		"linux":   {"xdg-open", url},
+		"freebsd": {"xdg-open", url},
+	} {
+		if got := browserCommand(goos, url); !reflect.DeepEqual(got, want) {
+			t.Errorf("browserCommand(%s) = %v, want %v", goos, got, want)
+		}
+	}
+	if got := clipboardCommands("linux"); len(got) != 3 || got[0][0] != "wl-copy" {
+		t.Errorf("clipboardCommands(linux) = %v, want wl-copy first", got)
+	}
+	if got := clipboardCommands("darwin"); !reflect.DeepEqual(got, [][]string{{"pbcopy"}}) {
+		t.Errorf("clipboardCommands(darwin) = %v", got)
+	}
+}
+
+func TestValidateDomainTemplate(t *testing.T) {
+	for _, template := range []string{"%s.example.com", "%s.app.example.com", "app-%s.example.com"} {
+		if err := validateDomainTemplate(template); err != nil {
+			t.Errorf("validateDomainTemplate(%q) error: %v", template, err)
+		}
+	}
+	for _, template := range []string{
+		"",
+		"example.com",
+		"%s.%s.example.com",
+		"%d.example.com",
+		"%s.example.com%v",
+		"%%s.example.com",
+		"https://%s.example.com",
+		"%s.example.com/app",
+	} {
+		if err := validateDomainTemplate(template); err == nil {
+			t.Errorf("validateDomainTemplate(%q) expected an error", template)
+		}
+	}
+
+	// Every subcommand gets the config from configFromCmd, status included
+	for template, wantErr := range map[string]bool{"%s.example.com": false, "%s.%s.example.com": true} {
+		cmd := &cli.Command{
+			Name:  "serve",
+			Flags: []cli.Flag{&cli.StringFlag{Name: "domain-template"}},
+			Commands: []*cli.Command{{Name: "status", Action: func(_ context.Context, cmd *cli.Command) error {
+				_, err := configFromCmd(cmd)
+				return err
+			}}},
+		}
+		if err := cmd.Run(context.Background(), []string{"serve", "--domain-template", template, "status"}); (err != nil) != wantErr {
+			t.Errorf("status with domain template %q: error %v, want error %v", template, err, wantErr)
+		}
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf16"
 
 	"github.com/caarlos0/env/v11"
 	mcpclient "github.com/mark3labs/mcp-go/client"
@@ -15,27 +24,630 @@ import (
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/sashabaranov/go-openai"
 	tele "gopkg.in/telebot.v4"
+	"gopkg.in/telebot.v4/middleware"
 )
 
 type config struct {
-	TelegramBotToken          string `env:"TELEGRAM_BOT_TOKEN"`
-	TelegramApiId             string `env:"TELEGRAM_API_ID"`
-	TelegramApiHash           string `env:"TELEGRAM_API_HASH"`
-	OpenAIAPIKey              string `env:"OPENAI_API_KEY"`
-	OpenAIAPIURL              string `env:"OPENAI_API_URL"`
-	OpenAIModel               string `env:"OPENAI_MODEL"`
-	GithubPersonalAccessToken string `env:"GITHUB_PERSONAL_ACCESS_TOKEN"`
-	GithubMCPCommand          string `env:"GITHUB_MCP_COMMAND" default:"docker run -i --rm -e GITHUB_PERSONAL_ACCESS_TOKEN ghcr.io/github/github-mcp-server"`
+	TelegramBotToken          string   `env:"TELEGRAM_BOT_TOKEN"`
+	TelegramApiId             string   `env:"TELEGRAM_API_ID"`
+	TelegramApiHash           string   `env:"TELEGRAM_API_HASH"`
+	OpenAIAPIKey              string   `env:"OPENAI_API_KEY"`
+	OpenAIAPIURL              string   `env:"OPENAI_API_URL"`
+	OpenAIModel               string   `env:"OPENAI_MODEL"`
+	GithubPersonalAccessToken string   `env:"GITHUB_PERSONAL_ACCESS_TOKEN"`
+	GithubMCPCommand          string   `env:"GITHUB_MCP_COMMAND" default:"docker run -i --rm -e GITHUB_PERSONAL_ACCESS_TOKEN ghcr.io/github/github-mcp-server"`
+	GithubMCPTransport        string   `env:"GITHUB_MCP_TRANSPORT" envDefault:"stdio"`
+	GithubMCPURL              string   `env:"GITHUB_MCP_URL"`
+	GithubMCPTools            []string `env:"GITHUB_MCP_TOOLS" envSeparator:","`
+	TelegramAllowedUsers      []int64  `env:"TELEGRAM_ALLOWED_USERS" envSeparator:","`
+	SystemPrompt              string   `env:"SYSTEM_PROMPT"`
+	HistoryFile               string   `env:"HISTORY_FILE" envDefault:"history.json"`
+	MaxHistoryMessages        int      `env:"MAX_HISTORY_MESSAGES" envDefault:"50"`
 }
 
-// Conversation stores messages for the single user
+// newMCPTransport connects to the GitHub MCP server: a spawned command over stdio, or a remote server
+// over SSE or streamable HTTP, which gets the personal access token as bearer token.
+func newMCPTransport(cfg config) (mcptransport.Interface, error) {
+	var headers map[string]string
+	if cfg.GithubPersonalAccessToken != "" {
+		headers = map[string]string{"Authorization": "Bearer " + cfg.GithubPersonalAccessToken}
+	}
+	switch cfg.GithubMCPTransport {
+	case "stdio":
+		githubMCPCommand := strings.Fields(cfg.GithubMCPCommand)
+		if len(githubMCPCommand) == 0 {
+			return nil, fmt.Errorf("GITHUB_MCP_COMMAND is required for the stdio transport")
+		}
+		// For Docker, we don't need to pass the token in the env slice since it's already in the command
+		var envVars []string
+		if !strings.Contains(cfg.GithubMCPCommand, "docker") {
+			envVars = []string{"GITHUB_PERSONAL_ACCESS_TOKEN=" + cfg.GithubPersonalAccessToken}
+		}
+		return mcptransport.NewStdio(githubMCPCommand[0], envVars, githubMCPCommand[1:]...), nil
+	case "sse":
+		if cfg.GithubMCPURL == "" {
+			return nil, fmt.Errorf("GITHUB_MCP_URL is required for the sse transport")
+		}
+		return mcptransport.NewSSE(cfg.GithubMCPURL, mcptransport.WithHeaders(headers))
+	case "http":
+		if cfg.GithubMCPURL == "" {
+			return nil, fmt.Errorf("GITHUB_MCP_URL is required for the http transport")
+		}
+		return mcptransport.NewStreamableHTTP(cfg.GithubMCPURL, mcptransport.WithHTTPHeaders(headers))
+	}
+	return nil, fmt.Errorf("unknown GITHUB_MCP_TRANSPORT %q, use stdio, sse or http", cfg.GithubMCPTransport)
+}
+
+// defaultTools are exposed when GITHUB_MCP_TOOLS is empty
+var defaultTools = []openai.Tool{
+	{
+		Type: "function",
+		Function: &openai.FunctionDefinition{
+			Name: "create_issue",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"assignees": {"type": "array", "items": {"type": "string"}},
+					"body":      {"type": "string"},
+					"labels":    {"type": "array", "items": {"type": "string"}},
+					"milestone": {"type": "number"},
+					"owner":     {"type": "string"},
+					"repo":      {"type": "string"},
+					"title":     {"type": "string"}
+				},
+				"required": ["owner", "repo", "title"]
+			}`),
+		},
+	},
+	{
+		Type: "function",
+		Function: &openai.FunctionDefinition{
+			Name: "list_tags",
+			Parameters: json.RawMessage(`{
+				"type": "object",
+				"properties": {
+					"owner":   {"type": "string"},
+					"repo":    {"type": "string"},
+					"page":    {"type": "number"},
+					"perPage": {"type": "number"}
+				},
+				"required": ["owner", "repo", "page", "perPage"]
+			}`),
+		},
+	},
+}
+
+// botCommands are the commands shown by /help and in Telegram's command menu
+var botCommands = []tele.Command{
+	{Text: "new", Description: "start a new conversation"},
+	{Text: "tools", Description: "list the GitHub tools I can use"},
+	{Text: "help", Description: "show this help"},
+}
+
+// toolsSummary lists the exposed tools with the descriptions the MCP server gives them, marking the
+// ones that ask for confirmation, and counts the server's other tools that could be enabled.
+func toolsSummary(exposed []openai.Tool, mcpTools []mcp.Tool, readOnly map[string]bool) string {
+	descriptions := make(map[string]string)
+	for _, tool := range mcpTools {
+		descriptions[tool.Name] = tool.Description
+	}
+	var summary strings.Builder
+	summary.WriteString("I can use these GitHub tools:\n\n")
+	for _, tool := range exposed {
+		name := tool.Function.Name
+		summary.WriteString("• " + name)
+		if !readOnly[name] {
+			summary.WriteString(" (asks for confirmation)")
+		}
+		if description, _, _ := strings.Cut(descriptions[name], "\n"); description != "" {
+			summary.WriteString(" - " + description)
+		}
+		summary.WriteString("\n")
+	}
+	if others := len(mcpTools) - len(exposed); others > 0 {
+		summary.WriteString(fmt.Sprintf("\nThe server offers %d more, which can be enabled with GITHUB_MCP_TOOLS.", others))
+	}
+	return summary.String()
+}
+
+// defaultReadOnlyTools are the default tools that run without confirmation
+var defaultReadOnlyTools = map[string]bool{"list_tags": true}
+
+// readOnlyTools returns the tools the MCP server marks as read-only. Everything else may change
+// something on GitHub and needs confirmation.
+func readOnlyTools(mcpTools []mcp.Tool) map[string]bool {
+	readOnly := make(map[string]bool)
+	for _, tool := range mcpTools {
+		if hint := tool.Annotations.ReadOnlyHint; hint != nil && *hint {
+			readOnly[tool.Name] = true
+		}
+	}
+	return readOnly
+}
+
+// allowedTools builds OpenAI tool definitions for the allowlisted tools from the MCP server's own
+// schemas. Every name in the allowlist must be advertised by the server.
+func allowedTools(mcpTools []mcp.Tool, allowlist []string) ([]openai.Tool, error) {
+	byName := make(map[string]mcp.Tool)
+	for _, tool := range mcpTools {
+		byName[tool.Name] = tool
+	}
+	var tools []openai.Tool
+	var unknown []string
+	for _, name := range allowlist {
+		name = strings.TrimSpace(name)
+		tool, ok := byName[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		parameters := tool.RawInputSchema
+		if parameters == nil {
+			var err error
+			parameters, err = json.Marshal(tool.InputSchema)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode schema of %s: %w", tool.Name, err)
+			}
+		}
+		tools = append(tools, openai.Tool{
+			Type: "function",
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  json.RawMessage(parameters),
+			},
+		})
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("MCP server has no tools named %s", strings.Join(unknown, ", "))
+	}
+	return tools, nil
+}
+
+// Conversation stores messages of a user
 type Conversation struct {
-	Messages []openai.ChatCompletionMessage
+	Messages []openai.ChatCompletionMessage `json:"messages"`
 }
 
-// Global conversation for single user
-var conversation = &Conversation{
-	Messages: []openai.ChatCompletionMessage{},
+// historyStore keeps conversations by Telegram user ID in a JSON file, so they survive restarts
+type historyStore struct {
+	mu          sync.Mutex
+	path        string
+	maxMessages int
+	users       map[int64]*Conversation
+}
+
+// loadHistory reads the conversations saved at path. A missing file starts with no history, an empty
+// path keeps history in memory only.
+func loadHistory(path string, maxMessages int) (*historyStore, error) {
+	store := &historyStore{path: path, maxMessages: maxMessages, users: make(map[int64]*Conversation)}
+	if path == "" {
+		return store, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.users); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// Messages returns a copy of the user's history
+func (h *historyStore) Messages(userID int64) []openai.ChatCompletionMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if conversation, ok := h.users[userID]; ok {
+		return slices.Clone(conversation.Messages)
+	}
+	return nil
+}
+
+// Append adds messages to the end of the user's history, keeping any messages answered while these
+// waited for a confirmation, trims it to the newest messages and writes the store to disk
+func (h *historyStore) Append(userID int64, messages []openai.ChatCompletionMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var history []openai.ChatCompletionMessage
+	if conversation, ok := h.users[userID]; ok {
+		history = conversation.Messages
+	}
+	h.users[userID] = &Conversation{Messages: trimHistory(slices.Concat(history, messages), h.maxMessages)}
+	return h.write()
+}
+
+// Clear forgets the user's history
+func (h *historyStore) Clear(userID int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.users, userID)
+	return h.write()
+}
+
+// write stores all conversations atomically: to a temporary file first, then renamed over the old one
+func (h *historyStore) write() error {
+	if h.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(h.users)
+	if err != nil {
+		return err
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Unique IDs of the confirmation buttons, their data is the confirmation ID
+const (
+	confirmUnique = "confirm"
+	cancelUnique  = "cancel"
+)
+
+// confirmTimeout is how long a confirmation prompt waits before the call counts as cancelled
+const confirmTimeout = 5 * time.Minute
+
+// confirmationPrompts tracks tool calls waiting for the user to press Confirm or Cancel
+type confirmationPrompts struct {
+	mu      sync.Mutex
+	next    int
+	pending map[string]*confirmationPrompt
+}
+
+// confirmationPrompt is a prompt only the user who asked may answer
+type confirmationPrompt struct {
+	userID int64
+	answer chan bool
+}
+
+var confirmations = &confirmationPrompts{pending: make(map[string]*confirmationPrompt)}
+
+// Ask shows the tool call with Confirm and Cancel buttons and waits for the answer
+func (p *confirmationPrompts) Ask(c tele.Context, toolCall openai.ToolCall) (bool, error) {
+	p.mu.Lock()
+	p.next++
+	id := strconv.Itoa(p.next)
+	answer := make(chan bool, 1)
+	p.pending[id] = &confirmationPrompt{userID: c.Sender().ID, answer: answer}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	arguments := toolCall.Function.Arguments
+	var indented bytes.Buffer
+	if json.Indent(&indented, []byte(arguments), "", "  ") == nil {
+		arguments = indented.String()
+	}
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data("Confirm", confirmUnique, id),
+		markup.Data("Cancel", cancelUnique, id),
+	))
+	if err := c.Send(fmt.Sprintf("Run %s?\n\n%s", toolCall.Function.Name, arguments), markup); err != nil {
+		return false, err
+	}
+
+	select {
+	case confirmed := <-answer:
+		return confirmed, nil
+	case <-time.After(confirmTimeout):
+		return false, c.Send(fmt.Sprintf("No answer, %s was cancelled.", toolCall.Function.Name))
+	}
+}
+
+// Answer resolves the prompt whose button was pressed and removes its buttons. In a group chat
+// only the user the prompt was for can answer it.
+func (p *confirmationPrompts) Answer(c tele.Context, confirmed bool) error {
+	p.mu.Lock()
+	prompt, ok := p.pending[c.Data()]
+	if ok && prompt.userID != c.Sender().ID {
+		p.mu.Unlock()
+		return c.Respond(&tele.CallbackResponse{Text: "Only the user who asked can answer this."})
+	}
+	delete(p.pending, c.Data())
+	p.mu.Unlock()
+	if !ok {
+		return c.Respond(&tele.CallbackResponse{Text: "This request has expired."})
+	}
+	prompt.answer <- confirmed
+	status := "Cancelled."
+	if confirmed {
+		status = "Confirmed."
+	}
+	if err := c.Respond(); err != nil {
+		return err
+	}
+	return c.Edit(c.Message().Text + "\n\n" + status)
+}
+
+// maxToolRounds limits how many times a single message lets the model call tools
+const maxToolRounds = 5
+
+// callTool runs a tool call on the MCP server and returns its result as text for the model
+func callTool(mcpClient *mcpclient.Client, toolCall openai.ToolCall) string {
+	argsMap := make(map[string]any)
+	if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &argsMap); err != nil {
+		return fmt.Sprintf("Error: invalid arguments: %v", err)
+	}
+	log.Printf("Tool call %s arguments: %+v", toolCall.Function.Name, argsMap)
+	result, err := mcpClient.CallTool(context.Background(), mcp.CallToolRequest{
+		Params: mcp.CallToolParams{
+			Name:      toolCall.Function.Name,
+			Arguments: argsMap,
+		},
+	})
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	text := toolResultText(result.Content)
+	if result.IsError {
+		text = "Error: " + text
+	}
+	return text
+}
+
+// toolResultText joins the parts of a tool result. Text is kept as is, other parts are described in
+// brackets since the model only receives text back.
+func toolResultText(content []mcp.Content) string {
+	var parts []string
+	for _, part := range content {
+		switch part := part.(type) {
+		case mcp.TextContent:
+			parts = append(parts, part.Text)
+		case mcp.ImageContent:
+			parts = append(parts, fmt.Sprintf("[image %s]", part.MIMEType))
+		case mcp.AudioContent:
+			parts = append(parts, fmt.Sprintf("[audio %s]", part.MIMEType))
+		case mcp.ResourceLink:
+			parts = append(parts, fmt.Sprintf("[resource %s %s]", part.Name, part.URI))
+		case mcp.EmbeddedResource:
+			if resource, ok := mcp.AsTextResourceContents(part.Resource); ok {
+				parts = append(parts, resource.Text)
+			} else {
+				parts = append(parts, "[binary resource]")
+			}
+		default:
+			parts = append(parts, fmt.Sprintf("[unsupported %T content]", part))
+		}
+	}
+	if len(parts) == 0 {
+		return "(no content)"
+	}
+	return strings.Join(parts, "\n")
+}
+
+// defaultSystemPrompt tells the model it is a GitHub assistant and which tools it has
+func defaultSystemPrompt(tools []openai.Tool) string {
+	var prompt strings.Builder
+	prompt.WriteString("You are a GitHub assistant in a Telegram chat. You act on GitHub through these tools:\n")
+	for _, tool := range tools {
+		prompt.WriteString("- " + tool.Function.Name)
+		if tool.Function.Description != "" {
+			prompt.WriteString(": " + tool.Function.Description)
+		}
+		prompt.WriteString("\n")
+	}
+	prompt.WriteString("Use a tool whenever the user asks to read or change something on GitHub, like opening an issue in a repository. ")
+	prompt.WriteString("Ask for the owner or repository when they are unclear instead of guessing. ")
+	prompt.WriteString("After a tool ran, confirm what was done in one or two sentences and include links from the result. ")
+	prompt.WriteString("Keep answers short, they are read on a phone.")
+	return prompt.String()
+}
+
+// withSystemPrompt puts the system prompt in front of a conversation. It isn't stored in the history,
+// so a changed prompt applies to ongoing conversations and /new needs nothing special.
+func withSystemPrompt(prompt string, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	return append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: prompt}}, messages...)
+}
+
+// replyError logs a failed step in detail and tells the user what went wrong in a few words, instead
+// of leaving them without an answer.
+func replyError(c tele.Context, what string, err error) error {
+	log.Printf("%s failed for user %d: %v", what, c.Sender().ID, err)
+	return c.Send(fmt.Sprintf("Sorry, the %s failed: %s", what, describeError(err)))
+}
+
+// describeError tells configuration problems, which need fixing, apart from transient ones, which
+// are worth retrying.
+func describeError(err error) string {
+	status := 0
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &requestErr):
+		status = requestErr.HTTPStatusCode
+	}
+	var netErr net.Error
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "access was denied, check the API key in the bot's configuration."
+	case status == http.StatusNotFound || status == http.StatusBadRequest:
+		return "the request was rejected, check the model and API URL in the bot's configuration."
+	case status == http.StatusTooManyRequests:
+		return "we are rate limited right now, please try again in a minute."
+	case status >= 500, errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return "the service is having trouble right now, please try again."
+	}
+	return err.Error()
+}
+
+// maxMessageLength is the longest text Telegram accepts in a single message, in UTF-16 code units
+const maxMessageLength = 4096
+
+// editInterval is how often a streamed reply is edited, to stay clear of Telegram's rate limits
+const editInterval = time.Second
+
+// streamCompletion streams a chat completion, calling onContent with the text received so far, and
+// returns the complete message with tool calls assembled from their deltas.
+func streamCompletion(ctx context.Context, client *openai.Client, request openai.ChatCompletionRequest, onContent func(string)) (openai.ChatCompletionMessage, error) {
+	request.Stream = true
+	stream, err := client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return openai.ChatCompletionMessage{}, err
+	}
+	defer stream.Close()
+
+	message := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var content strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return openai.ChatCompletionMessage{}, err
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			onContent(content.String())
+		}
+		for _, toolCall := range delta.ToolCalls {
+			index := len(message.ToolCalls)
+			if toolCall.Index != nil {
+				index = *toolCall.Index
+			}
+			for len(message.ToolCalls) <= index {
+				message.ToolCalls = append(message.ToolCalls, openai.ToolCall{Type: openai.ToolTypeFunction})
+			}
+			call := &message.ToolCalls[index]
+			if toolCall.ID != "" {
+				call.ID = toolCall.ID
+			}
+			call.Function.Name += toolCall.Function.Name
+			call.Function.Arguments += toolCall.Function.Arguments
+		}
+	}
+	message.Content = content.String()
+	return message, nil
+}
+
+// replyStreamer shows a growing reply in Telegram: it sends the first part and edits it as more text
+// arrives, starting another message whenever the reply outgrows maxMessageLength.
+type replyStreamer struct {
+	c      tele.Context
+	sent   []*tele.Message
+	texts  []string
+	edited time.Time
+}
+
+// Update shows text, at most once per editInterval unless final is set
+func (r *replyStreamer) Update(text string, final bool) error {
+	if !final && time.Since(r.edited) < editInterval {
+		return nil
+	}
+	r.edited = time.Now()
+	for i, part := range splitMessage(text, maxMessageLength) {
+		if i < len(r.sent) {
+			if r.texts[i] == part {
+				continue
+			}
+			message, err := r.c.Bot().Edit(r.sent[i], part)
+			if err != nil {
+				return err
+			}
+			r.sent[i], r.texts[i] = message, part
+			continue
+		}
+		message, err := r.c.Bot().Send(r.c.Recipient(), part)
+		if err != nil {
+			return err
+		}
+		r.sent = append(r.sent, message)
+		r.texts = append(r.texts, part)
+	}
+	return nil
+}
+
+// splitMessage cuts text into parts of at most limit UTF-16 code units, the way Telegram counts
+// message length, preferring paragraph breaks, then line breaks, then spaces, so long replies don't
+// break mid-word.
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	for text = strings.TrimSpace(text); text != ""; {
+		// Emoji and other characters outside the BMP take two units
+		end, units := len(text), 0
+		for i, r := range text {
+			if units += utf16.RuneLen(r); units > limit {
+				end = i
+				break
+			}
+		}
+		if end == len(text) {
+			parts = append(parts, text)
+			break
+		}
+		window := text[:end]
+		cut := len(window)
+		for _, boundary := range []string{"\n\n", "\n", " "} {
+			// Only use a boundary in the second half, so parts don't get too short
+			if i := strings.LastIndex(window, boundary); i > len(window)/2 {
+				cut = i
+				break
+			}
+		}
+		parts = append(parts, strings.TrimSpace(text[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	return parts
+}
+
+// keepTyping shows the "typing" chat action until the returned function is called. Telegram clears
+// the action after a few seconds, so it is repeated.
+func keepTyping(c tele.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(4 * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := c.Notify(tele.Typing); err != nil {
+				log.Printf("Failed to send typing action: %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// userLocks holds a mutex per user ID, so a user's messages are answered one after another
+var userLocks sync.Map
+
+// lockUser blocks until the user has no other message in flight and returns the unlock function
+func lockUser(userID int64) func() {
+	mu, _ := userLocks.LoadOrStore(userID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// trimHistory keeps at most maxMessages of the newest messages. The kept history starts at a user
+// message, so tool results never lose the assistant message that requested them.
+func trimHistory(messages []openai.ChatCompletionMessage, maxMessages int) []openai.ChatCompletionMessage {
+	if maxMessages <= 0 || len(messages) <= maxMessages {
+		return messages
+	}
+	messages = messages[len(messages)-maxMessages:]
+	for len(messages) > 0 && messages[0].Role != openai.ChatMessageRoleUser {
+		messages = messages[1:]
+	}
+	return messages
 }
 
 func main() {
@@ -44,16 +656,16 @@ func main() {
 		fmt.Printf("Error parsing environment variables: %+v\n", err)
 		os.Exit(1)
 	}
+	if len(cfg.TelegramAllowedUsers) == 0 {
+		log.Fatal("TELEGRAM_ALLOWED_USERS environment variable must list at least one user ID")
+	}
 
 	// Setup MCP client for GitHub
-	githubMCPCommand := strings.Split(cfg.GithubMCPCommand, " ")
-	// For Docker, we don't need to pass the token in the env slice since it's already in the command
-	var envVars []string
-	if !strings.Contains(cfg.GithubMCPCommand, "docker") {
-		envVars = []string{"GITHUB_PERSONAL_ACCESS_TOKEN=" + cfg.GithubPersonalAccessToken}
-	}
-	stdio := mcptransport.NewStdio(githubMCPCommand[0], envVars, githubMCPCommand[1:]...)
-	mcpClient := mcpclient.NewClient(stdio)
+	transport, err := newMCPTransport(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create transport: %v", err)
+	}
+	mcpClient := mcpclient.NewClient(transport)
 	if err := mcpClient.Start(context.Background()); err != nil {
 		log.Fatalf("Failed to start client: %v", err)
 	}
@@ -68,43 +680,29 @@ func main() {
 	log.Printf("Connected to server: %s v%s", initResult.ServerInfo.Name, initResult.ServerInfo.Version)
 	log.Printf("Server capabilities: %+v", initResult.Capabilities)
 
-	// Define limited set of tools for OpenAI
-	openaiTools := []openai.Tool{
-		{
-			Type: "function",
-			Function: &openai.FunctionDefinition{
-				Name: "create_issue",
-				Parameters: json.RawMessage(`{
-					"type": "object",
-					"properties": {
-						"assignees": {"type": "array", "items": {"type": "string"}},
-						"body":      {"type": "string"},
-						"labels":    {"type": "array", "items": {"type": "string"}},
-						"milestone": {"type": "number"},
-						"owner":     {"type": "string"},
-						"repo":      {"type": "string"},
-						"title":     {"type": "string"}
-					},
-					"required": ["owner", "repo", "title"]
-				}`),
-			},
-		},
-		{
-			Type: "function",
-			Function: &openai.FunctionDefinition{
-				Name: "list_tags",
-				Parameters: json.RawMessage(`{
-					"type": "object",
-					"properties": {
-						"owner":   {"type": "string"},
-						"repo":    {"type": "string"},
-						"page":    {"type": "number"},
-						"perPage": {"type": "number"}
-					},
-					"required": ["owner", "repo", "page", "perPage"]
-				}`),
-			},
-		},
+	// Expose the allowlisted MCP tools to OpenAI, or the default pair without an allowlist
+	openaiTools, readOnly := defaultTools, defaultReadOnlyTools
+	if len(cfg.GithubMCPTools) > 0 {
+		listResult, err := mcpClient.ListTools(context.Background(), mcp.ListToolsRequest{})
+		if err != nil {
+			log.Fatalf("Failed to list tools: %v", err)
+		}
+		openaiTools, err = allowedTools(listResult.Tools, cfg.GithubMCPTools)
+		if err != nil {
+			log.Fatalf("Failed to build tools: %v", err)
+		}
+		readOnly = readOnlyTools(listResult.Tools)
+	}
+	log.Printf("Exposing %d tools to OpenAI", len(openaiTools))
+
+	systemPrompt := cfg.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = defaultSystemPrompt(openaiTools)
+	}
+
+	history, err := loadHistory(cfg.HistoryFile, cfg.MaxHistoryMessages)
+	if err != nil {
+		log.Fatalf("Failed to load history: %v", err)
 	}
 
 	// Setup OpenAI client
@@ -122,22 +720,56 @@ func main() {
 		log.Fatalf("Failed to create bot: %v", err)
 	}
 
+	// Ignore everyone who isn't allowed
+	bot.Use(middleware.Whitelist(cfg.TelegramAllowedUsers...))
+
+	// Handle the buttons of confirmation prompts
+	bot.Handle(&tele.Btn{Unique: confirmUnique}, func(c tele.Context) error {
+		return confirmations.Answer(c, true)
+	})
+	bot.Handle(&tele.Btn{Unique: cancelUnique}, func(c tele.Context) error {
+		return confirmations.Answer(c, false)
+	})
+
 	// Handle /new command
 	bot.Handle("/new", func(c tele.Context) error {
-		conversation.Messages = []openai.ChatCompletionMessage{}
+		if err := history.Clear(c.Sender().ID); err != nil {
+			return replyError(c, "history reset", err)
+		}
 		return c.Send("New conversation started")
 	})
 
+	// Handle /tools command
+	bot.Handle("/tools", func(c tele.Context) error {
+		listResult, err := mcpClient.ListTools(context.Background(), mcp.ListToolsRequest{})
+		if err != nil {
+			return replyError(c, "GitHub tools request", err)
+		}
+		return c.Send(toolsSummary(openaiTools, listResult.Tools, readOnly))
+	})
+
+	// Handle /help command
+	bot.Handle("/help", func(c tele.Context) error {
+		var help strings.Builder
+		help.WriteString("Ask me in plain words to do something on GitHub, e.g. \"open an issue in owner/repo about the broken login\".\n\n")
+		for _, command := range botCommands {
+			help.WriteString(fmt.Sprintf("/%s - %s\n", command.Text, command.Description))
+		}
+		return c.Send(help.String())
+	})
+	if err := bot.SetCommands(botCommands); err != nil {
+		log.Printf("Failed to register commands: %v", err)
+	}
+
 	// Handle text messages (non-command messages)
 	bot.Handle(tele.OnText, func(c tele.Context) error {
 		messageText := c.Text()
 
-		// Initialize conversation if it doesn't exist
-		if conversation == nil {
-			conversation = &Conversation{
-				Messages: []openai.ChatCompletionMessage{},
-			}
-		}
+		// Continue the user's conversation, one message at a time
+		unlock := lockUser(c.Sender().ID)
+		defer func() { unlock() }()
+		conversation := &Conversation{Messages: history.Messages(c.Sender().ID)}
+		previous := len(conversation.Messages)
 
 		// Add user message to conversation
 		conversation.Messages = append(conversation.Messages, openai.ChatCompletionMessage{
@@ -145,59 +777,80 @@ func main() {
 			Content: messageText,
 		})
 
-		// Process with OpenAI
-		response, err := openaiClient.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-			Model:    cfg.OpenAIModel,
-			Messages: conversation.Messages,
-			Tools:    openaiTools,
-		})
-		if err != nil {
-			return err
-		}
+		// Keep showing "typing" until the answer is complete
+		stopTyping := keepTyping(c)
+		defer func() { stopTyping() }()
 
-		// Add assistant response to conversation
-		conversation.Messages = append(conversation.Messages, response.Choices[0].Message)
+		// Ask OpenAI, running the tools it calls until it answers. Text is streamed into messages as it arrives.
+		answered := false
+		for round := 0; ; round++ {
+			reply := &replyStreamer{c: c}
+			message, err := streamCompletion(context.Background(), openaiClient, openai.ChatCompletionRequest{
+				Model:    cfg.OpenAIModel,
+				Messages: withSystemPrompt(systemPrompt, conversation.Messages),
+				Tools:    openaiTools,
+			}, func(text string) {
+				if err := reply.Update(text, false); err != nil {
+					log.Printf("Failed to stream reply: %v", err)
+				}
+			})
+			if err != nil {
+				return replyError(c, "OpenAI request", err)
+			}
+			if err := reply.Update(message.Content, true); err != nil {
+				return err
+			}
+			answered = answered || message.Content != ""
+
+			// Add assistant response to conversation
+			conversation.Messages = append(conversation.Messages, message)
+			if len(message.ToolCalls) == 0 {
+				break
+			}
 
-		// Handle tool calls if present
-		if response.Choices[0].FinishReason == openai.FinishReasonToolCalls {
-			for _, toolCall := range response.Choices[0].Message.ToolCalls {
-				argsMap := make(map[string]any)
-				if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &argsMap); err != nil {
-					return err
+			// Answer every tool call; failures go back to the model as the tool's result.
+			// Tools that change something on GitHub only run once the user confirms.
+			for _, toolCall := range message.ToolCalls {
+				result := "The user cancelled this call."
+				confirmed := readOnly[toolCall.Function.Name]
+				if !confirmed {
+					// Nothing happens until the user answers, so let their other messages through
+					stopTyping()
+					unlock()
+					confirmed, err = confirmations.Ask(c, toolCall)
+					unlock = lockUser(c.Sender().ID)
+					stopTyping = keepTyping(c)
+					if err != nil {
+						return err
+					}
 				}
-				log.Printf("Tool call arguments: %+v", argsMap)
-				toolCallResult, err := mcpClient.CallTool(context.Background(), mcp.CallToolRequest{
-					Params: mcp.CallToolParams{
-						Name:      toolCall.Function.Name,
-						Arguments: argsMap,
-					},
-				})
-				if err != nil {
-					return err
+				if confirmed {
+					result = callTool(mcpClient, toolCall)
 				}
-				toolResultContent := toolCallResult.Content[0].(mcp.TextContent)
 				conversation.Messages = append(conversation.Messages, openai.ChatCompletionMessage{
 					Role:       "tool",
-					Content:    toolResultContent.Text,
+					Content:    result,
 					ToolCallID: toolCall.ID,
 				})
 			}
-
-			// Make the second API call with the complete conversation including tool calls and responses
-			response, err = openaiClient.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
-				Model:    cfg.OpenAIModel,
-				Messages: conversation.Messages,
-				Tools:    openaiTools,
-			})
-			if err != nil {
-				return err
+			if round+1 == maxToolRounds {
+				break
 			}
+		}
 
-			// Add final assistant response to conversation
-			conversation.Messages = append(conversation.Messages, response.Choices[0].Message)
+		// Other messages may have been answered while a confirmation was pending
+		if err := history.Append(c.Sender().ID, conversation.Messages[previous:]); err != nil {
+			log.Printf("Failed to save history: %v", err)
 		}
 
-		return c.Send(response.Choices[0].Message.Content)
+		last := conversation.Messages[len(conversation.Messages)-1]
+		switch {
+		case last.Role == "tool":
+			return c.Send(fmt.Sprintf("Stopped after %d rounds of tool calls without an answer.", maxToolRounds))
+		case !answered:
+			return c.Send("(empty response)")
+		}
+		return nil
 	})
 
 	bot.Start()
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/sashabaranov/go-openai"
+	tele "gopkg.in/telebot.v4"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		want  []string
+	}{
+		{name: "short", text: " hello ", limit: 10, want: []string{"hello"}},
+		{name: "empty", text: "  ", limit: 10, want: nil},
+		{name: "paragraph", text: "aaaa bbbb\n\ncccc", limit: 12, want: []string{"aaaa bbbb", "cccc"}},
+		{name: "space", text: "aaaa bbbb cccc", limit: 10, want: []string{"aaaa bbbb", "cccc"}},
+		{name: "no boundary", text: "abcdefghij", limit: 4, want: []string{"abcd", "efgh", "ij"}},
+		{name: "boundary too early", text: "a bcdefghij", limit: 6, want: []string{"a bcde", "fghij"}},
+		// Telegram counts UTF-16 code units, an emoji takes two
+		{name: "emoji", text: "😀😀😀", limit: 4, want: []string{"😀😀", "😀"}},
+		{name: "cyrillic", text: "привет", limit: 4, want: []string{"прив", "ет"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMessage(tt.text, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMessage(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+			}
+			for _, part := range got {
+				if n := len(utf16.Encode([]rune(part))); n > tt.limit {
+					t.Errorf("part %q is %d UTF-16 units, limit is %d", part, n, tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	message := func(role, content string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: role, Content: content}
+	}
+	history := []openai.ChatCompletionMessage{
+		message(openai.ChatMessageRoleUser, "open an issue"),
+		message(openai.ChatMessageRoleAssistant, "calling create_issue"),
+		message(openai.ChatMessageRoleTool, "issue #1"),
+		message(openai.ChatMessageRoleAssistant, "opened #1"),
+		message(openai.ChatMessageRoleUser, "thanks"),
+		message(openai.ChatMessageRoleAssistant, "you're welcome"),
+	}
+
+	tests := []struct {
+		name        string
+		maxMessages int
+		want        []string
+	}{
+		{name: "unlimited", maxMessages: 0, want: []string{"open an issue", "calling create_issue", "issue #1", "opened #1", "thanks", "you're welcome"}},
+		{name: "under limit", maxMessages: 10, want: []string{"open an issue", "calling create_issue", "issue #1", "opened #1", "thanks", "you're welcome"}},
+		{name: "starts at user", maxMessages: 2, want: []string{"thanks", "you're welcome"}},
+		// The tool result would lose the assistant message that requested it
+		{name: "drops orphaned tool result", maxMessages: 4, want: []string{"thanks", "you're welcome"}},
+		{name: "no user message", maxMessages: 1, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, m := range trimHistory(history, tt.maxMessages) {
+				got = append(got, m.Content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trimHistory(%d) = %q, want %q", tt.maxMessages, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolResultText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []mcp.Content
+		want    string
+	}{
+		{name: "empty", content: nil, want: "(no content)"},
+		{name: "text and image", content: []mcp.Content{mcp.NewTextContent("done"), mcp.NewImageContent("iVBO", "image/png")}, want: "done\n[image image/png]"},
+		{name: "audio", content: []mcp.Content{mcp.NewAudioContent("UklG", "audio/wav")}, want: "[audio audio/wav]"},
+		{name: "resource link", content: []mcp.Content{mcp.NewResourceLink("file:///notes.md", "notes.md", "", "text/markdown")}, want: "[resource notes.md file:///notes.md]"},
+		{name: "text resource", content: []mcp.Content{mcp.NewEmbeddedResource(mcp.TextResourceContents{URI: "file:///notes.md", Text: "# Notes"})}, want: "# Notes"},
+		{name: "binary resource", content: []mcp.Content{mcp.NewEmbeddedResource(mcp.BlobResourceContents{URI: "file:///logo.png", Blob: "iVBO"})}, want: "[binary resource]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toolResultText(tt.content); got != tt.want {
+				t.Errorf("toolResultText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedTools(t *testing.T) {
+	mcpTools := []mcp.Tool{
+		mcp.NewTool("create_issue", mcp.WithDescription("Open an issue"), mcp.WithString("title", mcp.Required())),
+		mcp.NewToolWithRawSchema("list_tags", "List tags", json.RawMessage(`{"type":"object"}`)),
+		mcp.NewTool("delete_repository"),
+	}
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		want      []string
+		wantErr   string
+	}{
+		{name: "allowlisted", allowlist: []string{" create_issue ", "list_tags"}, want: []string{"create_issue", "list_tags"}},
+		{name: "none", allowlist: nil, want: nil},
+		{name: "unknown", allowlist: []string{"create_issue", "merge", "fork"}, wantErr: "merge, fork"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tools, err := allowedTools(mcpTools, tt.allowlist)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error naming %s, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("allowedTools failed: %v", err)
+			}
+			var names []string
+			for _, tool := range tools {
+				names = append(names, tool.Function.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("allowedTools() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+
+	// The MCP server's schemas are passed on, raw ones as they are
+	tools, err := allowedTools(mcpTools, []string{"create_issue", "list_tags"})
+	if err != nil {
+		t.Fatalf("allowedTools failed: %v", err)
+	}
+	if tools[0].Function.Description != "Open an issue" {
+		t.Errorf("description = %q, want the MCP tool's", tools[0].Function.Description)
+	}
+	if params := string(tools[0].Function.Parameters.(json.RawMessage)); !strings.Contains(params, `"title"`) {
+		t.Errorf("create_issue parameters %s are missing title", params)
+	}
+	if params := string(tools[1].Function.Parameters.(json.RawMessage)); params != `{"type":"object"}` {
+		t.Errorf("list_tags parameters = %s, want the raw schema", params)
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "unauthorized", err: &openai.APIError{HTTPStatusCode: 401}, want: "access was denied"},
+		{name: "forbidden", err: &openai.RequestError{HTTPStatusCode: 403}, want: "access was denied"},
+		{name: "wrapped not found", err: fmt.Errorf("stream: %w", &openai.RequestError{HTTPStatusCode: 404}), want: "the request was rejected"},
+		{name: "bad request", err: &openai.APIError{HTTPStatusCode: 400}, want: "the request was rejected"},
+		{name: "rate limited", err: &openai.APIError{HTTPStatusCode: 429}, want: "we are rate limited"},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: 503}, want: "the service is having trouble"},
+		{name: "timeout", err: fmt.Errorf("completion: %w", context.DeadlineExceeded), want: "the service is having trouble"},
+		{name: "network", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: "the service is having trouble"},
+		{name: "other", err: errors.New("model returned no choices"), want: "model returned no choices"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeError(tt.err); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("describeError() = %q, want it to start with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfirmationAnswer(t *testing.T) {
+	// Every Bot API call succeeds
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1}}}`))
+	}))
+	defer api.Close()
+	bot, err := tele.NewBot(tele.Settings{URL: api.URL, Offline: true})
+	if err != nil {
+		t.Fatalf("Failed to create bot: %v", err)
+	}
+
+	prompts := &confirmationPrompts{pending: make(map[string]*confirmationPrompt)}
+	answer := make(chan bool, 1)
+	prompts.pending["1"] = &confirmationPrompt{userID: 1, answer: answer}
+	press := func(userID int64) tele.Context {
+		return tele.NewContext(bot, tele.Update{Callback: &tele.Callback{
+			ID:      "callback",
+			Sender:  &tele.User{ID: userID},
+			Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: 1}, Text: "Run create_issue?"},
+			Data:    "1",
+		}})
+	}
+
+	if err := prompts.Answer(press(2), true); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if len(answer) != 0 || prompts.pending["1"] == nil {
+		t.Fatal("another user answered the prompt")
+	}
+
+	if err := prompts.Answer(press(1), false); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	if confirmed := <-answer; confirmed {
+		t.Error("expected the prompt to be cancelled")
+	}
+	if _, ok := prompts.pending["1"]; ok {
+		t.Error("answered prompt is still pending")
+	}
+}
+
+func TestHistoryAppend(t *testing.T) {
+	message := func(role, content string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: role, Content: content}
+	}
+	path := filepath.Join(t.TempDir(), "history.json")
+	history, err := loadHistory(path, 4)
+	if err != nil {
+		t.Fatalf("loadHistory failed: %v", err)
+	}
+
+	// A message answered while another waited for a confirmation is kept
+	turns := [][]openai.ChatCompletionMessage{
+		{message(openai.ChatMessageRoleUser, "list tags"), message(openai.ChatMessageRoleAssistant, "v1.0")},
+		{message(openai.ChatMessageRoleUser, "open an issue"), message(openai.ChatMessageRoleAssistant, "opened #1")},
+		{message(openai.ChatMessageRoleUser, "thanks"), message(openai.ChatMessageRoleAssistant, "you're welcome")},
+	}
+	for _, turn := range turns {
+		if err := history.Append(1, turn); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+
+	reloaded, err := loadHistory(path, 4)
+	if err != nil {
+		t.Fatalf("loadHistory failed: %v", err)
+	}
+	var got []string
+	for _, m := range reloaded.Messages(1) {
+		got = append(got, m.Content)
+	}
+	if want := []string{"open an issue", "opened #1", "thanks", "you're welcome"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+}
@@ -21,6 +21,13 @@ import (
 
 func main() {
 	cmd := &cli.Command{
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "machine",
+				Aliases: []string{"no-decoration"},
+				Usage:   "suppress banners, emoji and progress messages (enabled automatically when stdout is not a terminal)",
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "resolve",
@@ -33,6 +40,7 @@ func main() {
 						Aliases: []string{"o"},
 						Usage:   "output file for subnets and frequent IPs",
 					},
+					filterCIDRFlag,
 				},
 			},
 			{
@@ -40,6 +48,7 @@ func main() {
 				Aliases: []string{"a"},
 				Usage:   "analyze domain patterns and statistics",
 				Action:  analyzeDomainsAction,
+				Flags:   []cli.Flag{filterCIDRFlag},
 			},
 			{
 				Name:    "fronting",
@@ -68,6 +77,49 @@ func main() {
 	}
 }
 
+var filterCIDRFlag = &cli.StringSliceFlag{
+	Name:  "filter-cidr",
+	Usage: "only report domains resolving into these CIDRs, e.g. 104.16.0.0/12 (repeatable)",
+}
+
+// printer writes command output, dropping decorations in machine mode so
+// the result stays parseable from scripts.
+type printer struct {
+	w       io.Writer
+	machine bool
+}
+
+func newPrinter(cmd *cli.Command) *printer {
+	return &printer{
+		w:       os.Stdout,
+		machine: cmd.Bool("machine") || !isTerminal(os.Stdout),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *printer) header(title string) {
+	if p.machine {
+		return
+	}
+	fmt.Fprintln(p.w, "\n"+strings.Repeat("=", 80))
+	fmt.Fprintln(p.w, title)
+	fmt.Fprintln(p.w, strings.Repeat("=", 80))
+}
+
+func (p *printer) progress(format string, a ...any) {
+	if p.machine {
+		return
+	}
+	fmt.Fprintf(p.w, format, a...)
+}
+
 type DomainResult struct {
 	Domain      string
 	IPv4        []string
@@ -132,22 +184,30 @@ func resolveDomainsAction(ctx context.Context, cmd *cli.Command) error {
 	filename := cmd.Args().First()
 	outputFile := cmd.String("output")
 
+	cidrs, err := parseCIDRs(cmd.StringSlice("filter-cidr"))
+	if err != nil {
+		return err
+	}
+
 	domains, err := readDomainsFromFile(filename)
 	if err != nil {
 		return fmt.Errorf("error reading domains file: %v", err)
 	}
 
-	fmt.Printf("Resolving %d domains...\n", len(domains))
+	p := newPrinter(cmd)
+	p.progress("Resolving %d domains...\n", len(domains))
 
 	results := resolveDomains(domains)
+	if len(cidrs) > 0 {
+		results, _ = filterByCIDR(results, cidrs)
+		p.progress("%d domains resolve into %s\n", len(results), strings.Join(cmd.StringSlice("filter-cidr"), ", "))
+	}
 
 	// Print individual results
-	printResults(results)
+	printResults(p, results)
 
 	// Analyze IP ranges
-	analyzeIPRanges(results, outputFile)
-
-	return nil
+	return analyzeIPRanges(p, results, outputFile)
 }
 
 func analyzeDomainsAction(ctx context.Context, cmd *cli.Command) error {
@@ -156,16 +216,30 @@ func analyzeDomainsAction(ctx context.Context, cmd *cli.Command) error {
 	}
 
 	filename := cmd.Args().First()
+	cidrs, err := parseCIDRs(cmd.StringSlice("filter-cidr"))
+	if err != nil {
+		return err
+	}
+
 	domains, err := readDomainsFromFile(filename)
 	if err != nil {
 		return fmt.Errorf("error reading domains file: %v", err)
 	}
 
-	fmt.Printf("Analyzing %d domains...\n", len(domains))
+	p := newPrinter(cmd)
+	if len(cidrs) > 0 {
+		p.progress("Resolving %d domains...\n", len(domains))
+		matched, _ := filterByCIDR(resolveDomains(domains), cidrs)
+		domains = domains[:0]
+		for _, result := range matched {
+			domains = append(domains, result.Domain)
+		}
+	}
+	p.progress("Analyzing %d domains...\n", len(domains))
 
 	// Basic domain analysis
 	domainStats := analyzeDomainPatterns(domains)
-	printDomainAnalysis(domainStats)
+	printDomainAnalysis(p, domainStats)
 
 	return nil
 }
@@ -183,17 +257,16 @@ func checkIPsAction(ctx context.Context, cmd *cli.Command) error {
 		return fmt.Errorf("error reading IPs file: %v", err)
 	}
 
-	fmt.Printf("Checking %d IPs/subnets...\n", len(ips))
+	p := newPrinter(cmd)
+	p.progress("Checking %d IPs/subnets...\n", len(ips))
 
 	results := checkIPs(ips)
 
 	// Print individual results
-	printIPCheckResults(results)
+	printIPCheckResults(p, results)
 
 	// Group by geo info and owner
-	groupByGeoAndOwner(results, outputFile)
-
-	return nil
+	return groupByGeoAndOwner(p, results, outputFile)
 }
 
 func readIPsFromFile(filename string) ([]string, error) {
@@ -273,8 +346,51 @@ func resolveDomains(domains []string) []DomainResult {
 	return results
 }
 
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+	return cidrs, nil
+}
+
+// filterByCIDR partitions results into domains with at least one IP inside
+// the given CIDRs, narrowed down to just the matching IPs, and the rest
+func filterByCIDR(results []DomainResult, cidrs []*net.IPNet) (matched, unmatched []DomainResult) {
+	inCIDRs := func(ips []string) []string {
+		var out []string
+		for _, ipStr := range ips {
+			ip := net.ParseIP(ipStr)
+			for _, cidr := range cidrs {
+				if ip != nil && cidr.Contains(ip) {
+					out = append(out, ipStr)
+					break
+				}
+			}
+		}
+		return out
+	}
+
+	for _, result := range results {
+		filtered := result
+		filtered.IPv4 = inCIDRs(result.IPv4)
+		filtered.IPv6 = inCIDRs(result.IPv6)
+		if len(filtered.IPv4) == 0 && len(filtered.IPv6) == 0 {
+			unmatched = append(unmatched, result)
+			continue
+		}
+		matched = append(matched, filtered)
+	}
+	return matched, unmatched
+}
+
 func checkIPs(ips []string) []IPCheckResult {
 	var allResults []IPCheckResult
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 
 	for _, ip := range ips {
@@ -307,7 +423,9 @@ func checkIPs(ips []string) []IPCheckResult {
 					}
 
 					result.CheckTime = time.Since(start)
+					mu.Lock()
 					allResults = append(allResults, result)
+					mu.Unlock()
 				}(sampleIP, ip)
 			}
 		} else {
@@ -336,7 +454,9 @@ func checkIPs(ips []string) []IPCheckResult {
 				}
 
 				result.CheckTime = time.Since(start)
+				mu.Lock()
 				allResults = append(allResults, result)
+				mu.Unlock()
 			}(ip)
 		}
 	}
@@ -523,52 +643,46 @@ func getSampleIPsFromCIDR(cidr string) []string {
 	return sampleIPs
 }
 
-func printResults(results []DomainResult) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("DOMAIN RESOLUTION RESULTS")
-	fmt.Println(strings.Repeat("=", 80))
+func printResults(p *printer, results []DomainResult) {
+	p.header("DOMAIN RESOLUTION RESULTS")
 
 	for _, result := range results {
-		fmt.Printf("\nDomain: %s\n", result.Domain)
+		fmt.Fprintf(p.w, "\nDomain: %s\n", result.Domain)
 		if result.Error != "" {
-			fmt.Printf("  Error: %s\n", result.Error)
+			fmt.Fprintf(p.w, "  Error: %s\n", result.Error)
 		} else {
 			if len(result.IPv4) > 0 {
-				fmt.Printf("  IPv4: %s\n", strings.Join(result.IPv4, ", "))
+				fmt.Fprintf(p.w, "  IPv4: %s\n", strings.Join(result.IPv4, ", "))
 			}
 			if len(result.IPv6) > 0 {
-				fmt.Printf("  IPv6: %s\n", strings.Join(result.IPv6, ", "))
+				fmt.Fprintf(p.w, "  IPv6: %s\n", strings.Join(result.IPv6, ", "))
 			}
 		}
-		fmt.Printf("  Resolve time: %v\n", result.ResolveTime)
+		fmt.Fprintf(p.w, "  Resolve time: %v\n", result.ResolveTime)
 	}
 }
 
-func printIPCheckResults(results []IPCheckResult) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("IP CHECK RESULTS")
-	fmt.Println(strings.Repeat("=", 80))
+func printIPCheckResults(p *printer, results []IPCheckResult) {
+	p.header("IP CHECK RESULTS")
 
 	for _, result := range results {
-		fmt.Printf("\nIP: %s\n", result.IP)
+		fmt.Fprintf(p.w, "\nIP: %s\n", result.IP)
 		if result.Error != "" {
-			fmt.Printf("  Error: %s\n", result.Error)
+			fmt.Fprintf(p.w, "  Error: %s\n", result.Error)
 		} else {
-			fmt.Printf("  Country: %s (%s)\n", result.Country, result.CountryCode)
-			fmt.Printf("  Region: %s\n", result.Region)
-			fmt.Printf("  City: %s\n", result.City)
-			fmt.Printf("  ISP: %s\n", result.ISP)
-			fmt.Printf("  Organization: %s\n", result.Org)
-			fmt.Printf("  ASN: %s\n", result.ASN)
+			fmt.Fprintf(p.w, "  Country: %s (%s)\n", result.Country, result.CountryCode)
+			fmt.Fprintf(p.w, "  Region: %s\n", result.Region)
+			fmt.Fprintf(p.w, "  City: %s\n", result.City)
+			fmt.Fprintf(p.w, "  ISP: %s\n", result.ISP)
+			fmt.Fprintf(p.w, "  Organization: %s\n", result.Org)
+			fmt.Fprintf(p.w, "  ASN: %s\n", result.ASN)
 		}
-		fmt.Printf("  Check time: %v\n", result.CheckTime)
+		fmt.Fprintf(p.w, "  Check time: %v\n", result.CheckTime)
 	}
 }
 
-func groupByGeoAndOwner(results []IPCheckResult, outputFile string) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("GROUPED ANALYSIS")
-	fmt.Println(strings.Repeat("=", 80))
+func groupByGeoAndOwner(p *printer, results []IPCheckResult, outputFile string) error {
+	p.header("GROUPED ANALYSIS")
 
 	// Group by geographic location
 	geoGroups := make(map[string]*GeoGroup)
@@ -608,7 +722,7 @@ func groupByGeoAndOwner(results []IPCheckResult, outputFile string) {
 	}
 
 	// Print geographic groups
-	fmt.Println("\nBy Geographic Location:")
+	fmt.Fprintln(p.w, "\nBy Geographic Location:")
 	var geoList []*GeoGroup
 	for _, group := range geoGroups {
 		geoList = append(geoList, group)
@@ -618,14 +732,14 @@ func groupByGeoAndOwner(results []IPCheckResult, outputFile string) {
 	})
 
 	for _, group := range geoList {
-		fmt.Printf("\n  %s, %s, %s (%d IPs)\n", group.City, group.Region, group.Country, group.Count)
+		fmt.Fprintf(p.w, "\n  %s, %s, %s (%d IPs)\n", group.City, group.Region, group.Country, group.Count)
 		for _, ip := range group.IPs {
-			fmt.Printf("    %s\n", ip.IP)
+			fmt.Fprintf(p.w, "    %s\n", ip.IP)
 		}
 	}
 
 	// Print owner groups
-	fmt.Println("\nBy Owner/ISP:")
+	fmt.Fprintln(p.w, "\nBy Owner/ISP:")
 	var ownerList []*OwnerGroup
 	for _, group := range ownerGroups {
 		ownerList = append(ownerList, group)
@@ -635,28 +749,27 @@ func groupByGeoAndOwner(results []IPCheckResult, outputFile string) {
 	})
 
 	for _, group := range ownerList {
-		fmt.Printf("\n  %s / %s / %s (%d IPs)\n", group.Org, group.ISP, group.ASN, group.Count)
+		fmt.Fprintf(p.w, "\n  %s / %s / %s (%d IPs)\n", group.Org, group.ISP, group.ASN, group.Count)
 		for _, ip := range group.IPs {
-			fmt.Printf("    %s\n", ip.IP)
+			fmt.Fprintf(p.w, "    %s\n", ip.IP)
 		}
 	}
 
 	// Write to output file if specified
 	if outputFile != "" {
-		writeIPCheckAnalysisToFile(geoList, ownerList, outputFile)
+		return writeIPCheckAnalysisToFile(p, geoList, ownerList, outputFile)
 	}
+	return nil
 }
 
-func writeIPCheckAnalysisToFile(geoGroups []*GeoGroup, ownerGroups []*OwnerGroup, filename string) {
+func writeIPCheckAnalysisToFile(p *printer, geoGroups []*GeoGroup, ownerGroups []*OwnerGroup, filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
-		return
+		return fmt.Errorf("error creating output file: %v", err)
 	}
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
-	defer writer.Flush()
 
 	// Write geographic groups
 	writer.WriteString("# Geographic Groups\n")
@@ -676,13 +789,18 @@ func writeIPCheckAnalysisToFile(geoGroups []*GeoGroup, ownerGroups []*OwnerGroup
 		}
 	}
 
-	fmt.Printf("\nIP analysis written to: %s\n", filename)
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	p.progress("\nIP analysis written to: %s\n", filename)
+	return nil
 }
 
-func analyzeIPRanges(results []DomainResult, outputFile string) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("IP RANGE ANALYSIS")
-	fmt.Println(strings.Repeat("=", 80))
+func analyzeIPRanges(p *printer, results []DomainResult, outputFile string) error {
+	p.header("IP RANGE ANALYSIS")
 
 	allIPs := make(map[string]int)
 
@@ -701,15 +819,15 @@ func analyzeIPRanges(results []DomainResult, outputFile string) {
 	// Find common subnets
 	subnets := findCommonSubnets(allIPs)
 
-	fmt.Printf("\nTotal unique IPs found: %d\n", len(allIPs))
-	fmt.Printf("Common subnets:\n")
+	fmt.Fprintf(p.w, "\nTotal unique IPs found: %d\n", len(allIPs))
+	fmt.Fprintf(p.w, "Common subnets:\n")
 
 	for _, subnet := range subnets {
-		fmt.Printf("  %s (%s) - %d IPs\n", subnet.Network, subnet.CIDR, subnet.Count)
+		fmt.Fprintf(p.w, "  %s (%s) - %d IPs\n", subnet.Network, subnet.CIDR, subnet.Count)
 	}
 
 	// Show IPs by frequency
-	fmt.Println("\nIPs by frequency:")
+	fmt.Fprintln(p.w, "\nIPs by frequency:")
 	var ipFreq []struct {
 		IP   string
 		Freq int
@@ -728,29 +846,28 @@ func analyzeIPRanges(results []DomainResult, outputFile string) {
 
 	for _, item := range ipFreq {
 		if item.Freq > 1 {
-			fmt.Printf("  %s: %d domains\n", item.IP, item.Freq)
+			fmt.Fprintf(p.w, "  %s: %d domains\n", item.IP, item.Freq)
 		}
 	}
 
 	// Write to output file if specified
 	if outputFile != "" {
-		writeIPAnalysisToFile(subnets, ipFreq, outputFile)
+		return writeIPAnalysisToFile(p, subnets, ipFreq, outputFile)
 	}
+	return nil
 }
 
-func writeIPAnalysisToFile(subnets []IPRange, ipFreq []struct {
+func writeIPAnalysisToFile(p *printer, subnets []IPRange, ipFreq []struct {
 	IP   string
 	Freq int
-}, filename string) {
+}, filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
-		return
+		return fmt.Errorf("error creating output file: %v", err)
 	}
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
-	defer writer.Flush()
 
 	// Write subnets
 	writer.WriteString("# Common Subnets\n")
@@ -766,7 +883,14 @@ func writeIPAnalysisToFile(subnets []IPRange, ipFreq []struct {
 		}
 	}
 
-	fmt.Printf("\nIP analysis written to: %s\n", filename)
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing output file: %v", err)
+	}
+	p.progress("\nIP analysis written to: %s\n", filename)
+	return nil
 }
 
 func findCommonSubnets(ips map[string]int) []IPRange {
@@ -853,15 +977,13 @@ func analyzeDomainPatterns(domains []string) DomainStats {
 	return stats
 }
 
-func printDomainAnalysis(stats DomainStats) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("DOMAIN ANALYSIS")
-	fmt.Println(strings.Repeat("=", 80))
+func printDomainAnalysis(p *printer, stats DomainStats) {
+	p.header("DOMAIN ANALYSIS")
 
-	fmt.Printf("\nTotal domains: %d\n", stats.TotalDomains)
-	fmt.Printf("Average domain length: %.2f characters\n", stats.AverageLength)
+	fmt.Fprintf(p.w, "\nTotal domains: %d\n", stats.TotalDomains)
+	fmt.Fprintf(p.w, "Average domain length: %.2f characters\n", stats.AverageLength)
 
-	fmt.Println("\nTop TLDs:")
+	fmt.Fprintln(p.w, "\nTop TLDs:")
 	var tldFreq []struct {
 		TLD   string
 		Count int
@@ -880,12 +1002,12 @@ func printDomainAnalysis(stats DomainStats) {
 		if i >= 10 { // Show top 10
 			break
 		}
-		fmt.Printf("  %s: %d domains\n", item.TLD, item.Count)
+		fmt.Fprintf(p.w, "  %s: %d domains\n", item.TLD, item.Count)
 	}
 
-	fmt.Println("\nCommon patterns:")
+	fmt.Fprintln(p.w, "\nCommon patterns:")
 	for _, pattern := range stats.CommonPatterns {
-		fmt.Printf("  %s\n", pattern)
+		fmt.Fprintf(p.w, "  %s\n", pattern)
 	}
 }
 
@@ -907,10 +1029,11 @@ func domainFrontingAction(ctx context.Context, cmd *cli.Command) error {
 	yourDomain := cmd.Args().Get(0)
 	targetDomain := cmd.Args().Get(1)
 
-	fmt.Printf("Testing domain fronting: %s -> %s\n", yourDomain, targetDomain)
+	p := newPrinter(cmd)
+	p.progress("Testing domain fronting: %s -> %s\n", yourDomain, targetDomain)
 
 	result := testDomainFronting(yourDomain, targetDomain)
-	printFrontingResult(result)
+	printFrontingResult(p, result)
 
 	return nil
 }
@@ -1019,32 +1142,34 @@ func testDomainFronting(yourDomain, targetDomain string) FrontingResult {
 	return result
 }
 
-func printFrontingResult(result FrontingResult) {
-	fmt.Println("\n" + strings.Repeat("=", 80))
-	fmt.Println("DOMAIN FRONTING TEST RESULTS")
-	fmt.Println(strings.Repeat("=", 80))
+func printFrontingResult(p *printer, result FrontingResult) {
+	p.header("DOMAIN FRONTING TEST RESULTS")
 
-	fmt.Printf("\nYour Domain: %s\n", result.YourDomain)
-	fmt.Printf("Target Domain: %s\n", result.TargetDomain)
+	fmt.Fprintf(p.w, "\nYour Domain: %s\n", result.YourDomain)
+	fmt.Fprintf(p.w, "Target Domain: %s\n", result.TargetDomain)
 
 	if result.Error != "" {
-		fmt.Printf("Error: %s\n", result.Error)
+		fmt.Fprintf(p.w, "Error: %s\n", result.Error)
 		return
 	}
 
-	fmt.Printf("Domain Fronting Possible: %t\n", result.Possible)
-	fmt.Printf("Reason: %s\n", result.Reason)
+	fmt.Fprintf(p.w, "Domain Fronting Possible: %t\n", result.Possible)
+	fmt.Fprintf(p.w, "Reason: %s\n", result.Reason)
 
 	if result.SNIResponse != "" {
-		fmt.Printf("Certificate Subject: %s\n", result.SNIResponse)
+		fmt.Fprintf(p.w, "Certificate Subject: %s\n", result.SNIResponse)
 	}
 
-	fmt.Printf("Test Duration: %v\n", result.TestDuration)
+	fmt.Fprintf(p.w, "Test Duration: %v\n", result.TestDuration)
+
+	if p.machine {
+		return
+	}
 
 	if result.Possible {
-		fmt.Println("\n⚠️  WARNING: Domain fronting appears to be possible!")
-		fmt.Println("   This could potentially be used to bypass domain-based filtering.")
+		fmt.Fprintln(p.w, "\n⚠️  WARNING: Domain fronting appears to be possible!")
+		fmt.Fprintln(p.w, "   This could potentially be used to bypass domain-based filtering.")
 	} else {
-		fmt.Println("\n✅ Domain fronting does not appear to be possible.")
+		fmt.Fprintln(p.w, "\n✅ Domain fronting does not appear to be possible.")
 	}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMachineModeOutput(t *testing.T) {
+	var buf bytes.Buffer
+	p := &printer{w: &buf, machine: true}
+
+	p.progress("Resolving %d domains...\n", 1)
+	printResults(p, []DomainResult{
+		{Domain: "example.com", IPv4: []string{"93.184.216.34"}, ResolveTime: time.Millisecond},
+	})
+	if err := analyzeIPRanges(p, []DomainResult{
+		{Domain: "a.example.com", IPv4: []string{"10.0.0.1"}},
+		{Domain: "b.example.com", IPv4: []string{"10.0.0.1"}},
+	}, ""); err != nil {
+		t.Fatal(err)
+	}
+	printDomainAnalysis(p, analyzeDomainPatterns([]string{"a.example.com", "b.example.com"}))
+	printIPCheckResults(p, []IPCheckResult{{IP: "10.0.0.1", Country: "Nowhere"}})
+	if err := groupByGeoAndOwner(p, []IPCheckResult{{IP: "10.0.0.1", Country: "Nowhere"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	printFrontingResult(p, FrontingResult{YourDomain: "a.example.com", TargetDomain: "b.example.com", Possible: true})
+	printFrontingResult(p, FrontingResult{YourDomain: "a.example.com", TargetDomain: "b.example.com"})
+
+	out := buf.String()
+	for _, s := range []string{strings.Repeat("=", 10), "⚠️", "✅", "Resolving"} {
+		if strings.Contains(out, s) {
+			t.Errorf("machine mode output contains %q:\n%s", s, out)
+		}
+	}
+	if !strings.Contains(out, "example.com") {
+		t.Errorf("machine mode output is missing results:\n%s", out)
+	}
+}
+
+func TestDecoratedOutput(t *testing.T) {
+	var buf bytes.Buffer
+	p := &printer{w: &buf}
+
+	printFrontingResult(p, FrontingResult{YourDomain: "a.example.com", TargetDomain: "b.example.com", Possible: true})
+
+	out := buf.String()
+	if !strings.Contains(out, strings.Repeat("=", 80)) || !strings.Contains(out, "⚠️") {
+		t.Errorf("expected banner and emoji in decorated output:\n%s", out)
+	}
+}
+
+func TestFilterByCIDR(t *testing.T) {
+	cidrs, err := parseCIDRs([]string{"104.16.0.0/12", "2606:4700::/32"})
+	if err != nil {
+		t.Fatalf("parseCIDRs failed: %v", err)
+	}
+	results := []DomainResult{
+		{Domain: "cdn.example.com", IPv4: []string{"104.18.1.1", "8.8.8.8"}},
+		{Domain: "v6.example.com", IPv6: []string{"2606:4700::6810:84e5"}},
+		{Domain: "other.example.com", IPv4: []string{"93.184.216.34"}},
+		{Domain: "broken.example.com", Error: "no such host"},
+	}
+
+	matched, unmatched := filterByCIDR(results, cidrs)
+
+	if len(matched) != 2 || matched[0].Domain != "cdn.example.com" || matched[1].Domain != "v6.example.com" {
+		t.Fatalf("unexpected matched domains: %+v", matched)
+	}
+	if !reflect.DeepEqual(matched[0].IPv4, []string{"104.18.1.1"}) {
+		t.Errorf("expected only the matching IP, got %v", matched[0].IPv4)
+	}
+	if len(unmatched) != 2 || unmatched[0].Domain != "other.example.com" || unmatched[1].Domain != "broken.example.com" {
+		t.Errorf("unexpected unmatched domains: %+v", unmatched)
+	}
+
+	if _, err := parseCIDRs([]string{"104.16.0.0"}); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}